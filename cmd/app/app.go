@@ -23,6 +23,7 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/cert-manager/istio-csr/cmd/app/options"
+	"github.com/cert-manager/istio-csr/pkg/cleanup"
 	"github.com/cert-manager/istio-csr/pkg/controller"
 	"github.com/cert-manager/istio-csr/pkg/server"
 	agenttls "github.com/cert-manager/istio-csr/pkg/tls"
@@ -48,9 +49,14 @@ func NewCommand(ctx context.Context) *cobra.Command {
 
 			readyz := healthz.New()
 
+			// Run the deletion workers of created CertificateRequests. The
+			// periodic sweep is run by the leader only.
+			cleaner := cleanup.New(opts.Logr, opts.CertManagerOptions, opts.KubeOptions)
+			go cleaner.Run(ctx)
+
 			// Create a new TLS provider for the serving certificate and private key.
 			tlsProvider, err := agenttls.NewProvider(ctx, opts.Logr, opts.TLSOptions,
-				opts.KubeOptions, opts.CertManagerOptions, readyz.Register())
+				opts.KubeOptions, opts.CertManagerOptions, cleaner, readyz.Register())
 			if err != nil {
 				return err
 			}
@@ -62,26 +68,47 @@ func NewCommand(ctx context.Context) *cobra.Command {
 			}
 
 			// Create an new server instance that implements the certificate signing API
-			server := server.New(opts.Logr,
-				opts.CertManagerOptions, opts.KubeOptions,
-				readyz.Register())
-
-			// Build the data which should be present in the well-known configmap in
-			// all namespaces.
-			rootCAConfigData := map[string]string{
-				"root-cert.pem": fmt.Sprintf("%s", tlsProvider.RootCA()),
+			server, err := server.New(opts.Logr,
+				opts.CertManagerOptions, opts.KubeOptions, opts.TLSOptions, opts.AuthzOptions,
+				tlsProvider, cleaner, readyz.Register())
+			if err != nil {
+				return err
 			}
 
-			// Build and run the namespace controller to distribute the root CA
-			rootCAController, err := controller.NewCARootController(opts, rootCAConfigData, readyz.Check)
+			// Build and run the namespace controller to distribute the root CA,
+			// which is updated when the provider's root CA changes. The
+			// provider's Secret certificate issuers, and the CertificateRequest
+			// sweeper, are run by the leader only.
+			rootCAController, err := controller.NewCARootController(opts, tlsProvider, readyz.Check,
+				append(tlsProvider.Runnables(), cleaner.Sweeper())...)
 			if err != nil {
 				return fmt.Errorf("failed to create new controller: %s", err)
 			}
 
-			go rootCAController.Run(ctx)
+			// The controller blocks until this replica is the leader, while the
+			// signing service is served by every replica. If the controller
+			// stops, for example on losing leadership, the signing service is
+			// stopped too so that the replica is restarted as a candidate.
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			controllerErr := make(chan error, 1)
+			go func() {
+				defer cancel()
+				controllerErr <- rootCAController.Run(ctx)
+			}()
 
 			// Run the istio agent certificate signing service
-			return server.Run(ctx, tlsConfig, opts.ServingAddress)
+			if err := server.Run(ctx, tlsConfig, opts.ServingAddress); err != nil {
+				return err
+			}
+
+			cancel()
+			if err := <-controllerErr; err != nil {
+				return fmt.Errorf("controller stopped: %s", err)
+			}
+
+			return nil
 		},
 	}
 
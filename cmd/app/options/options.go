@@ -17,8 +17,15 @@ limitations under the License.
 package options
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -30,6 +37,9 @@ import (
 	"istio.io/istio/pkg/jwt"
 	"istio.io/istio/pkg/spiffe"
 	"istio.io/istio/security/pkg/server/ca/authenticate"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
@@ -39,6 +49,8 @@ import (
 	cliflag "k8s.io/component-base/cli/flag"
 	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
 )
 
 // Options is a struct to hold options for cert-manager-istio-csr
@@ -47,6 +59,8 @@ type Options struct {
 	*CertManagerOptions
 	*TLSOptions
 	*KubeOptions
+	*AuthzOptions
+	*ControllerOptions
 }
 
 type AppOptions struct {
@@ -55,6 +69,15 @@ type AppOptions struct {
 
 	ReadyzPort int
 	ReadyzPath string
+
+	// MetricsPort is the port Prometheus metrics are served on.
+	MetricsPort int
+
+	// PodName and PodNamespace are the name and namespace of the running
+	// istio-csr pod, sourced from the POD_NAME and POD_NAMESPACE environment
+	// variables. Used to record events.
+	PodName      string
+	PodNamespace string
 }
 
 type CertManagerOptions struct {
@@ -67,17 +90,192 @@ type CertManagerOptions struct {
 	Namespace   string
 	PreserveCRs bool
 	IssuerRef   cmmeta.ObjectReference
+
+	PreserveCRsRetention time.Duration
+	OrphanedCRsAge       time.Duration
+	CleanupSweepInterval time.Duration
+
+	ApproveCRs bool
+	DenyCRs    bool
+	Username   string
+
+	// DenyCRsAllowedUsernames are usernames, other than istio-csr's, whose
+	// CertificateRequests referencing the issuer are not denied.
+	DenyCRsAllowedUsernames []string
+
+	migrationIssuerName  string
+	migrationIssuerKind  string
+	migrationIssuerGroup string
+
+	// MigrationIssuerRef is the target issuer of a migration. If nil, no
+	// migration is configured.
+	MigrationIssuerRef  *cmmeta.ObjectReference
+	MigrationPercentage int
+	MigrationStrategy   string
 }
 
 type TLSOptions struct {
-	RootCACertFile             string
-	RootCAConfigMapName        string
+	RootCACertFile        string
+	RootCAConfigMapName   string
+	RootCASourceKind      string
+	RootCASourceName      string
+	RootCASourceNamespace string
+	RootCASourceKey       string
+	RootCARetention       time.Duration
+
+	// RootCARetentionConfigMapName, if set, is the ConfigMap in the
+	// certificate namespace which the root CA and retired root CAs are
+	// persisted in, so that they are retained across restarts.
+	RootCARetentionConfigMapName string
+
 	ServingAddress             string
 	ServingCertificateDuration time.Duration
 
+	// ServingCertificateRenewalFraction is the fraction of the issued duration
+	// after which certificates are renewed. The serving certificate is not
+	// ready once within ServingCertificateExpiryDangerWindow of its expiry.
+	ServingCertificateRenewalFraction    float64
+	ServingCertificateExpiryDangerWindow time.Duration
+
+	// ServingCertificateDNSNames, ServingCertificateIPAddresses and
+	// ServingCertificateKeyAlgorithm are the SANs and key of requested serving
+	// certificates. ServingCertificateIdentity is the identity annotated on
+	// their CertificateRequests.
+	ServingCertificateDNSNames     []string
+	servingCertificateIPAddresses  []string
+	ServingCertificateIPAddresses  []net.IP
+	servingCertificateKeyAlgorithm string
+	ServingCertificateKeyAlgorithm util.KeyAlgorithm
+	ServingCertificateIdentity     string
+
+	// ServingCertificateDir, or the ServingCertificateSecretName Secret in
+	// ServingCertificateSecretNamespace, if set, is the kubernetes.io/tls
+	// source of the serving certificate, rather than requesting it from the
+	// issuer.
+	ServingCertificateDir             string
+	ServingCertificateSecretName      string
+	ServingCertificateSecretNamespace string
+
+	// ServingCertificateStoreSecretName, if set, is the Secret in
+	// ServingCertificateStoreNamespace that requested serving certificates are
+	// stored in and shared between replicas, coordinated by a Lease of the
+	// same name suffixed with "-renewal".
+	ServingCertificateStoreSecretName string
+	ServingCertificateStoreNamespace  string
+
+	// TLSMinVersion, TLSMaxVersion, TLSCipherSuites and TLSCurvePreferences
+	// restrict the TLS versions, cipher suites and key exchange curves
+	// negotiated by the gRPC service. If FIPS is true, they are restricted to a
+	// FIPS-approved profile, and only FIPS-approved key types are accepted in
+	// workload CSRs and for serving keys.
+	tlsMinVersion       string
+	TLSMinVersion       uint16
+	tlsMaxVersion       string
+	TLSMaxVersion       uint16
+	tlsCipherSuites     []string
+	TLSCipherSuites     []uint16
+	tlsCurvePreferences []string
+	TLSCurvePreferences []tls.CurveID
+	FIPS                bool
+
+	// IstiodCertificate, if true, issues and renews istiod's serving
+	// certificate, written to the IstiodCertificateSecretName Secret in
+	// IstiodNamespace. IstiodRevisions are the istio revisions the certificate
+	// serves, derived from the configured revisions. The certificate carries
+	// the SPIFFE identity of IstiodServiceAccountName.
+	IstiodCertificate             bool
+	IstiodCertificateSecretName   string
+	IstiodCertificateDuration     time.Duration
+	istiodCertificateKeyAlgorithm string
+	IstiodCertificateKeyAlgorithm util.KeyAlgorithm
+	IstiodServiceName             string
+	IstiodServiceAccountName      string
+	IstiodNamespace               string
+	IstiodRevisions               []string
+
+	// CACerts, if true, issues and renews an intermediate CA for istiod's
+	// built-in CA, written to the CACertsSecretName plug-in CA Secret in
+	// CACertsNamespace, with a CACertsKeyAlgorithm private key.
+	CACerts             bool
+	CACertsSecretName   string
+	CACertsDuration     time.Duration
+	CACertsNamespace    string
+	caCertsKeyAlgorithm string
+	CACertsKeyAlgorithm util.KeyAlgorithm
+
 	ClusterID string
 }
 
+type AuthzOptions struct {
+	PolicyConfigMapName      string
+	PolicyConfigMapNamespace string
+
+	webhookCAFile   string
+	WebhookURL      string
+	WebhookCABundle []byte
+	WebhookTimeout  time.Duration
+	WebhookFailOpen bool
+
+	AdmissionPort             int
+	AdmissionCertDir          string
+	AdmissionAllowedUsernames []string
+	AdmissionTrustedUsernames []string
+}
+
+type ControllerOptions struct {
+	namespaceSelector string
+
+	// NamespaceSelector selects the namespaces the root CA ConfigMap is
+	// distributed to, by label.
+	NamespaceSelector          labels.Selector
+	IncludeNamespaces          []string
+	ExcludeNamespaces          []string
+	RemoveUnselectedConfigMaps bool
+
+	// WatchNamespaces, if set, restricts the controller to only these
+	// namespaces, never listing or watching cluster-scoped resources.
+	WatchNamespaces []string
+
+	// ConfigMapLabelSelector, if not empty, further restricts the cached root
+	// CA ConfigMaps to those matching it, on top of their names.
+	configMapLabelSelector string
+	ConfigMapLabelSelector labels.Selector
+
+	// RevisionConfigMapNames are the names of the root CA ConfigMap for istio
+	// revisions, selected by the istio.io/rev Namespace label.
+	RevisionConfigMapNames map[string]string
+
+	// RevisionRootCAs are the root CA bundles distributed to namespaces of
+	// istio revisions, read once from revisionRootCAFiles. They are not
+	// watched for changes, and root CA retention doesn't apply to them.
+	revisionRootCAFiles map[string]string
+	RevisionRootCAs     map[string][]byte
+
+	// DefaultRevision is the revision of Namespaces without the istio.io/rev
+	// label.
+	DefaultRevision string
+
+	// WebhookCABundleSelector and WebhookCABundleNames select the webhook
+	// configurations whose caBundle is kept equal to the root CA.
+	webhookCABundleSelector string
+	WebhookCABundleSelector labels.Selector
+	WebhookCABundleNames    []string
+
+	// RemoteClusters, if true, distributes the root CA to the remote clusters
+	// of istio remote secrets in RemoteClusterSecretNamespace.
+	RemoteClusters               bool
+	RemoteClusterSecretNamespace string
+
+	// LeaderElection, if true, only runs the controllers on the replica
+	// holding the Lease LeaderElectionID in LeaderElectionNamespace.
+	LeaderElection              bool
+	LeaderElectionID            string
+	LeaderElectionNamespace     string
+	LeaderElectionLeaseDuration time.Duration
+	LeaderElectionRenewDeadline time.Duration
+	LeaderElectionRetryPeriod   time.Duration
+}
+
 type KubeOptions struct {
 	kubeConfigFlags *genericclioptions.ConfigFlags
 
@@ -93,6 +291,8 @@ func New() *Options {
 		CertManagerOptions: new(CertManagerOptions),
 		TLSOptions:         new(TLSOptions),
 		KubeOptions:        new(KubeOptions),
+		AuthzOptions:       new(AuthzOptions),
+		ControllerOptions:  new(ControllerOptions),
 	}
 }
 
@@ -107,6 +307,9 @@ func (o *Options) Complete() error {
 	flag.Set("v", o.logLevel)
 	o.Logr = log
 
+	o.PodName = os.Getenv("POD_NAME")
+	o.PodNamespace = os.Getenv("POD_NAMESPACE")
+
 	var err error
 	o.RestConfig, err = o.kubeConfigFlags.ToRESTConfig()
 	if err != nil {
@@ -133,6 +336,296 @@ func (o *Options) Complete() error {
 		Group: o.issuerGroup,
 	}
 
+	if len(o.migrationIssuerName) > 0 {
+		o.MigrationIssuerRef = &cmmeta.ObjectReference{
+			Name:  o.migrationIssuerName,
+			Kind:  o.migrationIssuerKind,
+			Group: o.migrationIssuerGroup,
+		}
+
+		if o.MigrationPercentage < 0 || o.MigrationPercentage > 100 {
+			return fmt.Errorf("--migration-target-percentage must be between 0 and 100, got %d", o.MigrationPercentage)
+		}
+
+		if o.MigrationStrategy != "Identity" && o.MigrationStrategy != "Namespace" {
+			return fmt.Errorf("--migration-strategy must be one of Identity or Namespace, got %q", o.MigrationStrategy)
+		}
+	}
+
+	if o.DenyCRs && len(o.Username) == 0 {
+		return errors.New("--istio-csr-username must be set when --deny-foreign-certificate-requests is enabled")
+	}
+
+	if o.AdmissionPort > 0 && len(o.Username) == 0 {
+		return errors.New("--istio-csr-username must be set when the admission webhook is enabled")
+	}
+
+	if len(o.RootCASourceKind) > 0 {
+		if o.RootCASourceKind != "Secret" && o.RootCASourceKind != "ConfigMap" {
+			return fmt.Errorf("--root-ca-source-kind must be one of Secret or ConfigMap, got %q", o.RootCASourceKind)
+		}
+		if len(o.RootCASourceName) == 0 {
+			return errors.New("--root-ca-source-name must be set when --root-ca-source-kind is set")
+		}
+		if len(o.RootCACertFile) > 0 {
+			return errors.New("only one of --root-ca-file and --root-ca-source-kind may be set")
+		}
+		if len(o.RootCASourceNamespace) == 0 {
+			o.RootCASourceNamespace = o.CertManagerOptions.Namespace
+		}
+	}
+
+	if o.ServingCertificateRenewalFraction <= 0 || o.ServingCertificateRenewalFraction >= 1 {
+		return fmt.Errorf("--serving-certificate-renewal-fraction must be between 0 and 1, got %v", o.ServingCertificateRenewalFraction)
+	}
+	if o.ServingCertificateExpiryDangerWindow < 0 {
+		return fmt.Errorf("--serving-certificate-expiry-danger-window must not be negative, got %s", o.ServingCertificateExpiryDangerWindow)
+	}
+
+	for _, name := range o.ServingCertificateDNSNames {
+		if errs := validation.IsDNS1123Subdomain(strings.TrimPrefix(name, "*.")); len(errs) > 0 {
+			return fmt.Errorf("invalid --serving-certificate-dns-names %q: %s", name, strings.Join(errs, ", "))
+		}
+	}
+	o.ServingCertificateIPAddresses = nil
+	for _, addr := range o.servingCertificateIPAddresses {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("invalid --serving-certificate-ip-addresses %q: not an IP address", addr)
+		}
+		o.ServingCertificateIPAddresses = append(o.ServingCertificateIPAddresses, ip)
+	}
+	if len(o.ServingCertificateDNSNames) == 0 && len(o.ServingCertificateIPAddresses) == 0 &&
+		len(o.ServingCertificateDir) == 0 && len(o.ServingCertificateSecretName) == 0 {
+		return errors.New("at least one of --serving-certificate-dns-names or --serving-certificate-ip-addresses must be set")
+	}
+	o.ServingCertificateKeyAlgorithm, err = util.ParseKeyAlgorithm(o.servingCertificateKeyAlgorithm)
+	if err != nil {
+		return fmt.Errorf("invalid --serving-certificate-key-algorithm: %s", err)
+	}
+	if len(o.ServingCertificateIdentity) == 0 {
+		return errors.New("--serving-certificate-identity must be set")
+	}
+
+	if len(o.ServingCertificateDir) > 0 && len(o.ServingCertificateSecretName) > 0 {
+		return errors.New("only one of --serving-certificate-dir and --serving-certificate-secret-name may be set")
+	}
+	if len(o.ServingCertificateSecretName) > 0 && len(o.ServingCertificateSecretNamespace) == 0 {
+		o.ServingCertificateSecretNamespace = o.CertManagerOptions.Namespace
+	}
+	if err := o.TLSOptions.completeTLSProfile(); err != nil {
+		return err
+	}
+
+	if len(o.ServingCertificateStoreSecretName) > 0 {
+		if len(o.ServingCertificateDir) > 0 || len(o.ServingCertificateSecretName) > 0 {
+			return errors.New("--serving-certificate-store-secret-name cannot be used with --serving-certificate-dir or --serving-certificate-secret-name")
+		}
+		if len(o.ServingCertificateStoreNamespace) == 0 {
+			o.ServingCertificateStoreNamespace = o.CertManagerOptions.Namespace
+		}
+	}
+
+	if o.RootCARetention == 0 {
+		o.RootCARetention = o.MaximumClientCertificateDuration
+		if o.ServingCertificateDuration > o.RootCARetention {
+			o.RootCARetention = o.ServingCertificateDuration
+		}
+	}
+
+	o.NamespaceSelector, err = labels.Parse(o.namespaceSelector)
+	if err != nil {
+		return fmt.Errorf("failed to parse --namespace-selector %q: %s", o.namespaceSelector, err)
+	}
+
+	if len(o.WatchNamespaces) > 0 {
+		if !o.NamespaceSelector.Empty() {
+			return errors.New("--namespace-selector cannot be used with --watch-namespaces, since namespace labels cannot be read")
+		}
+		if len(o.IncludeNamespaces) > 0 {
+			return errors.New("--include-namespaces cannot be used with --watch-namespaces")
+		}
+		if len(o.RevisionConfigMapNames) > 0 || len(o.revisionRootCAFiles) > 0 {
+			return errors.New("--revision-configmap-names and --revision-root-ca-files cannot be used with --watch-namespaces, since namespace labels cannot be read")
+		}
+		if len(o.PolicyConfigMapName) > 0 {
+			return errors.New("--policy-configmap-name cannot be used with --watch-namespaces, since namespace labels cannot be read")
+		}
+	}
+
+	if o.IstiodCertificate {
+		if len(o.IstiodNamespace) == 0 {
+			o.IstiodNamespace = o.CertManagerOptions.Namespace
+		}
+
+		o.IstiodCertificateKeyAlgorithm, err = util.ParseKeyAlgorithm(o.istiodCertificateKeyAlgorithm)
+		if err != nil {
+			return fmt.Errorf("invalid --istiod-cert-key-algorithm: %s", err)
+		}
+
+		revisions := sets.NewString(o.DefaultRevision)
+		for revision := range o.RevisionConfigMapNames {
+			revisions.Insert(revision)
+		}
+		for revision := range o.revisionRootCAFiles {
+			revisions.Insert(revision)
+		}
+		o.IstiodRevisions = revisions.List()
+	}
+
+	if o.CACerts {
+		o.CACertsKeyAlgorithm, err = util.ParseKeyAlgorithm(o.caCertsKeyAlgorithm)
+		if err != nil {
+			return fmt.Errorf("invalid --cacerts-key-algorithm: %s", err)
+		}
+	}
+
+	if o.CACerts && len(o.CACertsNamespace) == 0 {
+		o.CACertsNamespace = o.CertManagerOptions.Namespace
+	}
+
+	o.ConfigMapLabelSelector, err = labels.Parse(o.configMapLabelSelector)
+	if err != nil {
+		return fmt.Errorf("failed to parse --configmap-label-selector %q: %s", o.configMapLabelSelector, err)
+	}
+
+	o.WebhookCABundleSelector, err = labels.Parse(o.webhookCABundleSelector)
+	if err != nil {
+		return fmt.Errorf("failed to parse --webhook-ca-bundle-selector %q: %s", o.webhookCABundleSelector, err)
+	}
+	if len(o.WatchNamespaces) > 0 && (!o.WebhookCABundleSelector.Empty() || len(o.WebhookCABundleNames) > 0) {
+		return errors.New("--webhook-ca-bundle-selector and --webhook-ca-bundle-names cannot be used with --watch-namespaces")
+	}
+
+	if o.RemoteClusters {
+		if len(o.WatchNamespaces) > 0 {
+			return errors.New("--remote-clusters cannot be used with --watch-namespaces")
+		}
+		if len(o.RemoteClusterSecretNamespace) == 0 {
+			o.RemoteClusterSecretNamespace = o.CertManagerOptions.Namespace
+		}
+	}
+
+	o.RevisionRootCAs = make(map[string][]byte)
+	for revision, file := range o.revisionRootCAFiles {
+		rootCA, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read root CA file %s of revision %q: %s", file, revision, err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(rootCA) {
+			return fmt.Errorf("root CA file %s of revision %q contains no PEM encoded certificates", file, revision)
+		}
+		o.RevisionRootCAs[revision] = rootCA
+	}
+
+	if o.LeaderElection {
+		if len(o.LeaderElectionID) == 0 {
+			return errors.New("--leader-election-id must be set when leader election is enabled")
+		}
+		if len(o.LeaderElectionNamespace) == 0 {
+			o.LeaderElectionNamespace = o.CertManagerOptions.Namespace
+		}
+		if o.LeaderElectionRetryPeriod <= 0 {
+			return errors.New("--leader-election-retry-period must be greater than 0")
+		}
+		if o.LeaderElectionRenewDeadline <= o.LeaderElectionRetryPeriod {
+			return fmt.Errorf("--leader-election-renew-deadline (%s) must be greater than --leader-election-retry-period (%s)",
+				o.LeaderElectionRenewDeadline, o.LeaderElectionRetryPeriod)
+		}
+		if o.LeaderElectionLeaseDuration <= o.LeaderElectionRenewDeadline {
+			return fmt.Errorf("--leader-election-lease-duration (%s) must be greater than --leader-election-renew-deadline (%s)",
+				o.LeaderElectionLeaseDuration, o.LeaderElectionRenewDeadline)
+		}
+	}
+
+	if len(o.PolicyConfigMapNamespace) == 0 {
+		o.PolicyConfigMapNamespace = o.CertManagerOptions.Namespace
+	}
+
+	if len(o.webhookCAFile) > 0 {
+		o.WebhookCABundle, err = ioutil.ReadFile(o.webhookCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read authorization webhook CA file %s: %s",
+				o.webhookCAFile, err)
+		}
+	}
+
+	return nil
+}
+
+// completeTLSProfile parses the TLS versions, cipher suites and curves of the
+// gRPC service. If FIPS is enabled, unset values default to the FIPS-approved
+// profile, and values outside of it are rejected.
+func (t *TLSOptions) completeTLSProfile() error {
+	var err error
+
+	t.TLSMinVersion, err = cliflag.TLSVersion(t.tlsMinVersion)
+	if err != nil {
+		return fmt.Errorf("invalid --tls-min-version: %s", err)
+	}
+
+	t.TLSMaxVersion = 0
+	if len(t.tlsMaxVersion) > 0 {
+		t.TLSMaxVersion, err = cliflag.TLSVersion(t.tlsMaxVersion)
+		if err != nil {
+			return fmt.Errorf("invalid --tls-max-version: %s", err)
+		}
+		if t.TLSMaxVersion < t.TLSMinVersion {
+			return fmt.Errorf("--tls-max-version %s must not be lower than --tls-min-version %s",
+				t.tlsMaxVersion, t.tlsMinVersion)
+		}
+	}
+
+	t.TLSCipherSuites, err = cliflag.TLSCipherSuites(t.tlsCipherSuites)
+	if err != nil {
+		return fmt.Errorf("invalid --tls-cipher-suites: %s", err)
+	}
+
+	t.TLSCurvePreferences, err = util.ParseCurves(t.tlsCurvePreferences)
+	if err != nil {
+		return fmt.Errorf("invalid --tls-curve-preferences: %s", err)
+	}
+
+	if !t.FIPS {
+		return nil
+	}
+
+	// TLS 1.3 cipher suites are not configurable, so the FIPS profile is
+	// limited to TLS 1.2.
+	if t.TLSMinVersion != tls.VersionTLS12 {
+		return errors.New("--fips requires --tls-min-version to be VersionTLS12")
+	}
+	if t.TLSMaxVersion != 0 && t.TLSMaxVersion != tls.VersionTLS12 {
+		return errors.New("--fips requires --tls-max-version to be VersionTLS12")
+	}
+	t.TLSMaxVersion = tls.VersionTLS12
+
+	if len(t.TLSCipherSuites) == 0 {
+		t.TLSCipherSuites = util.FIPSCipherSuites
+	}
+	fipsCipherSuites := make(map[uint16]bool)
+	for _, suite := range util.FIPSCipherSuites {
+		fipsCipherSuites[suite] = true
+	}
+	for _, suite := range t.TLSCipherSuites {
+		if !fipsCipherSuites[suite] {
+			return fmt.Errorf("--fips does not allow cipher suite %s", tls.CipherSuiteName(suite))
+		}
+	}
+
+	if len(t.TLSCurvePreferences) == 0 {
+		t.TLSCurvePreferences = util.FIPSCurves
+	}
+	fipsCurves := make(map[tls.CurveID]bool)
+	for _, curve := range util.FIPSCurves {
+		fipsCurves[curve] = true
+	}
+	for _, curve := range t.TLSCurvePreferences {
+		if !fipsCurves[curve] {
+			return fmt.Errorf("--fips does not allow curve %s", curve)
+		}
+	}
+
 	return nil
 }
 
@@ -142,6 +635,8 @@ func (o *Options) addFlags(cmd *cobra.Command) {
 	o.AppOptions.addFlags(nfs.FlagSet("App"))
 	o.TLSOptions.addFlags(nfs.FlagSet("TLS"))
 	o.CertManagerOptions.addFlags(nfs.FlagSet("cert-manager"))
+	o.AuthzOptions.addFlags(nfs.FlagSet("Authorization"))
+	o.ControllerOptions.addFlags(nfs.FlagSet("Controller"))
 	o.KubeOptions.kubeConfigFlags = genericclioptions.NewConfigFlags(true)
 	o.KubeOptions.kubeConfigFlags.AddFlags(nfs.FlagSet("Kubernetes"))
 
@@ -175,6 +670,10 @@ func (a *AppOptions) addFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&a.ReadyzPath,
 		"readiness-probe-path", "/readyz",
 		"HTTP path to expose the readiness probe server.")
+
+	fs.IntVar(&a.MetricsPort,
+		"metrics-port", 8080,
+		"Port to expose Prometheus metrics on, at /metrics.")
 }
 
 func (t *TLSOptions) addFlags(fs *pflag.FlagSet) {
@@ -184,14 +683,203 @@ func (t *TLSOptions) addFlags(fs *pflag.FlagSet) {
 
 	fs.DurationVarP(&t.ServingCertificateDuration,
 		"serving-certificate-duration", "t", time.Hour*24,
-		"Certificate duration of serving certificates. Will be renewed after 2/3 of "+
-			"the duration.")
+		"Certificate duration of serving certificates. Will be renewed after "+
+			"--serving-certificate-renewal-fraction of the duration granted by the issuer.")
+
+	fs.Float64Var(&t.ServingCertificateRenewalFraction,
+		"serving-certificate-renewal-fraction", 2.0/3.0,
+		"Fraction, between 0 and 1, of the duration granted by the issuer after "+
+			"which serving certificates are renewed, measured from the certificate's "+
+			"NotBefore to NotAfter. Also used for the istiod and plug-in CA certificates.")
+
+	fs.DurationVar(&t.ServingCertificateExpiryDangerWindow,
+		"serving-certificate-expiry-danger-window", time.Minute*5,
+		"Duration before the expiry of the serving certificate within which "+
+			"istio-csr reports not ready, if the certificate has failed to renew.")
+
+	fs.StringSliceVar(&t.ServingCertificateDNSNames,
+		"serving-certificate-dns-names", []string{"cert-manager-istio-csr.cert-manager.svc"},
+		"DNS names of requested serving certificates. Should include the names "+
+			"istio-csr is reached by, such as its Service or an east-west gateway.")
+
+	fs.StringSliceVar(&t.servingCertificateIPAddresses,
+		"serving-certificate-ip-addresses", nil,
+		"IP addresses of requested serving certificates.")
+
+	fs.StringVar(&t.servingCertificateKeyAlgorithm,
+		"serving-certificate-key-algorithm", string(util.KeyAlgorithmRSA2048),
+		"Algorithm of the private key of requested serving certificates, one of "+
+			"RSA-2048, RSA-4096, ECDSA-P256 or ECDSA-P384.")
+
+	fs.StringVar(&t.ServingCertificateIdentity,
+		"serving-certificate-identity", "cert-manager-istio-csr",
+		"Identity annotated on the CertificateRequests of requested serving "+
+			"certificates.")
+
+	fs.StringVar(&t.ServingCertificateDir,
+		"serving-certificate-dir", "",
+		"Directory of a mounted kubernetes.io/tls Secret to serve the certificate "+
+			"and key from (tls.crt and tls.key), rather than requesting the serving "+
+			"certificate from the issuer. The files are watched and reloaded on change. "+
+			"ca.crt is used as the root CA if no other root CA is configured.")
+
+	fs.StringVar(&t.ServingCertificateSecretName,
+		"serving-certificate-secret-name", "",
+		"Name of a kubernetes.io/tls Secret to serve the certificate and key from, "+
+			"rather than requesting the serving certificate from the issuer. The "+
+			"Secret is watched and reloaded on change. Cannot be used with "+
+			"--serving-certificate-dir.")
+
+	fs.StringVar(&t.ServingCertificateSecretNamespace,
+		"serving-certificate-secret-namespace", "",
+		"Namespace of the serving certificate Secret. Defaults to the certificate "+
+			"namespace.")
+
+	fs.StringVar(&t.ServingCertificateStoreSecretName,
+		"serving-certificate-store-secret-name", "",
+		"Name of a kubernetes.io/tls Secret to store requested serving certificates "+
+			"in. Replicas reuse the stored certificate while it is valid, and renewal "+
+			"is coordinated between replicas through a Lease of the same name "+
+			"suffixed with '-renewal'. "+
+			"Cannot be used with --serving-certificate-dir or "+
+			"--serving-certificate-secret-name.")
+
+	fs.StringVar(&t.ServingCertificateStoreNamespace,
+		"serving-certificate-store-namespace", "",
+		"Namespace of the serving certificate store Secret and Lease. Defaults to "+
+			"the certificate namespace.")
+
+	fs.StringVar(&t.tlsMinVersion,
+		"tls-min-version", "VersionTLS12",
+		"Minimum TLS version of the gRPC service. One of "+
+			strings.Join(cliflag.TLSPossibleVersions(), ", ")+".")
+
+	fs.StringVar(&t.tlsMaxVersion,
+		"tls-max-version", "",
+		"Maximum TLS version of the gRPC service. One of "+
+			strings.Join(cliflag.TLSPossibleVersions(), ", ")+". If empty, "+
+			"defaults to the latest supported version.")
+
+	fs.StringSliceVar(&t.tlsCipherSuites,
+		"tls-cipher-suites", []string{},
+		"Comma-separated list of TLS 1.2 cipher suites of the gRPC service. TLS 1.3 "+
+			"cipher suites are not configurable. If empty, defaults to the Go default "+
+			"cipher suites. Possible values: "+
+			strings.Join(cliflag.TLSCipherPossibleValues(), ", ")+".")
+
+	fs.StringSliceVar(&t.tlsCurvePreferences,
+		"tls-curve-preferences", []string{},
+		"Comma-separated list of key exchange curves of the gRPC service, in order of "+
+			"preference. One of P256, P384, P521 or X25519. If empty, defaults to the "+
+			"Go default curves.")
+
+	fs.BoolVar(&t.FIPS,
+		"fips", false,
+		"If enabled, restricts the gRPC service to a FIPS-approved profile of TLS 1.2, "+
+			"ECDHE with AES-GCM cipher suites and NIST curves. Only RSA keys of at least "+
+			"2048 bits and ECDSA keys on NIST curves are accepted in workload CSRs and "+
+			"for serving keys.")
+
+	fs.BoolVar(&t.IstiodCertificate,
+		"istiod-cert", false,
+		"If enabled, istio-csr issues and renews istiod's serving certificate "+
+			"through the configured issuer, writing it to a kubernetes.io/tls Secret "+
+			"with the root CA bundle in ca.crt.")
+
+	fs.StringVar(&t.IstiodCertificateSecretName,
+		"istiod-cert-secret-name", "istiod-tls",
+		"Name of the Secret istiod's serving certificate is written to.")
+
+	fs.DurationVar(&t.IstiodCertificateDuration,
+		"istiod-cert-duration", time.Hour*24,
+		"Certificate duration of istiod's serving certificate. Will be renewed "+
+			"after --serving-certificate-renewal-fraction of the granted duration.")
+
+	fs.StringVar(&t.istiodCertificateKeyAlgorithm,
+		"istiod-cert-key-algorithm", string(util.KeyAlgorithmRSA2048),
+		"Algorithm of the private key of istiod's serving certificate, one of "+
+			"RSA-2048, RSA-4096, ECDSA-P256 or ECDSA-P384.")
+
+	fs.StringVar(&t.IstiodServiceName,
+		"istiod-service-name", "istiod",
+		"Name of the istiod Service. The certificate's DNS names are those of this "+
+			"Service, and of the Service suffixed with each configured revision.")
+
+	fs.StringVar(&t.IstiodServiceAccountName,
+		"istiod-service-account-name", "istiod-service-account",
+		"Name of istiod's service account. The certificate's URI SAN is the SPIFFE "+
+			"identity of this service account in the trust domain.")
+
+	fs.StringVar(&t.IstiodNamespace,
+		"istiod-namespace", "",
+		"Namespace of istiod and its serving certificate Secret. If empty, defaults "+
+			"to the certificate namespace.")
+
+	fs.BoolVar(&t.CACerts,
+		"cacerts", false,
+		"If enabled, istio-csr issues and renews an intermediate CA through the "+
+			"configured issuer, writing it to an istio plug-in CA Secret for istiod's "+
+			"built-in CA. root-cert.pem is kept equal to the distributed root CA.")
+
+	fs.StringVar(&t.CACertsSecretName,
+		"cacerts-secret-name", "cacerts",
+		"Name of the istio plug-in CA Secret the intermediate CA is written to.")
+
+	fs.DurationVar(&t.CACertsDuration,
+		"cacerts-duration", time.Hour*24*365,
+		"Certificate duration of the plug-in intermediate CA. Will be renewed "+
+			"after --serving-certificate-renewal-fraction of the granted duration.")
+
+	fs.StringVar(&t.caCertsKeyAlgorithm,
+		"cacerts-key-algorithm", string(util.KeyAlgorithmRSA2048),
+		"Algorithm of the private key of the plug-in intermediate CA, one of "+
+			"RSA-2048, RSA-4096, ECDSA-P256 or ECDSA-P384. An existing plug-in CA with "+
+			"a key of another algorithm, or which isn't FIPS-approved with --fips, is "+
+			"reissued.")
+
+	fs.StringVar(&t.CACertsNamespace,
+		"cacerts-namespace", "",
+		"Namespace of the istio plug-in CA Secret. If empty, defaults to the "+
+			"certificate namespace.")
 
 	fs.StringVar(&t.RootCACertFile,
 		"root-ca-file", "",
 		"File location of a PEM encoded Root CA certificate to be used as root of "+
-			"trust for TLS. If empty, the CA returned from the cert-manager issuer will "+
-			"be used.")
+			"trust for TLS. The file is watched and reloaded on change. If empty, the CA "+
+			"returned from the cert-manager issuer will be used.")
+
+	fs.StringVar(&t.RootCASourceKind,
+		"root-ca-source-kind", "",
+		"Kind of the object in the cluster to source the PEM encoded Root CA from, "+
+			"either Secret or ConfigMap. The object is watched and the Root CA updated "+
+			"on change. Cannot be used with --root-ca-file.")
+
+	fs.StringVar(&t.RootCASourceName,
+		"root-ca-source-name", "",
+		"Name of the Secret or ConfigMap to source the Root CA from.")
+
+	fs.StringVar(&t.RootCASourceNamespace,
+		"root-ca-source-namespace", "",
+		"Namespace of the Secret or ConfigMap to source the Root CA from. Defaults "+
+			"to the certificate namespace.")
+
+	fs.StringVar(&t.RootCASourceKey,
+		"root-ca-source-key", "ca.crt",
+		"Key of the Secret or ConfigMap which holds the PEM encoded Root CA.")
+
+	fs.DurationVar(&t.RootCARetention,
+		"root-ca-retention", 0,
+		"Duration to keep a previous root CA in the distributed trust bundle and "+
+			"client verification pool after the root CA is rotated. If 0, defaults to "+
+			"the longest certificate duration istio-csr issues, so that previous roots "+
+			"are pruned once every certificate they signed would have expired.")
+
+	fs.StringVar(&t.RootCARetentionConfigMapName,
+		"root-ca-retention-configmap-name", "",
+		"Name of the ConfigMap in the certificate namespace which the root CA and "+
+			"previous root CAs are persisted in, so that previous root CAs are retained "+
+			"in the trust bundle across restarts and leader changes. If empty, the "+
+			"default, previous root CAs are only held in memory.")
 
 	fs.StringVar(&t.RootCAConfigMapName,
 		"root-ca-configmap-name", "istio-ca-root-cert",
@@ -222,7 +910,223 @@ func (c *CertManagerOptions) addFlags(fs *pflag.FlagSet) {
 		"If enabled, will preserve created CertificateRequests, rather than "+
 			"deleting when they are ready.")
 
+	fs.DurationVar(&c.PreserveCRsRetention,
+		"preserve-certificate-requests-retention", 0,
+		"If preserving CertificateRequests, the age after which they will be "+
+			"garbage collected. If 0, preserved CertificateRequests are kept forever.")
+
+	fs.DurationVar(&c.OrphanedCRsAge,
+		"orphaned-certificate-request-age", time.Minute*10,
+		"If not preserving CertificateRequests, the age after which "+
+			"CertificateRequests created by istio-csr that failed to be deleted are "+
+			"garbage collected.")
+
+	fs.DurationVar(&c.CleanupSweepInterval,
+		"certificate-request-sweep-interval", time.Minute*5,
+		"Interval at which CertificateRequests created by istio-csr are checked for "+
+			"garbage collection.")
+
+	fs.BoolVar(&c.ApproveCRs,
+		"approve-certificate-requests", false,
+		"If enabled, will add an Approved condition to created CertificateRequests "+
+			"once they have been validated. Required from cert-manager v1.3.")
+
+	fs.BoolVar(&c.DenyCRs,
+		"deny-foreign-certificate-requests", false,
+		"If enabled, will run a controller which denies CertificateRequests "+
+			"referencing the configured issuer that were not created by istio-csr.")
+
+	fs.StringSliceVar(&c.DenyCRsAllowedUsernames,
+		"deny-foreign-allowed-usernames", nil,
+		"Kubernetes usernames, other than istio-csr's, whose CertificateRequests "+
+			"referencing the configured issuer are not denied, for example "+
+			"cert-manager's controller when it signs the istiod serving certificate.")
+
+	fs.StringVar(&c.Username,
+		"istio-csr-username", "",
+		"Kubernetes username of istio-csr, for example "+
+			"'system:serviceaccount:cert-manager:cert-manager-istio-csr'. Used to "+
+			"identify CertificateRequests created by istio-csr.")
+
 	fs.StringVarP(&c.Namespace,
 		"certificate-namespace", "c", "istio-system",
 		"Namespace to request certificates.")
+
+	fs.StringVar(&c.migrationIssuerName,
+		"migration-issuer-name", "",
+		"Name of an issuer to migrate workload certificates to. If set, a share of "+
+			"workload requests, given by --migration-target-percentage, are signed by "+
+			"this issuer instead of the configured issuer. Its root CA should be in the "+
+			"trust bundle before the percentage is raised.")
+	fs.StringVar(&c.migrationIssuerKind,
+		"migration-issuer-kind", "Issuer",
+		"Kind of the issuer to migrate workload certificates to.")
+	fs.StringVar(&c.migrationIssuerGroup,
+		"migration-issuer-group", "cert-manager.io",
+		"Group of the issuer to migrate workload certificates to.")
+
+	fs.IntVar(&c.MigrationPercentage,
+		"migration-target-percentage", 0,
+		"Percentage, from 0 to 100, of workload requests to sign with the migration issuer.")
+
+	fs.StringVar(&c.MigrationStrategy,
+		"migration-strategy", "Identity",
+		"How workload requests are assigned to the migration issuer, by a stable "+
+			"hash of either the caller's identity (Identity) or namespace (Namespace).")
+}
+
+func (a *AuthzOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&a.PolicyConfigMapName,
+		"policy-configmap-name", "",
+		"Name of a ConfigMap containing CEL authorization policies under the key "+
+			"'policies.yaml', which every request must satisfy. The ConfigMap is "+
+			"watched for changes. If empty, no policies are evaluated.")
+
+	fs.StringVar(&a.PolicyConfigMapNamespace,
+		"policy-configmap-namespace", "",
+		"Namespace of the policy ConfigMap. If empty, the certificate namespace is used.")
+
+	fs.StringVar(&a.WebhookURL,
+		"authorization-webhook-url", "",
+		"HTTPS URL of an external authorization webhook which will be sent a review "+
+			"of every request before it is signed. If empty, no webhook is consulted.")
+
+	fs.StringVar(&a.webhookCAFile,
+		"authorization-webhook-ca-file", "",
+		"File location of a PEM encoded CA bundle used to verify the authorization "+
+			"webhook's serving certificate. If empty, the system roots are used.")
+
+	fs.DurationVar(&a.WebhookTimeout,
+		"authorization-webhook-timeout", time.Second*5,
+		"Timeout of requests to the authorization webhook.")
+
+	fs.BoolVar(&a.WebhookFailOpen,
+		"authorization-webhook-fail-open", false,
+		"If enabled, requests will be allowed when the authorization webhook cannot "+
+			"be reached or returns an invalid response, rather than denied.")
+
+	fs.IntVar(&a.AdmissionPort,
+		"admission-webhook-port", 0,
+		"Port to serve the CertificateRequest validating admission webhook, which "+
+			"rejects CertificateRequests for the configured issuer not created by "+
+			"istio-csr or an allowed user. If 0, the webhook is not served.")
+
+	fs.StringVar(&a.AdmissionCertDir,
+		"admission-webhook-cert-dir", "/etc/cert-manager-istio-csr/admission",
+		"Directory containing the tls.crt and tls.key used to serve the admission webhook.")
+
+	fs.StringSliceVar(&a.AdmissionAllowedUsernames,
+		"admission-webhook-allowed-usernames", nil,
+		"Kubernetes usernames, other than istio-csr, which may create "+
+			"CertificateRequests for the configured issuer. Their CertificateRequests "+
+			"must pass the same CSR checks as istio workload requests.")
+
+	fs.StringSliceVar(&a.AdmissionTrustedUsernames,
+		"admission-webhook-trusted-usernames", nil,
+		"Kubernetes usernames which may create CertificateRequests for the configured "+
+			"issuer without the CSR checks of istio workload requests, for example "+
+			"cert-manager's controller when it signs the istiod serving certificate. "+
+			"CA certificates may not be requested.")
+}
+
+func (c *ControllerOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.namespaceSelector,
+		"namespace-selector", "",
+		"Label selector of namespaces to distribute the root CA ConfigMap to. If "+
+			"empty, all namespaces are selected.")
+
+	fs.StringSliceVar(&c.IncludeNamespaces,
+		"include-namespaces", []string{},
+		"Namespaces to distribute the root CA ConfigMap to. If empty, all "+
+			"namespaces matching the namespace selector are selected.")
+
+	fs.StringSliceVar(&c.ExcludeNamespaces,
+		"exclude-namespaces", []string{},
+		"Namespaces to never distribute the root CA ConfigMap to.")
+
+	fs.StringSliceVar(&c.WatchNamespaces,
+		"watch-namespaces", []string{},
+		"If set, the root CA ConfigMap is only distributed to these namespaces, and "+
+			"the controller only watches resources in these namespaces, never listing "+
+			"cluster-scoped resources. Allows running with namespace-scoped Roles only. "+
+			"Cannot be used with --namespace-selector or --include-namespaces.")
+
+	fs.BoolVar(&c.RemoveUnselectedConfigMaps,
+		"remove-unselected-configmaps", false,
+		"If enabled, the root CA ConfigMap managed by istio-csr is removed from "+
+			"namespaces which are no longer selected.")
+
+	fs.StringToStringVar(&c.RevisionConfigMapNames,
+		"revision-configmap-names", map[string]string{},
+		"Names of the root CA ConfigMap for istio revisions, as revision=name pairs. "+
+			"Namespaces are matched to a revision by their istio.io/rev label. Revisions "+
+			"without a name use --root-ca-configmap-name.")
+
+	fs.StringToStringVar(&c.revisionRootCAFiles,
+		"revision-root-ca-files", map[string]string{},
+		"Files containing the PEM encoded root CA bundle distributed to namespaces "+
+			"of istio revisions, as revision=file pairs. Revisions without a file are "+
+			"distributed the root CA. Files are only read on start up and are not watched, "+
+			"so changes require a restart, and --root-ca-retention doesn't apply to them.")
+
+	fs.StringVar(&c.DefaultRevision,
+		"default-revision", "default",
+		"The istio revision of namespaces without the istio.io/rev label.")
+
+	fs.StringVar(&c.configMapLabelSelector,
+		"configmap-label-selector", "",
+		"Label selector which further restricts the cached root CA ConfigMaps, "+
+			"on top of their names, for example "+
+			"'app.kubernetes.io/managed-by=cert-manager-istio-csr'. ConfigMaps which "+
+			"don't match are treated as missing, so every existing root CA ConfigMap "+
+			"must match. If empty, ConfigMaps are only selected by name.")
+
+	fs.StringVar(&c.webhookCABundleSelector,
+		"webhook-ca-bundle-selector", "",
+		"Label selector of Mutating and Validating webhook configurations whose "+
+			"caBundle is kept equal to the root CA. If empty, no configurations are "+
+			"selected by label.")
+
+	fs.StringSliceVar(&c.WebhookCABundleNames,
+		"webhook-ca-bundle-names", []string{},
+		"Names of Mutating and Validating webhook configurations whose caBundle is "+
+			"kept equal to the root CA.")
+
+	fs.BoolVar(&c.RemoteClusters,
+		"remote-clusters", false,
+		"If enabled, the root CA is also distributed to the remote clusters of a "+
+			"multi-cluster mesh, read from istio remote secrets labelled "+
+			"istio/multiCluster=true.")
+
+	fs.StringVar(&c.RemoteClusterSecretNamespace,
+		"remote-cluster-secret-namespace", "",
+		"Namespace of the istio remote secrets. If empty, defaults to the "+
+			"certificate namespace.")
+
+	fs.BoolVar(&c.LeaderElection,
+		"leader-election", true,
+		"If enabled, only the replica holding the leader election Lease runs the "+
+			"controllers. The certificate signing service is served by every replica.")
+
+	fs.StringVar(&c.LeaderElectionID,
+		"leader-election-id", "cert-manager-istio-csr",
+		"Name of the Lease used for leader election. Must be the same for every replica.")
+
+	fs.StringVar(&c.LeaderElectionNamespace,
+		"leader-election-namespace", "",
+		"Namespace of the Lease used for leader election. If empty, defaults to the "+
+			"certificate namespace.")
+
+	fs.DurationVar(&c.LeaderElectionLeaseDuration,
+		"leader-election-lease-duration", time.Second*15,
+		"Duration non-leader replicas wait before attempting to acquire the Lease "+
+			"after it was last renewed.")
+
+	fs.DurationVar(&c.LeaderElectionRenewDeadline,
+		"leader-election-renew-deadline", time.Second*10,
+		"Duration the leader retries renewing the Lease before giving up leadership.")
+
+	fs.DurationVar(&c.LeaderElectionRetryPeriod,
+		"leader-election-retry-period", time.Second*2,
+		"Duration replicas wait between attempts to acquire or renew the Lease.")
 }
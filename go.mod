@@ -3,10 +3,14 @@ module github.com/cert-manager/istio-csr
 go 1.15
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-logr/logr v0.3.0
+	github.com/golang/protobuf v1.4.3
+	github.com/google/cel-go v0.6.0
 	github.com/jetstack/cert-manager v1.1.0
 	github.com/onsi/ginkgo v1.14.1
 	github.com/onsi/gomega v1.10.4
+	github.com/prometheus/client_golang v1.7.1
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/pflag v1.0.5
 	google.golang.org/grpc v1.33.2
@@ -21,4 +25,5 @@ require (
 	k8s.io/klog/v2 v2.4.0
 	sigs.k8s.io/controller-runtime v0.8.0
 	sigs.k8s.io/kind v0.10.0
+	sigs.k8s.io/yaml v1.2.0
 )
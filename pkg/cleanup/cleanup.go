@@ -0,0 +1,213 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	cmclient "github.com/jetstack/cert-manager/pkg/client/clientset/versioned/typed/certmanager/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/cert-manager/istio-csr/cmd/app/options"
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+const (
+	// workers is the number of concurrent CertificateRequest deletions.
+	workers = 5
+
+	// maxQueueLength is the maximum number of CertificateRequests waiting to be
+	// deleted. Further deletions are dropped, and left for the sweeper.
+	maxQueueLength = 1000
+
+	// maxRetries is the number of times a failed deletion will be retried
+	// before being left for the sweeper.
+	maxRetries = 5
+
+	// deleteTimeout is the timeout of a single delete API call.
+	deleteTimeout = time.Second * 5
+)
+
+// Cleaner is responsible for deleting CertificateRequests created by
+// istio-csr. Deletions are processed by a bounded worker queue on every
+// replica, and retried on failure. A periodic sweep, run by the leader only,
+// deletes any CertificateRequests created by istio-csr which are older than
+// their retention period, catching those which were orphaned by a restart or a
+// failed deletion.
+type Cleaner struct {
+	log    logr.Logger
+	client cmclient.CertificateRequestInterface
+	queue  workqueue.RateLimitingInterface
+
+	preserveCRs   bool
+	retention     time.Duration
+	orphanAge     time.Duration
+	sweepInterval time.Duration
+
+	// now is used to determine the age of CertificateRequests
+	now func() time.Time
+}
+
+// New returns a new Cleaner for CertificateRequests.
+func New(log logr.Logger, cmOptions *options.CertManagerOptions, kubeOptions *options.KubeOptions) *Cleaner {
+	return &Cleaner{
+		log:           log.WithName("cleanup"),
+		client:        kubeOptions.CMClient,
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "certificaterequest-cleanup"),
+		preserveCRs:   cmOptions.PreserveCRs,
+		retention:     cmOptions.PreserveCRsRetention,
+		orphanAge:     cmOptions.OrphanedCRsAge,
+		sweepInterval: cmOptions.CleanupSweepInterval,
+		now:           time.Now,
+	}
+}
+
+// Run is a blocking func that runs the deletion workers until the context is
+// cancelled. Queued deletions are drained before returning.
+func (c *Cleaner) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.processNext() {
+			}
+		}()
+	}
+
+	<-ctx.Done()
+
+	c.queue.ShutDown()
+	wg.Wait()
+}
+
+// Sweeper returns the periodic sweep of the Cleaner as a manager Runnable,
+// which is run by the leader only, so that replicas don't all list and delete
+// the same CertificateRequests.
+func (c *Cleaner) Sweeper() manager.Runnable {
+	return manager.RunnableFunc(func(ctx context.Context) error {
+		wait.Until(func() { c.sweep(ctx) }, c.sweepInterval, ctx.Done())
+		return nil
+	})
+}
+
+// Delete queues the CertificateRequest with the given name to be deleted,
+// unless configured to preserve CertificateRequests.
+func (c *Cleaner) Delete(name string) {
+	if c.preserveCRs {
+		return
+	}
+
+	c.enqueue(name)
+}
+
+// enqueue adds the CertificateRequest to the deletion queue. If the queue is
+// full, the deletion is dropped and left for the sweeper.
+func (c *Cleaner) enqueue(name string) {
+	if c.queue.Len() >= maxQueueLength {
+		c.log.Info("cleanup queue full, leaving CertificateRequest for sweeper", "name", name)
+		return
+	}
+
+	c.queue.Add(name)
+}
+
+// processNext deletes the next CertificateRequest in the queue. Returns false
+// when the queue has been shut down.
+func (c *Cleaner) processNext() bool {
+	item, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(item)
+
+	name := item.(string)
+	log := c.log.WithValues("name", name)
+
+	if err := c.delete(name); err != nil {
+		if c.queue.NumRequeues(item) < maxRetries {
+			log.Error(err, "failed to delete CertificateRequest, retrying")
+			c.queue.AddRateLimited(item)
+			return true
+		}
+
+		log.Error(err, "failed to delete CertificateRequest, leaving for sweeper")
+	}
+
+	c.queue.Forget(item)
+	return true
+}
+
+// delete deletes the CertificateRequest with the given name. CertificateRequests
+// which no longer exist are not an error. Deletions are not tied to the
+// lifetime of the process, so that queued deletions are still made on
+// shutdown, but are bounded by deleteTimeout.
+func (c *Cleaner) delete(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+	defer cancel()
+
+	err := c.client.Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	c.log.V(3).Info("deleted CertificateRequest", "name", name)
+
+	return nil
+}
+
+// sweep lists all CertificateRequests created by istio-csr, and queues those
+// which are older than their retention period for deletion. Preserved
+// CertificateRequests are kept forever if no retention period is set.
+func (c *Cleaner) sweep(ctx context.Context) {
+	maxAge := c.orphanAge
+	if c.preserveCRs {
+		if c.retention <= 0 {
+			return
+		}
+		maxAge = c.retention
+	}
+
+	crs, err := c.client.List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(util.CertificateRequestLabels()).String(),
+	})
+	if err != nil {
+		c.log.Error(err, "failed to list CertificateRequests for sweep")
+		return
+	}
+
+	var queued int
+	for _, cr := range crs.Items {
+		if c.now().Sub(cr.CreationTimestamp.Time) > maxAge {
+			c.enqueue(cr.Name)
+			queued++
+		}
+	}
+
+	if queued > 0 {
+		c.log.Info("queued expired CertificateRequests for deletion", "count", queued, "max-age", maxAge)
+	}
+}
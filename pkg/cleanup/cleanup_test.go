@@ -0,0 +1,145 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cleanup
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmfake "github.com/jetstack/cert-manager/pkg/client/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+func TestSweep(t *testing.T) {
+	now := time.Now()
+
+	cr := func(name string, age time.Duration, labels map[string]string) runtime.Object {
+		return &cmapi.CertificateRequest{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "istio-system",
+				Labels:            labels,
+				CreationTimestamp: metav1.NewTime(now.Add(-age)),
+			},
+		}
+	}
+
+	existing := []runtime.Object{
+		cr("new", time.Minute, util.CertificateRequestLabels()),
+		cr("orphaned", time.Minute*20, util.CertificateRequestLabels()),
+		cr("old", time.Hour*48, util.CertificateRequestLabels()),
+		cr("not-istio-csr", time.Hour*48, nil),
+	}
+
+	tests := map[string]struct {
+		preserveCRs bool
+		retention   time.Duration
+		expRemain   []string
+	}{
+		"if not preserving, should delete CertificateRequests older than orphan age": {
+			preserveCRs: false,
+			expRemain:   []string{"new", "not-istio-csr"},
+		},
+		"if preserving with no retention, should delete nothing": {
+			preserveCRs: true,
+			retention:   0,
+			expRemain:   []string{"new", "not-istio-csr", "old", "orphaned"},
+		},
+		"if preserving with retention, should delete CertificateRequests older than retention": {
+			preserveCRs: true,
+			retention:   time.Hour * 24,
+			expRemain:   []string{"new", "not-istio-csr", "orphaned"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := cmfake.NewSimpleClientset(existing...).CertmanagerV1().CertificateRequests("istio-system")
+
+			c := &Cleaner{
+				log:         klogr.New(),
+				client:      client,
+				queue:       workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+				preserveCRs: test.preserveCRs,
+				retention:   test.retention,
+				orphanAge:   time.Minute * 10,
+				now:         func() time.Time { return now },
+			}
+
+			c.sweep(context.TODO())
+			c.queue.ShutDown()
+			for c.processNext() {
+			}
+
+			crs, err := client.List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var remain []string
+			for _, cr := range crs.Items {
+				remain = append(remain, cr.Name)
+			}
+			sort.Strings(remain)
+
+			if len(remain) != len(test.expRemain) {
+				t.Fatalf("unexpected remaining CertificateRequests, exp=%v got=%v", test.expRemain, remain)
+			}
+			for i := range remain {
+				if remain[i] != test.expRemain[i] {
+					t.Errorf("unexpected remaining CertificateRequests, exp=%v got=%v", test.expRemain, remain)
+				}
+			}
+		})
+	}
+}
+
+func TestRunDrainsQueueOnShutdown(t *testing.T) {
+	client := cmfake.NewSimpleClientset(&cmapi.CertificateRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: "signed", Namespace: "istio-system"},
+	}).CertmanagerV1().CertificateRequests("istio-system")
+
+	c := &Cleaner{
+		log:    klogr.New(),
+		client: client,
+		queue:  workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		now:    time.Now,
+	}
+
+	// Deletions queued before shutdown should still be made, despite the
+	// process context being cancelled
+	c.Delete("signed")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Run(ctx)
+
+	crs, err := client.List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crs.Items) != 0 {
+		t.Errorf("expected CertificateRequest to be deleted, got=%v", crs.Items)
+	}
+}
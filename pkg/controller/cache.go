@@ -0,0 +1,137 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// configMapCache caches only the ConfigMaps with the root CA ConfigMap names,
+// selected by field selector and optionally by label selector, rather than
+// every ConfigMap in the cluster.
+type configMapCache struct {
+	factories []informers.SharedInformerFactory
+	informers []cache.SharedIndexInformer
+}
+
+// newConfigMapCache returns a cache of ConfigMaps with the given names, in the
+// given namespaces, or all namespaces if empty. If labelSelector is not nil or
+// empty, only ConfigMaps matching it are cached. Field selectors cannot match
+// one of several values, so an informer is run for each name.
+func newConfigMapCache(kubeClient kubernetes.Interface, names []string, namespaces []string,
+	labelSelector labels.Selector) *configMapCache {
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	c := new(configMapCache)
+	for _, namespace := range namespaces {
+		for _, name := range names {
+			c.addInformer(kubeClient, name, namespace, labelSelector)
+		}
+	}
+
+	return c
+}
+
+// addInformer adds an informer of ConfigMaps with the given name in the given
+// namespace, matching the label selector if not nil or empty.
+func (c *configMapCache) addInformer(kubeClient kubernetes.Interface, name, namespace string,
+	labelSelector labels.Selector) {
+	factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+			if labelSelector != nil && !labelSelector.Empty() {
+				opts.LabelSelector = labelSelector.String()
+			}
+		}),
+	)
+
+	c.factories = append(c.factories, factory)
+	c.informers = append(c.informers, factory.Core().V1().ConfigMaps().Informer())
+}
+
+// Start will run the informers until the context is cancelled.
+func (c *configMapCache) Start(ctx context.Context) error {
+	for _, factory := range c.factories {
+		factory.Start(ctx.Done())
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// NeedLeaderElection returns false, so that the cache is started by every
+// replica, along with the manager's cache.
+func (c *configMapCache) NeedLeaderElection() bool {
+	return false
+}
+
+// hasSynced returns true if all informers have synced.
+func (c *configMapCache) hasSynced() bool {
+	for _, informer := range c.informers {
+		if !informer.HasSynced() {
+			return false
+		}
+	}
+	return true
+}
+
+// configMapReader is a client.Reader which reads ConfigMaps from the
+// configMapCache, and all other objects from the embedded Reader.
+type configMapReader struct {
+	client.Reader
+	cache *configMapCache
+}
+
+// Get reads ConfigMaps from the configMapCache, and all other objects from the
+// embedded Reader.
+func (r *configMapReader) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return r.Reader.Get(ctx, key, obj)
+	}
+
+	if !r.cache.hasSynced() {
+		return errors.New("configmap cache has not yet synced")
+	}
+
+	for _, informer := range r.cache.informers {
+		item, exists, err := informer.GetIndexer().GetByKey(key.String())
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			item.(*corev1.ConfigMap).DeepCopyInto(cm)
+			return nil
+		}
+	}
+
+	return apierrors.NewNotFound(corev1.Resource("configmaps"), key.Name)
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+func TestConfigMapReader(t *testing.T) {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "istio-ca-root-cert", Namespace: "foo"},
+		Data:       map[string]string{RootCertKey: "root"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cache := newConfigMapCache(fake.NewSimpleClientset(cm), []string{cm.Name}, nil, nil)
+	reader := &configMapReader{
+		Reader: fakeclient.NewClientBuilder().WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+		).Build(),
+		cache: cache,
+	}
+
+	// Reads before the cache has synced should fail
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: "foo", Name: cm.Name}, new(corev1.ConfigMap)); err == nil {
+		t.Error("expected error reading from unsynced cache, got none")
+	}
+
+	go cache.Start(ctx)
+	if err := wait.PollImmediate(time.Millisecond*10, time.Second*5, func() (bool, error) {
+		return cache.hasSynced(), nil
+	}); err != nil {
+		t.Fatal("timed out waiting for configmap cache to sync")
+	}
+
+	got := new(corev1.ConfigMap)
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: "foo", Name: cm.Name}, got); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !reflect.DeepEqual(got.Data, cm.Data) {
+		t.Errorf("unexpected ConfigMap data, exp=%v got=%v", cm.Data, got.Data)
+	}
+
+	err := reader.Get(ctx, types.NamespacedName{Namespace: "bar", Name: cm.Name}, new(corev1.ConfigMap))
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected not found error, got=%v", err)
+	}
+
+	// Other objects should be read from the embedded reader
+	if err := reader.Get(ctx, types.NamespacedName{Name: "foo"}, new(corev1.Namespace)); err != nil {
+		t.Errorf("unexpected error reading namespace: %s", err)
+	}
+}
+
+func TestConfigMapCacheLabelSelector(t *testing.T) {
+	managed := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "istio-ca-root-cert",
+			Namespace: "foo",
+			Labels:    map[string]string{util.ManagedByLabelKey: util.ManagedByLabelValue},
+		},
+	}
+	unmanaged := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "istio-ca-root-cert", Namespace: "bar"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	selector := labels.SelectorFromSet(labels.Set{util.ManagedByLabelKey: util.ManagedByLabelValue})
+	cache := newConfigMapCache(fake.NewSimpleClientset(managed, unmanaged), []string{managed.Name}, nil, selector)
+	reader := &configMapReader{Reader: fakeclient.NewClientBuilder().Build(), cache: cache}
+
+	go cache.Start(ctx)
+	if err := wait.PollImmediate(time.Millisecond*10, time.Second*5, func() (bool, error) {
+		return cache.hasSynced(), nil
+	}); err != nil {
+		t.Fatal("timed out waiting for configmap cache to sync")
+	}
+
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: "foo", Name: managed.Name}, new(corev1.ConfigMap)); err != nil {
+		t.Errorf("expected ConfigMap matching the label selector to be cached, got=%v", err)
+	}
+
+	err := reader.Get(ctx, types.NamespacedName{Namespace: "bar", Name: unmanaged.Name}, new(corev1.ConfigMap))
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected ConfigMap not matching the label selector to not be cached, got=%v", err)
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+var (
+	certificateRequestGVK = schema.GroupVersionKind{
+		Group:   "cert-manager.io",
+		Version: "v1",
+		Kind:    "CertificateRequest",
+	}
+)
+
+// certificateRequest denies CertificateRequests that reference the configured
+// issuer, but were not created by istio-csr or an allowed user, such as
+// cert-manager's controller requesting istiod's serving certificate from a
+// Certificate resource. CertificateRequests are handled as
+// unstructured since the requester's username is only present from
+// cert-manager v1.3.
+type certificateRequest struct {
+	log    logr.Logger
+	client client.Client
+
+	issuerRef cmmeta.ObjectReference
+	namespace string
+	username  string
+
+	// allowedUsernames are usernames, other than istio-csr's, whose
+	// CertificateRequests are not denied.
+	allowedUsernames map[string]struct{}
+}
+
+// newUnstructuredCertificateRequest returns an empty unstructured
+// CertificateRequest.
+func newUnstructuredCertificateRequest() *unstructured.Unstructured {
+	cr := new(unstructured.Unstructured)
+	cr.SetGroupVersionKind(certificateRequestGVK)
+	return cr
+}
+
+// Reconcile is called when a CertificateRequest event occurs for a
+// CertificateRequest which references the configured issuer. If the
+// CertificateRequest has not been created by istio-csr, and has not yet been
+// approved or denied, Reconcile will deny it.
+func (c *certificateRequest) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := c.log.WithValues("certificaterequest", req.NamespacedName.String())
+	cr := newUnstructuredCertificateRequest()
+
+	err := c.client.Get(ctx, req.NamespacedName, cr)
+	if apierrors.IsNotFound(err) {
+		log.V(2).Info("certificaterequest doesn't exist, ignoring")
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get %q: %s", req.NamespacedName, err)
+	}
+
+	if !c.referencesIssuer(cr) {
+		return ctrl.Result{}, nil
+	}
+
+	conditions, _, err := unstructured.NestedSlice(cr.Object, "status", "conditions")
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to read conditions of %q: %s", req.NamespacedName, err)
+	}
+
+	// Never change the decision of a CertificateRequest which has already been
+	// approved or denied.
+	for _, condition := range conditions {
+		condition, ok := condition.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		switch condition["type"] {
+		case string(util.CertificateRequestConditionApproved), string(util.CertificateRequestConditionDenied):
+			return ctrl.Result{}, nil
+		}
+	}
+
+	username, _, _ := unstructured.NestedString(cr.Object, "spec", "username")
+	if username == c.username {
+		return ctrl.Result{}, nil
+	}
+	if _, ok := c.allowedUsernames[username]; ok {
+		log.V(2).Info("certificaterequest created by allowed user, ignoring", "username", username)
+		return ctrl.Result{}, nil
+	}
+
+	log.Info("denying certificaterequest not created by istio-csr", "username", username)
+
+	conditions = append(conditions, map[string]interface{}{
+		"type":               string(util.CertificateRequestConditionDenied),
+		"status":             string(cmmeta.ConditionTrue),
+		"reason":             util.ApprovalReason,
+		"message":            fmt.Sprintf("CertificateRequests for this issuer may only be created by istio-csr, requested by %q", username),
+		"lastTransitionTime": metav1.Now().UTC().Format(time.RFC3339),
+	})
+
+	if err := unstructured.SetNestedSlice(cr.Object, conditions, "status", "conditions"); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to set conditions of %q: %s", req.NamespacedName, err)
+	}
+
+	if err := c.client.Status().Update(ctx, cr); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to deny %q: %s", req.NamespacedName, err)
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// referencesIssuer returns true if the given CertificateRequest references the
+// configured issuer. Namespaced issuers can only be referenced by
+// CertificateRequests in the same namespace.
+func (c *certificateRequest) referencesIssuer(obj client.Object) bool {
+	cr, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return false
+	}
+
+	var ref cmmeta.ObjectReference
+	ref.Name, _, _ = unstructured.NestedString(cr.Object, "spec", "issuerRef", "name")
+	ref.Kind, _, _ = unstructured.NestedString(cr.Object, "spec", "issuerRef", "kind")
+	ref.Group, _, _ = unstructured.NestedString(cr.Object, "spec", "issuerRef", "group")
+
+	if !util.IssuerRefEqual(ref, c.issuerRef) {
+		return false
+	}
+
+	if (len(ref.Kind) == 0 || ref.Kind == "Issuer") && cr.GetNamespace() != c.namespace {
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2/klogr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+func TestCertificateRequestReconcile(t *testing.T) {
+	const (
+		istioCSRUsername    = "system:serviceaccount:cert-manager:cert-manager-istio-csr"
+		certManagerUsername = "system:serviceaccount:cert-manager:cert-manager"
+	)
+
+	tests := map[string]struct {
+		username         string
+		issuerName       string
+		namespace        string
+		ownerCertificate string
+		allowedUsernames []string
+		conditions       []interface{}
+		expDenied        bool
+	}{
+		"if created by istio-csr, should not deny": {
+			username:   istioCSRUsername,
+			issuerName: "istio-ca",
+			namespace:  testNamespacedName.Namespace,
+			expDenied:  false,
+		},
+		"if created by another user, should deny": {
+			username:   "system:serviceaccount:istio-system:other",
+			issuerName: "istio-ca",
+			namespace:  testNamespacedName.Namespace,
+			expDenied:  true,
+		},
+		"if created by cert-manager for the chart's istiod Certificate and cert-manager is allowed, should not deny": {
+			username:         certManagerUsername,
+			issuerName:       "istio-ca",
+			namespace:        testNamespacedName.Namespace,
+			ownerCertificate: "istiod",
+			allowedUsernames: []string{certManagerUsername},
+			expDenied:        false,
+		},
+		"if created by cert-manager for the chart's istiod Certificate but cert-manager is not allowed, should deny": {
+			username:         certManagerUsername,
+			issuerName:       "istio-ca",
+			namespace:        testNamespacedName.Namespace,
+			ownerCertificate: "istiod",
+			expDenied:        true,
+		},
+		"if created by another user for another issuer, should not deny": {
+			username:   "system:serviceaccount:istio-system:other",
+			issuerName: "other-ca",
+			namespace:  testNamespacedName.Namespace,
+			expDenied:  false,
+		},
+		"if created by another user in another namespace, should not deny": {
+			username:   "system:serviceaccount:istio-system:other",
+			issuerName: "istio-ca",
+			namespace:  "other-ns",
+			expDenied:  false,
+		},
+		"if created by another user but already approved, should not deny": {
+			username:   "system:serviceaccount:istio-system:other",
+			issuerName: "istio-ca",
+			namespace:  testNamespacedName.Namespace,
+			conditions: []interface{}{
+				map[string]interface{}{
+					"type":   string(util.CertificateRequestConditionApproved),
+					"status": "True",
+				},
+			},
+			expDenied: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cr := newUnstructuredCertificateRequest()
+			cr.SetName(testNamespacedName.Name)
+			cr.SetNamespace(test.namespace)
+			unstructured.SetNestedField(cr.Object, test.username, "spec", "username")
+			unstructured.SetNestedField(cr.Object, test.issuerName, "spec", "issuerRef", "name")
+			if len(test.ownerCertificate) > 0 {
+				cr.SetOwnerReferences([]metav1.OwnerReference{
+					{
+						APIVersion: "cert-manager.io/v1",
+						Kind:       "Certificate",
+						Name:       test.ownerCertificate,
+						UID:        "1234",
+					},
+				})
+			}
+			if test.conditions != nil {
+				unstructured.SetNestedSlice(cr.Object, test.conditions, "status", "conditions")
+			}
+
+			scheme := runtime.NewScheme()
+			scheme.AddKnownTypeWithName(certificateRequestGVK, new(unstructured.Unstructured))
+			client := fakeclient.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(cr).Build()
+
+			c := &certificateRequest{
+				log:    klogr.New(),
+				client: client,
+				issuerRef: cmmeta.ObjectReference{
+					Name:  "istio-ca",
+					Kind:  "Issuer",
+					Group: "cert-manager.io",
+				},
+				namespace: testNamespacedName.Namespace,
+				username:  istioCSRUsername,
+
+				allowedUsernames: make(map[string]struct{}),
+			}
+			for _, username := range test.allowedUsernames {
+				c.allowedUsernames[username] = struct{}{}
+			}
+
+			req := ctrl.Request{}
+			req.Name, req.Namespace = cr.GetName(), cr.GetNamespace()
+			if _, err := c.Reconcile(context.TODO(), req); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			got := newUnstructuredCertificateRequest()
+			if err := client.Get(context.TODO(), req.NamespacedName, got); err != nil {
+				t.Fatal(err)
+			}
+
+			var denied bool
+			conditions, _, _ := unstructured.NestedSlice(got.Object, "status", "conditions")
+			for _, condition := range conditions {
+				if condition.(map[string]interface{})["type"] == string(util.CertificateRequestConditionDenied) {
+					denied = true
+				}
+			}
+
+			if denied != test.expDenied {
+				t.Errorf("unexpected denied, exp=%t got=%t", test.expDenied, denied)
+			}
+		})
+	}
+}
@@ -18,8 +18,9 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"os"
+	"sync"
 
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
@@ -27,18 +28,34 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
 	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	"github.com/cert-manager/istio-csr/cmd/app/options"
+	"github.com/cert-manager/istio-csr/pkg/server/admission"
+	"github.com/cert-manager/istio-csr/pkg/util"
 )
 
 const (
 	IstioConfigLabelKey = "istio.io/config"
+
+	// FieldManager is the field manager istio-csr applies ConfigMaps with.
+	FieldManager = "cert-manager-istio-csr"
 )
 
 // CARoot manages reconciles a configmap in each namespace with a desired set of data.
@@ -61,11 +78,31 @@ type configmap struct {
 
 type enforcer struct {
 	client        client.Client
-	data          map[string]string
 	configMapName string
+
+	// selector selects the namespaces the ConfigMap is distributed to. If
+	// removeUnselected is true, ConfigMaps are removed from namespaces which are
+	// not selected.
+	selector         *namespaceSelector
+	removeUnselected bool
+
+	// revisions, if set, selects the ConfigMap name and data of a namespace by
+	// its istio revision label.
+	revisions *revisions
+
+	// recorder records field manager conflicts against ConfigMaps. If nil, no
+	// events are recorded.
+	recorder record.EventRecorder
+
+	mu   sync.RWMutex
+	data map[string]string
 }
 
-func NewCARootController(opts *options.Options, data map[string]string, healthz healthz.Checker) (*CARoot, error) {
+// NewCARootController returns a new controller which distributes the root CA
+// bundle of rootCAs to every namespace, and updates the bundle when it changes.
+// The runnables are run alongside the controller, by the leader only.
+func NewCARootController(opts *options.Options, rootCAs RootCAs, healthz healthz.Checker,
+	runnables ...manager.Runnable) (*CARoot, error) {
 	log := opts.Logr.WithName("ca-root-controller").WithValues("configmap-name", opts.RootCAConfigMapName)
 
 	scheme := runtime.NewScheme()
@@ -73,20 +110,36 @@ func NewCARootController(opts *options.Options, data map[string]string, healthz
 		return nil, fmt.Errorf("failed to add kubernetes scheme: %s", err)
 	}
 
-	// hostname used as the leader election ID.
-	hostname, err := os.Hostname()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get hostname for election ID: %s", err)
+	// In restricted mode, only the watched namespaces are cached, and
+	// Namespaces are never watched.
+	restricted := len(opts.WatchNamespaces) > 0
+
+	var newCache cache.NewCacheFunc
+	if restricted {
+		cacheNamespaces := sets.NewString(opts.WatchNamespaces...)
+		if opts.DenyCRs {
+			// CertificateRequests are watched in the certificate namespace
+			cacheNamespaces.Insert(opts.Namespace)
+		}
+		newCache = cache.MultiNamespacedCacheBuilder(cacheNamespaces.List())
 	}
 
 	mgr, err := ctrl.NewManager(opts.KubeOptions.RestConfig, ctrl.Options{
-		Scheme:                  scheme,
-		LeaderElection:          true,
-		LeaderElectionNamespace: opts.Namespace,
-		LeaderElectionID:        hostname,
-		ReadinessEndpointName:   opts.ReadyzPath,
-		HealthProbeBindAddress:  fmt.Sprintf("0.0.0.0:%d", opts.ReadyzPort),
-		Logger:                  log,
+		NewCache:                   newCache,
+		Scheme:                     scheme,
+		LeaderElection:             opts.LeaderElection,
+		LeaderElectionResourceLock: resourcelock.LeasesResourceLock,
+		LeaderElectionNamespace:    opts.LeaderElectionNamespace,
+		LeaderElectionID:           opts.LeaderElectionID,
+		LeaseDuration:              &opts.LeaderElectionLeaseDuration,
+		RenewDeadline:              &opts.LeaderElectionRenewDeadline,
+		RetryPeriod:                &opts.LeaderElectionRetryPeriod,
+		ReadinessEndpointName:      opts.ReadyzPath,
+		HealthProbeBindAddress:     fmt.Sprintf("0.0.0.0:%d", opts.ReadyzPort),
+		MetricsBindAddress:         fmt.Sprintf("0.0.0.0:%d", opts.MetricsPort),
+		Logger:                     log,
+		Port:                       opts.AdmissionPort,
+		CertDir:                    opts.AdmissionCertDir,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("unable to start manager: %s", err)
@@ -96,48 +149,201 @@ func NewCARootController(opts *options.Options, data map[string]string, healthz
 		return nil, fmt.Errorf("failed to add istio-csr readiness checks: %s", err)
 	}
 
-	enforcer := &enforcer{
-		client:        mgr.GetClient(),
-		data:          data,
-		configMapName: opts.RootCAConfigMapName,
+	// The ConfigMap name and data of each namespace is selected by its istio
+	// revision
+	revisions := newRevisions(opts.DefaultRevision, opts.RevisionConfigMapNames, opts.RevisionRootCAs)
+
+	// Only the root CA ConfigMaps are cached, rather than every ConfigMap in
+	// the cluster. ConfigMaps are read from this cache, and all other objects
+	// from the manager's cache.
+	configMapCache := newConfigMapCache(opts.KubeClient,
+		revisions.configMapNames(opts.RootCAConfigMapName), opts.WatchNamespaces, opts.ConfigMapLabelSelector)
+	if err := mgr.Add(configMapCache); err != nil {
+		return nil, fmt.Errorf("failed to add configmap cache: %s", err)
+	}
+
+	cachedClient, err := client.NewDelegatingClient(client.NewDelegatingClientInput{
+		CacheReader: &configMapReader{Reader: mgr.GetCache(), cache: configMapCache},
+		Client:      mgr.GetClient(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build client: %s", err)
+	}
+
+	recorder := mgr.GetEventRecorderFor("cert-manager-istio-csr")
+
+	// Remote clusters are distributed the root CA in the same way as the local
+	// cluster, each with its own enforcer
+	selector := newNamespaceSelector(opts.NamespaceSelector, includeNamespaces(opts), opts.ExcludeNamespaces)
+	newEnforcer := func(client client.Client) *enforcer {
+		return &enforcer{
+			client:           client,
+			data:             rootCAData(rootCAs.RootCA()),
+			configMapName:    opts.RootCAConfigMapName,
+			selector:         selector,
+			removeUnselected: opts.RemoveUnselectedConfigMaps,
+			revisions:        revisions,
+		}
 	}
 
+	enforcer := newEnforcer(cachedClient)
+	enforcer.recorder = recorder
+
 	namespace := &namespace{
 		log:      log,
-		client:   mgr.GetClient(),
+		client:   cachedClient,
 		enforcer: enforcer,
 	}
 	configmap := &configmap{
 		log:      log,
-		client:   mgr.GetClient(),
+		client:   cachedClient,
 		enforcer: enforcer,
 	}
 
-	if err := ctrl.NewControllerManagedBy(mgr).
-		For(new(corev1.Namespace)).
-		Complete(namespace); err != nil {
-		return nil, fmt.Errorf("failed to create namespace controller: %s", err)
-	}
+	// Namespaces are requeued by the root CA watcher when the root CA changes
+	requeueEvents := make(chan event.GenericEvent)
 
-	// Only reconcile config maps that match the well known name
-	if err := ctrl.NewControllerManagedBy(mgr).
-		For(new(corev1.ConfigMap)).
-		WithEventFilter(predicate.NewPredicateFuncs(func(obj client.Object) bool {
-			if obj.GetName() != opts.RootCAConfigMapName {
-				return false
-			}
-			return true
-		})).
-		Complete(configmap); err != nil {
+	configMapController, err := controller.New("configmap", mgr, controller.Options{
+		Reconciler: configmap,
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to create configmap controller: %s", err)
 	}
 
+	for _, informer := range configMapCache.informers {
+		if err := configMapController.Watch(&source.Informer{Informer: informer}, new(handler.EnqueueRequestForObject)); err != nil {
+			return nil, fmt.Errorf("failed to watch configmaps: %s", err)
+		}
+	}
+
+	if restricted {
+		// Namespaces cannot be watched, so requeue the ConfigMap of each
+		// requeued namespace instead
+		if err := configMapController.Watch(&source.Channel{Source: requeueEvents},
+			handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{
+					Namespace: obj.GetName(),
+					Name:      opts.RootCAConfigMapName,
+				}}}
+			})); err != nil {
+			return nil, fmt.Errorf("failed to watch requeued namespaces: %s", err)
+		}
+	} else {
+		// Only Namespace metadata is cached
+		if err := ctrl.NewControllerManagedBy(mgr).
+			For(new(corev1.Namespace), builder.OnlyMetadata).
+			Watches(&source.Channel{Source: requeueEvents}, new(handler.EnqueueRequestForObject)).
+			Complete(namespace); err != nil {
+			return nil, fmt.Errorf("failed to create namespace controller: %s", err)
+		}
+	}
+
+	watcher := &rootCAWatcher{
+		log:           log.WithName("root-ca-watcher"),
+		client:        cachedClient,
+		recorder:      recorder,
+		rootCAs:       rootCAs,
+		rootCAEvents:  rootCAs.SubscribeRootCAEvents(),
+		enforcer:      enforcer,
+		requeueEvents: requeueEvents,
+		namespaces:    opts.WatchNamespaces,
+	}
+
+	if len(opts.PodName) > 0 && len(opts.PodNamespace) > 0 {
+		watcher.eventObject = &corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       opts.PodName,
+			Namespace:  opts.PodNamespace,
+		}
+	}
+
+	if !opts.WebhookCABundleSelector.Empty() || len(opts.WebhookCABundleNames) > 0 {
+		if err := addWebhookCABundleControllers(mgr, log, recorder, rootCAs, &webhookSelector{
+			labels: opts.WebhookCABundleSelector,
+			names:  sets.NewString(opts.WebhookCABundleNames...),
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.RemoteClusters {
+		watcher.remotes = newRemoteClusters(log, mgr, opts.KubeClient,
+			opts.RemoteClusterSecretNamespace, opts.ClusterID, rootCAs,
+			revisions.configMapNames(opts.RootCAConfigMapName), opts.ConfigMapLabelSelector, newEnforcer)
+		watcher.remotes.recorder = recorder
+		watcher.remotes.eventObject = watcher.eventObject
+		if err := mgr.Add(watcher.remotes); err != nil {
+			return nil, fmt.Errorf("failed to add remote clusters: %s", err)
+		}
+	}
+
+	if err := mgr.Add(watcher); err != nil {
+		return nil, fmt.Errorf("failed to add root CA watcher: %s", err)
+	}
+
+	for _, runnable := range runnables {
+		if err := mgr.Add(runnable); err != nil {
+			return nil, fmt.Errorf("failed to add leader runnable: %s", err)
+		}
+	}
+
+	// Optionally serve the CertificateRequest validating admission webhook,
+	// protecting the configured issuer
+	if opts.AdmissionPort > 0 {
+		mgr.GetWebhookServer().Register(admission.Path, &webhook.Admission{
+			Handler: admission.New(opts.Logr, opts.IssuerRef, opts.Namespace, opts.Username,
+				opts.AdmissionAllowedUsernames, opts.AdmissionTrustedUsernames),
+		})
+	}
+
+	// Optionally deny CertificateRequests for the configured issuer that were
+	// not created by istio-csr
+	if opts.DenyCRs {
+		certificateRequest := &certificateRequest{
+			log:       opts.Logr.WithName("certificaterequest-denier"),
+			client:    mgr.GetClient(),
+			issuerRef: opts.IssuerRef,
+			namespace: opts.Namespace,
+			username:  opts.Username,
+
+			allowedUsernames: make(map[string]struct{}),
+		}
+		for _, username := range opts.DenyCRsAllowedUsernames {
+			certificateRequest.allowedUsernames[username] = struct{}{}
+		}
+
+		if err := ctrl.NewControllerManagedBy(mgr).
+			For(newUnstructuredCertificateRequest()).
+			WithEventFilter(predicate.NewPredicateFuncs(certificateRequest.referencesIssuer)).
+			Complete(certificateRequest); err != nil {
+			return nil, fmt.Errorf("failed to create certificaterequest controller: %s", err)
+		}
+	}
+
 	return &CARoot{
 		mgr: mgr,
 		log: log,
 	}, nil
 }
 
+// newNamespaceMetadata returns an empty Namespace metadata object, which is
+// read from the metadata only Namespace cache.
+func newNamespaceMetadata() *metav1.PartialObjectMetadata {
+	ns := new(metav1.PartialObjectMetadata)
+	ns.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Namespace"))
+	return ns
+}
+
+// includeNamespaces returns the namespaces the ConfigMap may be distributed
+// to. In restricted mode, this is the watched namespaces.
+func includeNamespaces(opts *options.Options) []string {
+	if len(opts.WatchNamespaces) > 0 {
+		return opts.WatchNamespaces
+	}
+	return opts.IncludeNamespaces
+}
+
 // Run starts the controller. This is a blocking function.
 func (c *CARoot) Run(ctx context.Context) error {
 	c.log.Info("starting controller")
@@ -148,7 +354,18 @@ func (c *CARoot) Run(ctx context.Context) error {
 // well known name in the target Kubernetes cluster. Reconcile will ensure that
 // the ConfigMap exists, and the CA root bundle is present.
 func (c *configmap) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	if err := c.configmap(ctx, c.log, req.NamespacedName.Namespace); err != nil {
+	log := c.log.WithValues("namespace", req.NamespacedName.Namespace)
+
+	selected, err := c.selected(ctx, req.NamespacedName.Namespace)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !selected {
+		return ctrl.Result{}, c.removeConfigMaps(ctx, log, req.NamespacedName.Namespace, "")
+	}
+
+	if err := c.configmap(ctx, log, req.NamespacedName.Namespace); err != nil {
 		return ctrl.Result{}, err
 	}
 
@@ -160,7 +377,7 @@ func (c *configmap) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resul
 // exists, CA root bundle is present.
 func (n *namespace) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := n.log.WithValues("namespace", req.NamespacedName.String())
-	ns := new(corev1.Namespace)
+	ns := newNamespaceMetadata()
 
 	// Attempt to get the synced Namespace. If the resource no longer
 	// exists, we can ignore it.
@@ -173,12 +390,18 @@ func (n *namespace) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resul
 		return ctrl.Result{}, fmt.Errorf("failed to get %q: %s", req.NamespacedName, err)
 	}
 
-	// If the namespace is terminating, we should reconcile configmap
-	if ns.Status.Phase == corev1.NamespaceTerminating {
+	// If the namespace is terminating, we should reconcile configmap. Only
+	// metadata is cached, so a namespace is terminating once it has been
+	// marked for deletion.
+	if ns.DeletionTimestamp != nil {
 		log.V(2).Info("namespace is terminating, ignoring")
 		return ctrl.Result{}, nil
 	}
 
+	if !n.selector.matches(ns) {
+		return ctrl.Result{}, n.removeConfigMaps(ctx, log, req.Name, "")
+	}
+
 	if err := n.configmap(ctx, log, req.Name); err != nil {
 		return ctrl.Result{}, err
 	}
@@ -186,66 +409,256 @@ func (n *namespace) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Resul
 	return ctrl.Result{}, nil
 }
 
-// configmap will ensure that the provided namespace has the correct ConfigMap,
-// with the correct data and label.
-func (e *enforcer) configmap(ctx context.Context, log logr.Logger, namespace string) error {
-	var (
-		namespacedName = types.NamespacedName{
-			Name:      e.configMapName,
-			Namespace: namespace,
+// getData returns the data which should be present in every ConfigMap.
+func (e *enforcer) getData() map[string]string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.data
+}
+
+// setData replaces the data which should be present in every ConfigMap.
+func (e *enforcer) setData(data map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.data = data
+}
+
+// selected returns true if the namespace with the given name is selected for
+// the ConfigMap to be distributed to. The namespace is only fetched if needed
+// to match its labels.
+func (e *enforcer) selected(ctx context.Context, namespace string) (bool, error) {
+	if !e.selector.matchesName(namespace) {
+		return false, nil
+	}
+
+	if !e.selector.requiresLabels() {
+		return true, nil
+	}
+
+	ns := newNamespaceMetadata()
+	err := e.client.Get(ctx, types.NamespacedName{Name: namespace}, ns)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get namespace %q: %s", namespace, err)
+	}
+
+	return e.selector.matches(ns), nil
+}
+
+// removeConfigMaps will remove the ConfigMaps written by istio-csr from a
+// namespace, other than the ConfigMap named keep, if configured to remove
+// unselected ConfigMaps. This removes the ConfigMaps from namespaces which are
+// not selected, and those of other revisions from selected namespaces.
+// ConfigMaps not managed by istio-csr are left untouched.
+func (e *enforcer) removeConfigMaps(ctx context.Context, log logr.Logger, namespace, keep string) error {
+	if !e.removeUnselected {
+		log.V(3).Info("not removing unselected configmaps, ignoring")
+		return nil
+	}
+
+	for _, name := range e.revisions.configMapNames(e.configMapName) {
+		if name == keep {
+			continue
 		}
-		cm = new(corev1.ConfigMap)
-	)
 
+		if err := e.removeConfigMap(ctx, log, types.NamespacedName{Name: name, Namespace: namespace}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeConfigMap will remove the ConfigMap, if it is managed by istio-csr.
+func (e *enforcer) removeConfigMap(ctx context.Context, log logr.Logger, namespacedName types.NamespacedName) error {
 	log = log.WithValues("configmap", namespacedName.String())
+
+	cm := new(corev1.ConfigMap)
 	err := e.client.Get(ctx, namespacedName, cm)
 	if apierrors.IsNotFound(err) {
-		log.V(3).Info("configmap doesn't exist, creating")
-
-		return e.client.Create(ctx, &corev1.ConfigMap{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      e.configMapName,
-				Namespace: namespace,
-				Labels: map[string]string{
-					IstioConfigLabelKey: "true",
-				},
-			},
-			Data: e.data,
-		})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get %q: %s", namespacedName, err)
 	}
 
+	if cm.Labels[util.ManagedByLabelKey] != util.ManagedByLabelValue {
+		log.V(3).Info("configmap not managed by istio-csr, not removing")
+		return nil
+	}
+
+	log.Info("removing unselected configmap")
+	if err := e.client.Delete(ctx, cm); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete %q: %s", namespacedName, err)
+	}
+
+	return nil
+}
+
+// namespaceRevision returns the istio revision of the namespace. The namespace
+// is only fetched if revisions are configured.
+func (e *enforcer) namespaceRevision(ctx context.Context, namespace string) (revision, error) {
+	if !e.revisions.requiresLabels() {
+		return revision{}, nil
+	}
+
+	ns := newNamespaceMetadata()
+	if err := e.client.Get(ctx, types.NamespacedName{Name: namespace}, ns); err != nil {
+		return revision{}, err
+	}
+
+	return e.revisions.forNamespace(ns), nil
+}
+
+// configmap will ensure that the provided namespace has the ConfigMap of its
+// istio revision, with the correct data and labels, and remove the ConfigMaps
+// of other revisions if configured to remove unselected ConfigMaps.
+func (e *enforcer) configmap(ctx context.Context, log logr.Logger, namespace string) error {
+	rev, err := e.namespaceRevision(ctx, namespace)
+	if apierrors.IsNotFound(err) {
+		log.V(2).Info("namespace doesn't exist, ignoring")
+		return nil
+	}
 	if err != nil {
+		return fmt.Errorf("failed to get namespace %q: %s", namespace, err)
+	}
+
+	configMapName, data := e.configMapName, e.getData()
+	if len(rev.configMapName) > 0 {
+		configMapName = rev.configMapName
+	}
+	if len(rev.rootCA) > 0 {
+		data = rootCAData(rev.rootCA)
+	}
+
+	if err := e.applyConfigMap(ctx, log, types.NamespacedName{Name: configMapName, Namespace: namespace}, data); err != nil {
+		return err
+	}
+
+	if e.revisions.requiresLabels() {
+		return e.removeConfigMaps(ctx, log, namespace, configMapName)
+	}
+
+	return nil
+}
+
+// applyConfigMap will ensure that the ConfigMap exists with the correct data
+// and labels. The ConfigMap is server-side applied, so that istio-csr only owns
+// the root CA key and its labels. If another field manager owns the root CA
+// key, the conflict is reported rather than the key being overwritten.
+func (e *enforcer) applyConfigMap(ctx context.Context, log logr.Logger, namespacedName types.NamespacedName, data map[string]string) error {
+	cm := new(corev1.ConfigMap)
+
+	log = log.WithValues("configmap", namespacedName.String())
+	err := e.client.Get(ctx, namespacedName, cm)
+	switch {
+	case apierrors.IsNotFound(err):
+		cm = nil
+	case err != nil:
 		return fmt.Errorf("failed to get %q: %s", namespacedName, err)
+	case configMapUpToDate(cm, data):
+		return nil
 	}
 
-	var notMatch bool
-	for k, v := range e.data {
-		if kv, ok := cm.Data[k]; !ok || v != kv {
-			if cm.Data == nil {
-				cm.Data = make(map[string]string)
-			}
+	log.V(3).Info("applying configmap")
+	err = e.apply(ctx, namespacedName, data, false)
+	if err == nil {
+		return nil
+	}
+	if !apierrors.IsConflict(err) || cm == nil {
+		return fmt.Errorf("failed to apply %q: %s", namespacedName, err)
+	}
 
-			cm.Data[k] = v
-			notMatch = true
+	managers := conflictingManagers(cm, data)
+	if len(managers) == 0 {
+		// Only fields previously written by istio-csr with an update conflict,
+		// so take ownership of them
+		log.Info("taking ownership of configmap fields previously written by istio-csr")
+		if err := e.apply(ctx, namespacedName, data, true); err != nil {
+			return fmt.Errorf("failed to apply %q: %s", namespacedName, err)
 		}
+		return nil
 	}
 
-	if val, ok := cm.Labels[IstioConfigLabelKey]; !ok || val != "true" {
-		notMatch = true
+	// Returning an error would retry the apply indefinitely. The ConfigMap is
+	// reconciled again when it changes.
+	log.Error(err, "root CA key is owned by another field manager, not overwriting", "managers", managers)
+	if e.recorder != nil {
+		e.recorder.Eventf(cm, corev1.EventTypeWarning, "FieldManagerConflict",
+			"Key %q is owned by field managers %v, not overwriting", RootCertKey, managers)
 	}
 
-	if notMatch {
-		if cm.Labels == nil {
-			cm.Labels = make(map[string]string)
+	return nil
+}
+
+// apply server-side applies the ConfigMap with the given data, owning only
+// the given data keys and the istio-csr labels.
+func (e *enforcer) apply(ctx context.Context, namespacedName types.NamespacedName, data map[string]string, force bool) error {
+	cm := &corev1.ConfigMap{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      namespacedName.Name,
+			Namespace: namespacedName.Namespace,
+			Labels: map[string]string{
+				IstioConfigLabelKey:    "true",
+				util.ManagedByLabelKey: util.ManagedByLabelValue,
+			},
+		},
+		Data: data,
+	}
+
+	opts := []client.PatchOption{client.FieldOwner(FieldManager)}
+	if force {
+		opts = append(opts, client.ForceOwnership)
+	}
+
+	return e.client.Patch(ctx, cm, client.Apply, opts...)
+}
+
+// configMapUpToDate returns true if the ConfigMap already contains the given
+// data and the istio-csr labels.
+func configMapUpToDate(cm *corev1.ConfigMap, data map[string]string) bool {
+	for k, v := range data {
+		if kv, ok := cm.Data[k]; !ok || v != kv {
+			return false
 		}
+	}
 
-		cm.Labels[IstioConfigLabelKey] = "true"
+	return cm.Labels[IstioConfigLabelKey] == "true" &&
+		cm.Labels[util.ManagedByLabelKey] == util.ManagedByLabelValue
+}
 
-		log.V(3).Info("updating configmap")
-		if err := e.client.Update(ctx, cm); err != nil {
-			return err
+// conflictingManagers returns the names of the field managers, other than
+// istio-csr, which own any of the given data keys of the ConfigMap.
+func conflictingManagers(cm *corev1.ConfigMap, data map[string]string) []string {
+	managers := sets.NewString()
+
+	for _, entry := range cm.ManagedFields {
+		if entry.Manager == FieldManager || entry.FieldsV1 == nil {
+			continue
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+
+		dataFields, ok := fields["f:data"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for k := range data {
+			if _, ok := dataFields["f:"+k]; ok {
+				managers.Insert(entry.Manager)
+			}
 		}
 	}
 
-	return nil
+	return managers.List()
 }
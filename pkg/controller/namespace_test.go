@@ -18,19 +18,24 @@ package controller
 
 import (
 	"context"
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	k8sscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2/klogr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
 
+	"github.com/cert-manager/istio-csr/pkg/util"
 	"github.com/cert-manager/istio-csr/test/gen"
 )
 
@@ -126,10 +131,11 @@ func TestNamespaceReconcile(t *testing.T) {
 	terminating := buildSuite()
 	for name, test := range terminating {
 		test.existingNamespace = nil
-		// Add terminating Namespace
+		// Add terminating Namespace, which has been marked for deletion
 		test.existingNamespace = &corev1.Namespace{
 			ObjectMeta: metav1.ObjectMeta{
-				Name: testNamespacedName.Namespace,
+				Name:              testNamespacedName.Namespace,
+				DeletionTimestamp: &metav1.Time{Time: time.Now()},
 			},
 			Status: corev1.NamespaceStatus{
 				Phase: corev1.NamespaceTerminating,
@@ -201,6 +207,72 @@ func TestEnforcerConfigMap(t *testing.T) {
 	}
 }
 
+func TestEnforcerConfigMapConflict(t *testing.T) {
+	managedFields := func(manager string) []metav1.ManagedFieldsEntry {
+		return []metav1.ManagedFieldsEntry{{
+			Manager:    manager,
+			Operation:  metav1.ManagedFieldsOperationUpdate,
+			APIVersion: "v1",
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:data":{"f:foo":{}}}`)},
+		}}
+	}
+
+	tests := map[string]struct {
+		managedFields []metav1.ManagedFieldsEntry
+		expData       map[string]string
+		expEvents     int
+	}{
+		"if the key is owned by another field manager, should not overwrite and record an event": {
+			managedFields: managedFields("kubectl"),
+			expData:       map[string]string{"foo": "foo"},
+			expEvents:     1,
+		},
+		"if the key was previously written by istio-csr, should take ownership": {
+			managedFields: managedFields(FieldManager),
+			expData:       map[string]string{"foo": "bar"},
+			expEvents:     0,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			existing := gen.ConfigMapFrom(baseConfigMap,
+				gen.SetConfigMapData(map[string]string{"foo": "foo"}),
+			)
+			existing.ManagedFields = test.managedFields
+
+			client := buildClient(t, &testCase{existingConfigMap: existing})
+			client.(*applyClient).conflict = true
+
+			recorder := record.NewFakeRecorder(10)
+			enforcer := &enforcer{
+				client:        client,
+				data:          map[string]string{"foo": "bar"},
+				configMapName: testNamespacedName.Name,
+				recorder:      recorder,
+			}
+
+			if err := enforcer.configmap(context.TODO(), klogr.New(), testNamespacedName.Namespace); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			cm := new(corev1.ConfigMap)
+			if err := client.Get(context.TODO(), testNamespacedName, cm); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(cm.Data, test.expData) {
+				t.Errorf("unexpected data, exp=%v got=%v", test.expData, cm.Data)
+			}
+
+			if len(recorder.Events) != test.expEvents {
+				t.Errorf("unexpected number of events, exp=%d got=%d", test.expEvents, len(recorder.Events))
+			}
+		})
+	}
+}
+
 func buildClient(t *testing.T, test *testCase) client.Client {
 	scheme := runtime.NewScheme()
 	if err := k8sscheme.AddToScheme(scheme); err != nil {
@@ -219,7 +291,47 @@ func buildClient(t *testing.T, test *testCase) client.Client {
 	if len(objects) > 0 {
 		client = client.WithRuntimeObjects(objects...)
 	}
-	return client.Build()
+	return &applyClient{Client: client.Build()}
+}
+
+// applyClient emulates server-side apply, which the fake client does not
+// support, by creating the object if it doesn't exist, or merge patching it
+// otherwise. If conflict is true, applies without force fail with a conflict.
+type applyClient struct {
+	client.Client
+	conflict bool
+}
+
+func (a *applyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return a.Client.Patch(ctx, obj, patch, opts...)
+	}
+
+	patchOpts := new(client.PatchOptions)
+	patchOpts.ApplyOptions(opts)
+	if patchOpts.FieldManager != FieldManager {
+		return fmt.Errorf("unexpected field manager %q", patchOpts.FieldManager)
+	}
+
+	if a.conflict && (patchOpts.Force == nil || !*patchOpts.Force) {
+		return apierrors.NewApplyConflict(nil, "conflict")
+	}
+
+	data, err := patch.Data(obj)
+	if err != nil {
+		return err
+	}
+
+	existing := obj.DeepCopyObject().(client.Object)
+	err = a.Client.Get(ctx, client.ObjectKeyFromObject(obj), existing)
+	if apierrors.IsNotFound(err) {
+		return a.Client.Create(ctx, obj)
+	}
+	if err != nil {
+		return err
+	}
+
+	return a.Client.Patch(ctx, obj, client.RawPatch(types.MergePatchType, data))
 }
 
 func assertConfigMap(t *testing.T, test *testCase, client client.Client) {
@@ -243,7 +355,8 @@ func buildSuite() suite {
 			expConfigMap: gen.ConfigMapFrom(baseConfigMap,
 				gen.SetConfigMapResourceVersion("1"),
 				gen.SetConfigMapLabels(map[string]string{
-					IstioConfigLabelKey: "true",
+					IstioConfigLabelKey:    "true",
+					util.ManagedByLabelKey: util.ManagedByLabelValue,
 				}),
 				gen.SetConfigMapData(map[string]string{
 					"foo": "bar",
@@ -261,7 +374,8 @@ func buildSuite() suite {
 			expConfigMap: gen.ConfigMapFrom(baseConfigMap,
 				gen.SetConfigMapResourceVersion("2"),
 				gen.SetConfigMapLabels(map[string]string{
-					IstioConfigLabelKey: "true",
+					IstioConfigLabelKey:    "true",
+					util.ManagedByLabelKey: util.ManagedByLabelValue,
 				}),
 				gen.SetConfigMapData(map[string]string{
 					"foo": "bar",
@@ -277,7 +391,8 @@ func buildSuite() suite {
 			expConfigMap: gen.ConfigMapFrom(baseConfigMap,
 				gen.SetConfigMapResourceVersion("2"),
 				gen.SetConfigMapLabels(map[string]string{
-					IstioConfigLabelKey: "true",
+					IstioConfigLabelKey:    "true",
+					util.ManagedByLabelKey: util.ManagedByLabelValue,
 				}),
 				gen.SetConfigMapData(map[string]string{
 					"foo": "bar",
@@ -297,7 +412,8 @@ func buildSuite() suite {
 			expConfigMap: gen.ConfigMapFrom(baseConfigMap,
 				gen.SetConfigMapResourceVersion("2"),
 				gen.SetConfigMapLabels(map[string]string{
-					IstioConfigLabelKey: "true",
+					IstioConfigLabelKey:    "true",
+					util.ManagedByLabelKey: util.ManagedByLabelValue,
 				}),
 				gen.SetConfigMapData(map[string]string{
 					"foo": "bar",
@@ -318,7 +434,8 @@ func buildSuite() suite {
 			expConfigMap: gen.ConfigMapFrom(baseConfigMap,
 				gen.SetConfigMapResourceVersion("2"),
 				gen.SetConfigMapLabels(map[string]string{
-					IstioConfigLabelKey: "true",
+					IstioConfigLabelKey:    "true",
+					util.ManagedByLabelKey: util.ManagedByLabelValue,
 				}),
 				gen.SetConfigMapData(map[string]string{
 					"foo": "bar",
@@ -340,7 +457,8 @@ func buildSuite() suite {
 			expConfigMap: gen.ConfigMapFrom(baseConfigMap,
 				gen.SetConfigMapResourceVersion("2"),
 				gen.SetConfigMapLabels(map[string]string{
-					IstioConfigLabelKey: "true",
+					IstioConfigLabelKey:    "true",
+					util.ManagedByLabelKey: util.ManagedByLabelValue,
 				}),
 				gen.SetConfigMapData(map[string]string{
 					"foo": "bar",
@@ -360,8 +478,9 @@ func buildSuite() suite {
 			expConfigMap: gen.ConfigMapFrom(baseConfigMap,
 				gen.SetConfigMapResourceVersion("2"),
 				gen.SetConfigMapLabels(map[string]string{
-					IstioConfigLabelKey: "true",
-					"foo-bar":           "true",
+					IstioConfigLabelKey:    "true",
+					util.ManagedByLabelKey: util.ManagedByLabelValue,
+					"foo-bar":              "true",
 				}),
 				gen.SetConfigMapData(map[string]string{
 					"foo": "bar",
@@ -372,8 +491,9 @@ func buildSuite() suite {
 			existingConfigMap: gen.ConfigMapFrom(baseConfigMap,
 				gen.SetConfigMapResourceVersion("1"),
 				gen.SetConfigMapLabels(map[string]string{
-					IstioConfigLabelKey: "true",
-					"foo":               "bar",
+					IstioConfigLabelKey:    "true",
+					util.ManagedByLabelKey: util.ManagedByLabelValue,
+					"foo":                  "bar",
 				}),
 				gen.SetConfigMapData(map[string]string{
 					"foo": "bar",
@@ -383,8 +503,9 @@ func buildSuite() suite {
 			expConfigMap: gen.ConfigMapFrom(baseConfigMap,
 				gen.SetConfigMapResourceVersion("1"),
 				gen.SetConfigMapLabels(map[string]string{
-					IstioConfigLabelKey: "true",
-					"foo":               "bar",
+					IstioConfigLabelKey:    "true",
+					util.ManagedByLabelKey: util.ManagedByLabelValue,
+					"foo":                  "bar",
 				}),
 				gen.SetConfigMapData(map[string]string{
 					"foo": "bar",
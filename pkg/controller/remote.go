@@ -0,0 +1,501 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// RemoteSecretLabelKey is the label of istio remote secrets, which hold the
+	// kubeconfigs of the remote clusters of a multi-cluster mesh, keyed by
+	// cluster ID.
+	RemoteSecretLabelKey = "istio/multiCluster"
+
+	// remoteClusterRetryPeriod is the period after which remote clusters which
+	// failed to start are retried.
+	remoteClusterRetryPeriod = time.Second * 30
+
+	// remoteClusterHealthPeriod is the period remote cluster health is checked.
+	remoteClusterHealthPeriod = time.Second * 30
+
+	// remoteClusterHealthTimeout is the timeout of a remote cluster health
+	// check.
+	remoteClusterHealthTimeout = time.Second * 5
+)
+
+var (
+	remoteClusterHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "certmanager",
+		Subsystem: "istio_csr",
+		Name:      "remote_cluster_healthy",
+		Help:      "Whether the root CA is being distributed to a remote cluster (1), or the remote cluster is unhealthy (0).",
+	}, []string{"cluster"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(remoteClusterHealthy)
+}
+
+// remoteClusters distributes the root CA to the remote clusters of a
+// multi-cluster mesh, read from istio remote secrets. A reconciler is run for
+// every remote cluster, which is restarted when the cluster's kubeconfig
+// changes, and stopped when it is removed.
+type remoteClusters struct {
+	log        logr.Logger
+	mgr        manager.Manager
+	kubeClient kubernetes.Interface
+
+	// namespace is the namespace of the remote secrets.
+	namespace string
+
+	// localClusterID is the ID of the cluster istio-csr runs in, which is
+	// ignored if present in a remote secret.
+	localClusterID string
+
+	rootCAs                RootCAs
+	configMapNames         []string
+	configMapLabelSelector labels.Selector
+
+	// newEnforcer returns a new enforcer for a remote cluster, using the
+	// given client.
+	newEnforcer func(client.Client) *enforcer
+
+	// startCluster starts the reconciler of a remote cluster.
+	startCluster func(ctx context.Context, name string, kubeconfig []byte) (*remoteCluster, error)
+
+	// probe checks the health of a remote cluster.
+	probe func(ctx context.Context, cluster *remoteCluster) error
+
+	// recorder records changes in remote cluster health against eventObject.
+	// If eventObject is nil, no events are recorded.
+	recorder    record.EventRecorder
+	eventObject runtime.Object
+
+	mu       sync.Mutex
+	clusters map[string]*remoteCluster
+	trigger  chan struct{}
+}
+
+// remoteCluster is a running reconciler of a remote cluster. A cluster is
+// unhealthy until it has been probed.
+type remoteCluster struct {
+	kubeconfig []byte
+	kubeClient kubernetes.Interface
+	probed     bool
+	healthy    bool
+	cancel     context.CancelFunc
+
+	// rootCAEvents notifies the cluster's root CA watcher of root CA changes.
+	rootCAEvents chan struct{}
+}
+
+// newRemoteClusters returns a new remoteClusters, reading remote secrets from
+// the given namespace.
+func newRemoteClusters(log logr.Logger, mgr manager.Manager, kubeClient kubernetes.Interface,
+	namespace, localClusterID string, rootCAs RootCAs, configMapNames []string,
+	configMapLabelSelector labels.Selector, newEnforcer func(client.Client) *enforcer) *remoteClusters {
+	r := &remoteClusters{
+		log:                    log.WithName("remote-clusters"),
+		mgr:                    mgr,
+		kubeClient:             kubeClient,
+		namespace:              namespace,
+		localClusterID:         localClusterID,
+		rootCAs:                rootCAs,
+		configMapNames:         configMapNames,
+		configMapLabelSelector: configMapLabelSelector,
+		newEnforcer:            newEnforcer,
+		clusters:               make(map[string]*remoteCluster),
+		trigger:                make(chan struct{}, 1),
+	}
+	r.startCluster = r.newCluster
+	r.probe = probeCluster
+	return r
+}
+
+// Start will watch the remote secrets, and run a reconciler for every remote
+// cluster, until the context is cancelled.
+func (r *remoteClusters) Start(ctx context.Context) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(r.kubeClient, 0,
+		informers.WithNamespace(r.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = labels.Set{RemoteSecretLabelKey: "true"}.String()
+		}),
+	)
+
+	secrets := factory.Core().V1().Secrets()
+	secrets.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { r.resync() },
+		UpdateFunc: func(interface{}, interface{}) { r.resync() },
+		DeleteFunc: func(interface{}) { r.resync() },
+	})
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), secrets.Informer().HasSynced) {
+		return errors.New("failed to sync remote secrets")
+	}
+
+	ticker := time.NewTicker(remoteClusterHealthPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.sync(ctx, nil)
+			return nil
+
+		case <-r.trigger:
+			list, err := secrets.Lister().List(labels.Everything())
+			if err != nil {
+				r.log.Error(err, "failed to list remote secrets")
+				continue
+			}
+			// Probe newly started clusters straight away
+			if r.sync(ctx, r.kubeconfigs(list)) {
+				r.checkHealth(ctx)
+			}
+
+		case <-ticker.C:
+			r.checkHealth(ctx)
+		}
+	}
+}
+
+// resync triggers the remote clusters to be synced with the remote secrets,
+// without blocking.
+func (r *remoteClusters) resync() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// notify notifies every remote cluster that the root CA may have changed,
+// without blocking. A nil remoteClusters does nothing.
+func (r *remoteClusters) notify() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, cluster := range r.clusters {
+		select {
+		case cluster.rootCAEvents <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// kubeconfigs returns the kubeconfig of every remote cluster in the remote
+// secrets, keyed by cluster ID. The local cluster is ignored. If a cluster is
+// present in more than one secret, the first secret by name is used.
+func (r *remoteClusters) kubeconfigs(secrets []*corev1.Secret) map[string][]byte {
+	sort.Slice(secrets, func(i, j int) bool {
+		return secrets[i].Name < secrets[j].Name
+	})
+
+	kubeconfigs := make(map[string][]byte)
+	for _, secret := range secrets {
+		for name, kubeconfig := range secret.Data {
+			if name == r.localClusterID {
+				continue
+			}
+
+			if _, ok := kubeconfigs[name]; ok {
+				r.log.Error(errors.New("duplicate remote cluster"), "ignoring remote cluster present in more than one secret",
+					"cluster", name, "secret", secret.Name)
+				continue
+			}
+
+			kubeconfigs[name] = kubeconfig
+		}
+	}
+
+	return kubeconfigs
+}
+
+// sync stops the remote clusters which have been removed or whose kubeconfig
+// has changed, and starts those which are not running. Clusters which fail to
+// start are retried. Building a cluster discovers its API server, so clusters
+// are built without holding the lock, so that slow clusters don't block root
+// CA notifications. Returns true if any cluster was started.
+func (r *remoteClusters) sync(ctx context.Context, kubeconfigs map[string][]byte) bool {
+	r.mu.Lock()
+	for name, cluster := range r.clusters {
+		if kubeconfig, ok := kubeconfigs[name]; ok && bytes.Equal(kubeconfig, cluster.kubeconfig) {
+			continue
+		}
+
+		r.log.Info("stopping remote cluster", "cluster", name)
+		cluster.cancel()
+		delete(r.clusters, name)
+		remoteClusterHealthy.DeleteLabelValues(name)
+	}
+
+	toStart := make(map[string][]byte)
+	for name, kubeconfig := range kubeconfigs {
+		if _, ok := r.clusters[name]; !ok {
+			toStart[name] = kubeconfig
+		}
+	}
+	r.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var failed bool
+	built := make(map[string]*remoteCluster, len(toStart))
+	for name, kubeconfig := range toStart {
+		r.log.Info("starting remote cluster", "cluster", name)
+		cluster, err := r.startCluster(ctx, name, kubeconfig)
+		if err != nil {
+			r.log.Error(err, "failed to start remote cluster, retrying", "cluster", name,
+				"retry-period", remoteClusterRetryPeriod)
+			remoteClusterHealthy.WithLabelValues(name).Set(0)
+			failed = true
+			continue
+		}
+
+		built[name] = cluster
+	}
+
+	if failed {
+		time.AfterFunc(remoteClusterRetryPeriod, r.resync)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var started bool
+	for name, cluster := range built {
+		// Drop clusters which were started by another sync, or are no longer
+		// wanted since the context was cancelled, while building
+		if _, ok := r.clusters[name]; ok || ctx.Err() != nil {
+			r.log.Info("stopping remote cluster started while building", "cluster", name)
+			cluster.cancel()
+			continue
+		}
+
+		r.clusters[name] = cluster
+		remoteClusterHealthy.WithLabelValues(name).Set(0)
+		started = true
+	}
+
+	return started
+}
+
+// checkHealth checks the readiness of the API server of every remote cluster,
+// logging and recording events on changes in health. Clusters are probed
+// concurrently, without holding the lock, so that slow clusters don't block
+// root CA notifications.
+func (r *remoteClusters) checkHealth(ctx context.Context) {
+	r.mu.Lock()
+	clusters := make(map[string]*remoteCluster, len(r.clusters))
+	for name, cluster := range r.clusters {
+		clusters[name] = cluster
+	}
+	r.mu.Unlock()
+
+	var (
+		wg     sync.WaitGroup
+		errsMu sync.Mutex
+		errs   = make(map[string]error, len(clusters))
+	)
+	for name, cluster := range clusters {
+		wg.Add(1)
+		go func(name string, cluster *remoteCluster) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, remoteClusterHealthTimeout)
+			defer cancel()
+			err := r.probe(ctx, cluster)
+			errsMu.Lock()
+			errs[name] = err
+			errsMu.Unlock()
+		}(name, cluster)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, cluster := range clusters {
+		// Ignore clusters which were stopped or restarted while probing
+		if r.clusters[name] != cluster {
+			continue
+		}
+
+		err := errs[name]
+		healthy := err == nil
+		if !cluster.probed || healthy != cluster.healthy {
+			if healthy {
+				r.log.Info("remote cluster is healthy", "cluster", name)
+				r.event(corev1.EventTypeNormal, "RemoteClusterHealthy", "Remote cluster %q is healthy", name)
+			} else {
+				r.log.Error(err, "remote cluster is unhealthy", "cluster", name)
+				r.event(corev1.EventTypeWarning, "RemoteClusterUnhealthy", "Remote cluster %q is unhealthy: %s", name, err)
+			}
+		}
+
+		cluster.probed = true
+		cluster.healthy = healthy
+		if healthy {
+			remoteClusterHealthy.WithLabelValues(name).Set(1)
+		} else {
+			remoteClusterHealthy.WithLabelValues(name).Set(0)
+		}
+	}
+}
+
+// event records an event against the event object, if set.
+func (r *remoteClusters) event(eventType, reason, messageFmt string, args ...interface{}) {
+	if r.recorder == nil || r.eventObject == nil {
+		return
+	}
+	r.recorder.Eventf(r.eventObject, eventType, reason, messageFmt, args...)
+}
+
+// probeCluster returns an error if the API server of the remote cluster is not
+// ready.
+func probeCluster(ctx context.Context, cluster *remoteCluster) error {
+	return cluster.kubeClient.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+}
+
+// newCluster builds and starts the reconciler of a remote cluster, which
+// distributes the root CA to the namespaces of the remote cluster in the same
+// way as the local cluster.
+func (r *remoteClusters) newCluster(ctx context.Context, name string, kubeconfig []byte) (*remoteCluster, error) {
+	log := r.log.WithValues("cluster", name)
+
+	restConfig, err := clientcmd.RESTConfigFromKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build kubeconfig: %s", err)
+	}
+
+	kubeClient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build kubernetes client: %s", err)
+	}
+
+	remote, err := cluster.New(restConfig, func(opts *cluster.Options) {
+		opts.Scheme = r.mgr.GetScheme()
+		opts.Logger = log
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build cluster: %s", err)
+	}
+
+	configMapCache := newConfigMapCache(kubeClient, r.configMapNames, nil, r.configMapLabelSelector)
+	cachedClient, err := client.NewDelegatingClient(client.NewDelegatingClientInput{
+		CacheReader: &configMapReader{Reader: remote.GetCache(), cache: configMapCache},
+		Client:      remote.GetClient(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build client: %s", err)
+	}
+
+	enforcer := r.newEnforcer(cachedClient)
+	requeueEvents := make(chan event.GenericEvent)
+
+	ctrl, err := controller.NewUnmanaged("remote-"+name, r.mgr, controller.Options{
+		Reconciler: &namespace{log: log, client: cachedClient, enforcer: enforcer},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create controller: %s", err)
+	}
+
+	// Only Namespace metadata is cached
+	if err := ctrl.Watch(source.NewKindWithCache(newNamespaceMetadata(), remote.GetCache()),
+		new(handler.EnqueueRequestForObject)); err != nil {
+		return nil, fmt.Errorf("failed to watch namespaces: %s", err)
+	}
+
+	// ConfigMap events requeue their namespace
+	for _, informer := range configMapCache.informers {
+		if err := ctrl.Watch(&source.Informer{Informer: informer},
+			handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+				return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: obj.GetNamespace()}}}
+			})); err != nil {
+			return nil, fmt.Errorf("failed to watch configmaps: %s", err)
+		}
+	}
+
+	if err := ctrl.Watch(&source.Channel{Source: requeueEvents}, new(handler.EnqueueRequestForObject)); err != nil {
+		return nil, fmt.Errorf("failed to watch requeued namespaces: %s", err)
+	}
+
+	rootCAEvents := make(chan struct{}, 1)
+	watcher := &rootCAWatcher{
+		log:           log.WithName("root-ca-watcher"),
+		client:        cachedClient,
+		rootCAs:       r.rootCAs,
+		rootCAEvents:  rootCAEvents,
+		enforcer:      enforcer,
+		requeueEvents: requeueEvents,
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		if err := remote.Start(ctx); err != nil {
+			log.Error(err, "remote cluster cache stopped")
+		}
+	}()
+	go configMapCache.Start(ctx)
+	go watcher.Start(ctx)
+	go func() {
+		if err := ctrl.Start(ctx); err != nil {
+			log.Error(err, "remote cluster controller stopped")
+		}
+	}()
+
+	return &remoteCluster{
+		kubeconfig:   kubeconfig,
+		kubeClient:   kubeClient,
+		cancel:       cancel,
+		rootCAEvents: rootCAEvents,
+	}, nil
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/klogr"
+)
+
+func TestRemoteClustersKubeconfigs(t *testing.T) {
+	r := &remoteClusters{log: klogr.New(), localClusterID: "local"}
+
+	kubeconfigs := r.kubeconfigs([]*corev1.Secret{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "secret-b"},
+			Data: map[string][]byte{
+				"cluster-1": []byte("kubeconfig-b1"),
+				"cluster-2": []byte("kubeconfig-b2"),
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "secret-a"},
+			Data: map[string][]byte{
+				"cluster-1": []byte("kubeconfig-a1"),
+				"local":     []byte("kubeconfig-local"),
+			},
+		},
+	})
+
+	exp := map[string][]byte{
+		"cluster-1": []byte("kubeconfig-a1"),
+		"cluster-2": []byte("kubeconfig-b2"),
+	}
+	if !reflect.DeepEqual(kubeconfigs, exp) {
+		t.Errorf("unexpected kubeconfigs, exp=%s got=%s", exp, kubeconfigs)
+	}
+}
+
+func TestRemoteClustersSync(t *testing.T) {
+	tests := map[string]struct {
+		running     map[string]string
+		kubeconfigs map[string]string
+		failStart   map[string]bool
+
+		expStarted []string
+		expStopped []string
+		expRunning []string
+	}{
+		"if no clusters are running, should start all clusters": {
+			running:     nil,
+			kubeconfigs: map[string]string{"cluster-1": "a", "cluster-2": "b"},
+			expStarted:  []string{"cluster-1", "cluster-2"},
+			expStopped:  nil,
+			expRunning:  []string{"cluster-1", "cluster-2"},
+		},
+		"if cluster kubeconfigs are unchanged, should not restart clusters": {
+			running:     map[string]string{"cluster-1": "a"},
+			kubeconfigs: map[string]string{"cluster-1": "a"},
+			expStarted:  nil,
+			expStopped:  nil,
+			expRunning:  []string{"cluster-1"},
+		},
+		"if a cluster kubeconfig changed, should restart the cluster": {
+			running:     map[string]string{"cluster-1": "a", "cluster-2": "b"},
+			kubeconfigs: map[string]string{"cluster-1": "a", "cluster-2": "c"},
+			expStarted:  []string{"cluster-2"},
+			expStopped:  []string{"cluster-2"},
+			expRunning:  []string{"cluster-1", "cluster-2"},
+		},
+		"if a cluster is removed, should stop the cluster": {
+			running:     map[string]string{"cluster-1": "a", "cluster-2": "b"},
+			kubeconfigs: map[string]string{"cluster-1": "a"},
+			expStarted:  nil,
+			expStopped:  []string{"cluster-2"},
+			expRunning:  []string{"cluster-1"},
+		},
+		"if a cluster fails to start, should start the other clusters": {
+			running:     nil,
+			kubeconfigs: map[string]string{"cluster-1": "a", "cluster-2": "b"},
+			failStart:   map[string]bool{"cluster-2": true},
+			expStarted:  []string{"cluster-1"},
+			expStopped:  nil,
+			expRunning:  []string{"cluster-1"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var started, stopped []string
+
+			newCluster := func(name, kubeconfig string) *remoteCluster {
+				return &remoteCluster{
+					kubeconfig: []byte(kubeconfig),
+					cancel:     func() { stopped = append(stopped, name) },
+				}
+			}
+
+			r := &remoteClusters{
+				log:      klogr.New(),
+				clusters: make(map[string]*remoteCluster),
+				trigger:  make(chan struct{}, 1),
+				startCluster: func(_ context.Context, name string, kubeconfig []byte) (*remoteCluster, error) {
+					if test.failStart[name] {
+						return nil, errors.New("failed")
+					}
+					started = append(started, name)
+					return newCluster(name, string(kubeconfig)), nil
+				},
+			}
+			for name, kubeconfig := range test.running {
+				r.clusters[name] = newCluster(name, kubeconfig)
+			}
+
+			kubeconfigs := make(map[string][]byte)
+			for name, kubeconfig := range test.kubeconfigs {
+				kubeconfigs[name] = []byte(kubeconfig)
+			}
+
+			r.sync(context.TODO(), kubeconfigs)
+
+			var running []string
+			for name := range r.clusters {
+				running = append(running, name)
+			}
+
+			sort.Strings(started)
+			sort.Strings(stopped)
+			sort.Strings(running)
+
+			if !reflect.DeepEqual(started, test.expStarted) {
+				t.Errorf("unexpected started clusters, exp=%v got=%v", test.expStarted, started)
+			}
+			if !reflect.DeepEqual(stopped, test.expStopped) {
+				t.Errorf("unexpected stopped clusters, exp=%v got=%v", test.expStopped, stopped)
+			}
+			if !reflect.DeepEqual(running, test.expRunning) {
+				t.Errorf("unexpected running clusters, exp=%v got=%v", test.expRunning, running)
+			}
+		})
+	}
+}
+
+func TestRemoteClustersSyncDoesNotBlockNotify(t *testing.T) {
+	building := make(chan struct{})
+	release := make(chan struct{})
+
+	running := &remoteCluster{kubeconfig: []byte("a"), rootCAEvents: make(chan struct{}, 1)}
+	r := &remoteClusters{
+		log:      klogr.New(),
+		clusters: map[string]*remoteCluster{"cluster-1": running},
+		trigger:  make(chan struct{}, 1),
+		startCluster: func(_ context.Context, name string, kubeconfig []byte) (*remoteCluster, error) {
+			close(building)
+			<-release
+			return &remoteCluster{
+				kubeconfig:   kubeconfig,
+				cancel:       func() {},
+				rootCAEvents: make(chan struct{}, 1),
+			}, nil
+		},
+	}
+
+	done := make(chan bool)
+	go func() {
+		done <- r.sync(context.TODO(), map[string][]byte{
+			"cluster-1": []byte("a"),
+			"cluster-2": []byte("b"),
+		})
+	}()
+
+	// Root CA notifications should not be blocked by a slow cluster build
+	<-building
+	notified := make(chan struct{})
+	go func() {
+		r.notify()
+		close(notified)
+	}()
+	select {
+	case <-notified:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected notify to not be blocked by starting clusters")
+	}
+
+	select {
+	case <-running.rootCAEvents:
+	default:
+		t.Error("expected running cluster to be notified")
+	}
+
+	close(release)
+	if !<-done {
+		t.Error("expected sync to report a started cluster")
+	}
+
+	if _, ok := r.clusters["cluster-2"]; !ok {
+		t.Error("expected cluster-2 to be running")
+	}
+}
+
+func TestRemoteClustersCheckHealth(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	probing := make(chan struct{})
+	release := make(chan struct{})
+
+	healthy := &remoteCluster{rootCAEvents: make(chan struct{}, 1)}
+	unhealthy := &remoteCluster{rootCAEvents: make(chan struct{}, 1)}
+
+	r := &remoteClusters{
+		log:         klogr.New(),
+		recorder:    recorder,
+		eventObject: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "istio-csr", Namespace: "cert-manager"}},
+		clusters: map[string]*remoteCluster{
+			"healthy":   healthy,
+			"unhealthy": unhealthy,
+		},
+		probe: func(_ context.Context, cluster *remoteCluster) error {
+			if cluster == unhealthy {
+				close(probing)
+				<-release
+				return errors.New("not ready")
+			}
+			return nil
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		r.checkHealth(context.TODO())
+		close(done)
+	}()
+
+	// Root CA notifications should not be blocked by a slow probe
+	<-probing
+	notified := make(chan struct{})
+	go func() {
+		r.notify()
+		close(notified)
+	}()
+	select {
+	case <-notified:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected notify to not be blocked by health checks")
+	}
+	close(release)
+	<-done
+
+	if !healthy.probed || !healthy.healthy {
+		t.Errorf("expected healthy cluster to be probed healthy")
+	}
+	if !unhealthy.probed || unhealthy.healthy {
+		t.Errorf("expected unhealthy cluster to be probed unhealthy")
+	}
+
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	sort.Strings(events)
+	exp := []string{
+		`Normal RemoteClusterHealthy Remote cluster "healthy" is healthy`,
+		`Warning RemoteClusterUnhealthy Remote cluster "unhealthy" is unhealthy: not ready`,
+	}
+	if !reflect.DeepEqual(events, exp) {
+		t.Errorf("unexpected events, exp=%q got=%q", exp, events)
+	}
+
+	// Unchanged health should not be recorded again
+	r.probe = func(_ context.Context, cluster *remoteCluster) error {
+		if cluster == unhealthy {
+			return errors.New("not ready")
+		}
+		return nil
+	}
+	r.checkHealth(context.TODO())
+	if len(recorder.Events) > 0 {
+		t.Errorf("expected no events for unchanged health, got=%q", <-recorder.Events)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+const (
+	// IstioRevisionLabelKey is the Namespace label selecting the istio
+	// revision of the namespace.
+	IstioRevisionLabelKey = "istio.io/rev"
+)
+
+// revision is the root CA ConfigMap distributed to namespaces of an istio
+// revision.
+type revision struct {
+	// configMapName is the name of the ConfigMap. If empty, the default
+	// ConfigMap name is used.
+	configMapName string
+
+	// rootCA, if set, is the root CA bundle distributed instead of the root CA.
+	// It is read once on start up, so is not rotated, and previous root CAs
+	// are not retained in it.
+	rootCA []byte
+}
+
+// revisions holds the root CA ConfigMap of each configured istio revision.
+type revisions struct {
+	// defaultRevision is the revision of namespaces without the revision label.
+	defaultRevision string
+	revisions       map[string]revision
+}
+
+// newRevisions returns the revisions with the given ConfigMap names and root
+// CAs.
+func newRevisions(defaultRevision string, configMapNames map[string]string, rootCAs map[string][]byte) *revisions {
+	r := &revisions{
+		defaultRevision: defaultRevision,
+		revisions:       make(map[string]revision),
+	}
+
+	for name, configMapName := range configMapNames {
+		rev := r.revisions[name]
+		rev.configMapName = configMapName
+		r.revisions[name] = rev
+	}
+
+	for name, rootCA := range rootCAs {
+		rev := r.revisions[name]
+		rev.rootCA = rootCA
+		r.revisions[name] = rev
+	}
+
+	return r
+}
+
+// requiresLabels returns true if any revision is configured, and so the
+// namespace labels are needed to select its revision. A nil revisions
+// requires no labels.
+func (r *revisions) requiresLabels() bool {
+	return r != nil && len(r.revisions) > 0
+}
+
+// forNamespace returns the revision of the namespace, selected by its
+// revision label, or the default revision if not labelled. If the revision
+// is not configured, an empty revision is returned.
+func (r *revisions) forNamespace(ns metav1.Object) revision {
+	if r == nil {
+		return revision{}
+	}
+
+	name, ok := ns.GetLabels()[IstioRevisionLabelKey]
+	if !ok || len(name) == 0 {
+		name = r.defaultRevision
+	}
+
+	return r.revisions[name]
+}
+
+// configMapNames returns the ConfigMap names of all revisions, including the
+// given default name.
+func (r *revisions) configMapNames(defaultName string) []string {
+	names := sets.NewString(defaultName)
+	if r != nil {
+		for _, rev := range r.revisions {
+			if len(rev.configMapName) > 0 {
+				names.Insert(rev.configMapName)
+			}
+		}
+	}
+	return names.List()
+}
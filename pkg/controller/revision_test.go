@@ -0,0 +1,159 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+func TestRevisionsForNamespace(t *testing.T) {
+	revs := newRevisions("stable",
+		map[string]string{"canary": "canary-root-cert", "stable": "stable-root-cert"},
+		map[string][]byte{"canary": []byte("canary-root")},
+	)
+
+	tests := map[string]struct {
+		revisions   *revisions
+		labels      map[string]string
+		expRevision revision
+	}{
+		"if no revisions are configured, should return an empty revision": {
+			revisions:   nil,
+			labels:      map[string]string{IstioRevisionLabelKey: "canary"},
+			expRevision: revision{},
+		},
+		"if namespace is labelled with a configured revision, should return that revision": {
+			revisions:   revs,
+			labels:      map[string]string{IstioRevisionLabelKey: "canary"},
+			expRevision: revision{configMapName: "canary-root-cert", rootCA: []byte("canary-root")},
+		},
+		"if namespace is not labelled, should return the default revision": {
+			revisions:   revs,
+			labels:      nil,
+			expRevision: revision{configMapName: "stable-root-cert"},
+		},
+		"if namespace is labelled with an unknown revision, should return an empty revision": {
+			revisions:   revs,
+			labels:      map[string]string{IstioRevisionLabelKey: "other"},
+			expRevision: revision{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns", Labels: test.labels}}
+			if rev := test.revisions.forNamespace(ns); !reflect.DeepEqual(rev, test.expRevision) {
+				t.Errorf("unexpected revision, exp=%+v got=%+v", test.expRevision, rev)
+			}
+		})
+	}
+}
+
+func TestEnforcerConfigMapRevision(t *testing.T) {
+	defaultConfigMap := gen.ConfigMapFrom(baseConfigMap,
+		gen.SetConfigMapLabels(map[string]string{
+			IstioConfigLabelKey:    "true",
+			util.ManagedByLabelKey: util.ManagedByLabelValue,
+		}),
+		gen.SetConfigMapData(map[string]string{RootCertKey: "root"}),
+	)
+
+	tests := map[string]struct {
+		revisionLabel    string
+		removeUnselected bool
+
+		expConfigMapName    string
+		expData             map[string]string
+		expDefaultConfigMap bool
+	}{
+		"if namespace is not labelled, should keep the default ConfigMap": {
+			revisionLabel:       "",
+			removeUnselected:    true,
+			expConfigMapName:    testNamespacedName.Name,
+			expData:             map[string]string{RootCertKey: "root"},
+			expDefaultConfigMap: true,
+		},
+		"if namespace is labelled with a revision, should write the revision's ConfigMap and keep the default": {
+			revisionLabel:       "canary",
+			removeUnselected:    false,
+			expConfigMapName:    "canary-root-cert",
+			expData:             map[string]string{RootCertKey: "canary-root"},
+			expDefaultConfigMap: true,
+		},
+		"if namespace is labelled with a revision and removal enabled, should remove the default ConfigMap": {
+			revisionLabel:       "canary",
+			removeUnselected:    true,
+			expConfigMapName:    "canary-root-cert",
+			expData:             map[string]string{RootCertKey: "canary-root"},
+			expDefaultConfigMap: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespacedName.Namespace}}
+			if len(test.revisionLabel) > 0 {
+				ns.Labels = map[string]string{IstioRevisionLabelKey: test.revisionLabel}
+			}
+
+			client := buildClient(t, &testCase{existingConfigMap: defaultConfigMap, existingNamespace: ns})
+			enforcer := &enforcer{
+				client:           client,
+				data:             map[string]string{RootCertKey: "root"},
+				configMapName:    testNamespacedName.Name,
+				removeUnselected: test.removeUnselected,
+				revisions: newRevisions("default",
+					map[string]string{"canary": "canary-root-cert"},
+					map[string][]byte{"canary": []byte("canary-root")},
+				),
+			}
+
+			if err := enforcer.configmap(context.TODO(), klogr.New(), testNamespacedName.Namespace); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			cm := new(corev1.ConfigMap)
+			if err := client.Get(context.TODO(), types.NamespacedName{
+				Namespace: testNamespacedName.Namespace,
+				Name:      test.expConfigMapName,
+			}, cm); err != nil {
+				t.Fatalf("failed to get expected ConfigMap: %s", err)
+			}
+
+			if !reflect.DeepEqual(cm.Data, test.expData) {
+				t.Errorf("unexpected data, exp=%v got=%v", test.expData, cm.Data)
+			}
+
+			err := client.Get(context.TODO(), testNamespacedName, new(corev1.ConfigMap))
+			if exists := !apierrors.IsNotFound(err); exists != test.expDefaultConfigMap {
+				t.Errorf("unexpected default ConfigMap existence, exp=%t got=%t (%v)",
+					test.expDefaultConfigMap, exists, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+const (
+	// RootCertKey is the key of the root CA bundle in the distributed
+	// ConfigMaps.
+	RootCertKey = "root-cert.pem"
+)
+
+// RootCAs provides the root CA bundle which is distributed to every namespace,
+// and notifies of changes to it.
+type RootCAs interface {
+	RootCA() []byte
+	SubscribeRootCAEvents() <-chan struct{}
+}
+
+// rootCAWatcher watches for changes to the root CA. When it changes, the
+// enforced ConfigMap data is updated and every namespace is requeued.
+type rootCAWatcher struct {
+	log      logr.Logger
+	client   client.Client
+	recorder record.EventRecorder
+
+	// eventObject is the object root CA change events are recorded against.
+	// If nil, no events are recorded.
+	eventObject runtime.Object
+
+	rootCAs       RootCAs
+	rootCAEvents  <-chan struct{}
+	enforcer      *enforcer
+	requeueEvents chan<- event.GenericEvent
+
+	// namespaces, if set, are the namespaces to requeue, rather than listing
+	// all namespaces.
+	namespaces []string
+
+	// remotes, if set, are notified of root CA changes.
+	remotes *remoteClusters
+}
+
+// rootCAData returns the ConfigMap data for the given root CA bundle.
+func rootCAData(rootCA []byte) map[string]string {
+	return map[string]string{
+		RootCertKey: string(rootCA),
+	}
+}
+
+// Start will handle root CA change events until the context is cancelled.
+func (w *rootCAWatcher) Start(ctx context.Context) error {
+	// With a static set of namespaces, there is no namespace watch to trigger
+	// the initial reconcile, so requeue them all
+	if len(w.namespaces) > 0 {
+		w.requeueAll(ctx)
+	}
+
+	// Ensure no change has been missed before starting
+	w.handle(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.rootCAEvents:
+			w.handle(ctx)
+		}
+	}
+}
+
+// handle will update the enforced data and requeue all namespaces if the root
+// CA has changed. Remote clusters are notified to do the same.
+func (w *rootCAWatcher) handle(ctx context.Context) {
+	w.remotes.notify()
+
+	newRootCA := w.rootCAs.RootCA()
+	oldRootCA := w.enforcer.getData()[RootCertKey]
+	if oldRootCA == string(newRootCA) {
+		return
+	}
+
+	oldFingerprints := util.CertificateFingerprints([]byte(oldRootCA))
+	newFingerprints := util.CertificateFingerprints(newRootCA)
+
+	w.log.Info("root CA changed, updating all namespaces",
+		"old-fingerprints", oldFingerprints, "new-fingerprints", newFingerprints)
+
+	if w.eventObject != nil {
+		w.recorder.Eventf(w.eventObject, corev1.EventTypeNormal, "RootCAChanged",
+			"Root CA changed from [%s] to [%s]", oldFingerprints, newFingerprints)
+	}
+
+	w.enforcer.setData(rootCAData(newRootCA))
+
+	w.requeueAll(ctx)
+}
+
+// requeueAll sends a requeue event for every namespace.
+func (w *rootCAWatcher) requeueAll(ctx context.Context) {
+	// Only Namespace metadata is cached
+	namespaces := new(metav1.PartialObjectMetadataList)
+	namespaces.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("NamespaceList"))
+
+	if len(w.namespaces) > 0 {
+		for _, name := range w.namespaces {
+			namespaces.Items = append(namespaces.Items, metav1.PartialObjectMetadata{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+			})
+		}
+	} else if err := w.client.List(ctx, namespaces); err != nil {
+		w.log.Error(err, "failed to list namespaces to requeue")
+		return
+	}
+
+	for i := range namespaces.Items {
+		select {
+		case <-ctx.Done():
+			return
+		case w.requeueEvents <- event.GenericEvent{Object: &namespaces.Items[i]}:
+		}
+	}
+}
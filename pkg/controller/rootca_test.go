@@ -0,0 +1,125 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/klogr"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+type fakeRootCAs struct {
+	rootCA []byte
+}
+
+func (f *fakeRootCAs) RootCA() []byte {
+	return f.rootCA
+}
+
+func (f *fakeRootCAs) SubscribeRootCAEvents() <-chan struct{} {
+	return make(chan struct{})
+}
+
+func TestRootCAWatcherHandle(t *testing.T) {
+	tests := map[string]struct {
+		oldRootCA  string
+		newRootCA  string
+		namespaces []string
+
+		expData       map[string]string
+		expRequeued   []string
+		expEventCount int
+	}{
+		"if root CA has not changed, no namespaces should be requeued": {
+			oldRootCA:     "root-a",
+			newRootCA:     "root-a",
+			expData:       map[string]string{RootCertKey: "root-a"},
+			expRequeued:   nil,
+			expEventCount: 0,
+		},
+		"if root CA has changed, data should be updated and all namespaces requeued": {
+			oldRootCA:     "root-a",
+			newRootCA:     "root-b",
+			expData:       map[string]string{RootCertKey: "root-b"},
+			expRequeued:   []string{"ns-1", "ns-2"},
+			expEventCount: 1,
+		},
+		"if root CA has changed with static namespaces, only those namespaces should be requeued": {
+			oldRootCA:     "root-a",
+			newRootCA:     "root-b",
+			namespaces:    []string{"ns-2", "ns-3"},
+			expData:       map[string]string{RootCertKey: "root-b"},
+			expRequeued:   []string{"ns-2", "ns-3"},
+			expEventCount: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := fakeclient.NewClientBuilder().
+				WithObjects(
+					&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns-1"}},
+					&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ns-2"}},
+				).
+				Build()
+
+			recorder := record.NewFakeRecorder(10)
+			requeueEvents := make(chan event.GenericEvent, 10)
+			enforcer := &enforcer{client: client, data: rootCAData([]byte(test.oldRootCA))}
+
+			w := &rootCAWatcher{
+				log:           klogr.New(),
+				client:        client,
+				recorder:      recorder,
+				eventObject:   &corev1.ObjectReference{Kind: "Pod", Name: "istio-csr", Namespace: "cert-manager"},
+				rootCAs:       &fakeRootCAs{rootCA: []byte(test.newRootCA)},
+				enforcer:      enforcer,
+				requeueEvents: requeueEvents,
+				namespaces:    test.namespaces,
+			}
+
+			w.handle(context.TODO())
+			close(requeueEvents)
+
+			if data := enforcer.getData(); !reflect.DeepEqual(data, test.expData) {
+				t.Errorf("unexpected enforcer data, exp=%v got=%v", test.expData, data)
+			}
+
+			var requeued []string
+			for ev := range requeueEvents {
+				requeued = append(requeued, ev.Object.GetName())
+			}
+			sort.Strings(requeued)
+
+			if !reflect.DeepEqual(requeued, test.expRequeued) {
+				t.Errorf("unexpected requeued namespaces, exp=%v got=%v", test.expRequeued, requeued)
+			}
+
+			if len(recorder.Events) != test.expEventCount {
+				t.Errorf("unexpected number of events, exp=%d got=%d", test.expEventCount, len(recorder.Events))
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// namespaceSelector selects the namespaces that the root CA ConfigMap is
+// distributed to. A nil namespaceSelector selects all namespaces.
+type namespaceSelector struct {
+	labels  labels.Selector
+	include sets.String
+	exclude sets.String
+}
+
+// newNamespaceSelector returns a namespaceSelector which selects namespaces
+// matching the label selector, which are in the include list if not empty,
+// and are not in the exclude list.
+func newNamespaceSelector(selector labels.Selector, include, exclude []string) *namespaceSelector {
+	if selector == nil {
+		selector = labels.Everything()
+	}
+
+	return &namespaceSelector{
+		labels:  selector,
+		include: sets.NewString(include...),
+		exclude: sets.NewString(exclude...),
+	}
+}
+
+// matchesName returns true if the namespace with the given name is selected
+// by the include and exclude lists.
+func (s *namespaceSelector) matchesName(name string) bool {
+	if s == nil {
+		return true
+	}
+
+	if s.exclude.Has(name) {
+		return false
+	}
+
+	return s.include.Len() == 0 || s.include.Has(name)
+}
+
+// requiresLabels returns true if the namespace's labels are needed to
+// determine whether it is selected.
+func (s *namespaceSelector) requiresLabels() bool {
+	return s != nil && !s.labels.Empty()
+}
+
+// matches returns true if the namespace is selected.
+func (s *namespaceSelector) matches(ns metav1.Object) bool {
+	if !s.matchesName(ns.GetName()) {
+		return false
+	}
+
+	return !s.requiresLabels() || s.labels.Matches(labels.Set(ns.GetLabels()))
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2/klogr"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+func TestNamespaceSelectorMatches(t *testing.T) {
+	meshSelector := labels.SelectorFromSet(labels.Set{"mesh": "true"})
+
+	tests := map[string]struct {
+		selector  *namespaceSelector
+		namespace *corev1.Namespace
+		expMatch  bool
+	}{
+		"if selector is nil, should match": {
+			selector:  nil,
+			namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+			expMatch:  true,
+		},
+		"if selector is empty, should match": {
+			selector:  newNamespaceSelector(nil, nil, nil),
+			namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+			expMatch:  true,
+		},
+		"if namespace is excluded, should not match": {
+			selector:  newNamespaceSelector(nil, nil, []string{"kube-system"}),
+			namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system"}},
+			expMatch:  false,
+		},
+		"if namespace is not in include list, should not match": {
+			selector:  newNamespaceSelector(nil, []string{"bar"}, nil),
+			namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+			expMatch:  false,
+		},
+		"if namespace is in both include and exclude list, should not match": {
+			selector:  newNamespaceSelector(nil, []string{"foo"}, []string{"foo"}),
+			namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+			expMatch:  false,
+		},
+		"if namespace does not match label selector, should not match": {
+			selector:  newNamespaceSelector(meshSelector, nil, nil),
+			namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+			expMatch:  false,
+		},
+		"if namespace is included and matches label selector, should match": {
+			selector: newNamespaceSelector(meshSelector, []string{"foo"}, nil),
+			namespace: &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name: "foo", Labels: map[string]string{"mesh": "true"},
+			}},
+			expMatch: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if match := test.selector.matches(test.namespace); match != test.expMatch {
+				t.Errorf("unexpected match, exp=%t got=%t", test.expMatch, match)
+			}
+		})
+	}
+}
+
+func TestReconcileUnselectedNamespace(t *testing.T) {
+	istioCSRConfigMap := gen.ConfigMapFrom(baseConfigMap,
+		gen.SetConfigMapLabels(map[string]string{
+			IstioConfigLabelKey:    "true",
+			util.ManagedByLabelKey: util.ManagedByLabelValue,
+		}),
+		gen.SetConfigMapData(map[string]string{"foo": "bar"}),
+	)
+	otherConfigMap := gen.ConfigMapFrom(baseConfigMap,
+		gen.SetConfigMapLabels(map[string]string{IstioConfigLabelKey: "true"}),
+		gen.SetConfigMapData(map[string]string{"foo": "bar"}),
+	)
+
+	tests := map[string]struct {
+		existingConfigMap *corev1.ConfigMap
+		removeUnselected  bool
+		expExists         bool
+	}{
+		"if removal disabled, should leave the ConfigMap": {
+			existingConfigMap: istioCSRConfigMap,
+			removeUnselected:  false,
+			expExists:         true,
+		},
+		"if removal enabled, should remove the ConfigMap": {
+			existingConfigMap: istioCSRConfigMap,
+			removeUnselected:  true,
+			expExists:         false,
+		},
+		"if removal enabled but ConfigMap is not managed by istio-csr, should leave the ConfigMap": {
+			existingConfigMap: otherConfigMap,
+			removeUnselected:  true,
+			expExists:         true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := buildClient(t, &testCase{
+				existingConfigMap: test.existingConfigMap,
+				existingNamespace: &corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{Name: testNamespacedName.Namespace},
+					Status:     corev1.NamespaceStatus{Phase: corev1.NamespaceActive},
+				},
+			})
+
+			enforcer := &enforcer{
+				client:           client,
+				data:             map[string]string{"foo": "bar"},
+				configMapName:    testNamespacedName.Name,
+				selector:         newNamespaceSelector(nil, nil, []string{testNamespacedName.Namespace}),
+				removeUnselected: test.removeUnselected,
+			}
+
+			ns := &namespace{log: klogr.New(), client: client, enforcer: enforcer}
+			if _, err := ns.Reconcile(context.TODO(), ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: testNamespacedName.Namespace},
+			}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			cm := &configmap{log: klogr.New(), client: client, enforcer: enforcer}
+			if _, err := cm.Reconcile(context.TODO(), ctrl.Request{NamespacedName: testNamespacedName}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			err := client.Get(context.TODO(), testNamespacedName, new(corev1.ConfigMap))
+			if exists := !apierrors.IsNotFound(err); exists != test.expExists {
+				t.Errorf("unexpected ConfigMap existence, exp=%t got=%t (%v)", test.expExists, exists, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-logr/logr"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+// webhookSelector selects the webhook configurations whose caBundle is kept
+// equal to the root CA, by label or name.
+type webhookSelector struct {
+	labels labels.Selector
+	names  sets.String
+}
+
+// matches returns true if the webhook configuration is selected.
+func (s *webhookSelector) matches(obj client.Object) bool {
+	if s.names.Has(obj.GetName()) {
+		return true
+	}
+	return s.labels != nil && !s.labels.Empty() && s.labels.Matches(labels.Set(obj.GetLabels()))
+}
+
+// webhookCABundle keeps the caBundle of every webhook of the selected webhook
+// configurations equal to the root CA.
+type webhookCABundle struct {
+	log      logr.Logger
+	client   client.Client
+	recorder record.EventRecorder
+	rootCAs  RootCAs
+	selector *webhookSelector
+
+	// newObject returns a new webhook configuration of the reconciled kind.
+	newObject func() client.Object
+}
+
+// addWebhookCABundleControllers adds controllers to the manager which keep
+// the caBundle of the selected Mutating and Validating webhook configurations
+// equal to the root CA.
+func addWebhookCABundleControllers(mgr manager.Manager, log logr.Logger, recorder record.EventRecorder,
+	rootCAs RootCAs, selector *webhookSelector) error {
+	log = log.WithName("webhook-ca-bundle")
+
+	mutating := make(chan event.GenericEvent)
+	validating := make(chan event.GenericEvent)
+
+	for _, c := range []struct {
+		kind          string
+		newObject     func() client.Object
+		requeueEvents chan event.GenericEvent
+	}{
+		{
+			kind:          "MutatingWebhookConfiguration",
+			newObject:     func() client.Object { return new(admissionregistrationv1.MutatingWebhookConfiguration) },
+			requeueEvents: mutating,
+		},
+		{
+			kind:          "ValidatingWebhookConfiguration",
+			newObject:     func() client.Object { return new(admissionregistrationv1.ValidatingWebhookConfiguration) },
+			requeueEvents: validating,
+		},
+	} {
+		reconciler := &webhookCABundle{
+			log:       log.WithValues("kind", c.kind),
+			client:    mgr.GetClient(),
+			recorder:  recorder,
+			rootCAs:   rootCAs,
+			selector:  selector,
+			newObject: c.newObject,
+		}
+
+		if err := ctrl.NewControllerManagedBy(mgr).
+			Named(strings.ToLower(c.kind)).
+			For(c.newObject()).
+			Watches(&source.Channel{Source: c.requeueEvents}, new(handler.EnqueueRequestForObject)).
+			WithEventFilter(predicate.NewPredicateFuncs(selector.matches)).
+			Complete(reconciler); err != nil {
+			return fmt.Errorf("failed to create %s controller: %s", c.kind, err)
+		}
+	}
+
+	return mgr.Add(&webhookRequeuer{
+		log:          log,
+		client:       mgr.GetClient(),
+		rootCAEvents: rootCAs.SubscribeRootCAEvents(),
+		mutating:     mutating,
+		validating:   validating,
+	})
+}
+
+// Reconcile is called when a webhook configuration event occurs. Reconcile
+// will ensure the caBundle of every webhook is equal to the root CA, recording
+// an event if it is changed.
+func (w *webhookCABundle) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := w.log.WithValues("name", req.Name)
+
+	obj := w.newObject()
+	err := w.client.Get(ctx, req.NamespacedName, obj)
+	if apierrors.IsNotFound(err) {
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get %q: %s", req.Name, err)
+	}
+
+	if !w.selector.matches(obj) {
+		return ctrl.Result{}, nil
+	}
+
+	rootCA := w.rootCAs.RootCA()
+	patch := client.MergeFromWithOptions(obj.DeepCopyObject(), client.MergeFromWithOptimisticLock{})
+
+	updated := setWebhookCABundles(obj, rootCA)
+	if len(updated) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	log.Info("updating webhook caBundle to root CA", "webhooks", updated)
+	if err := w.client.Patch(ctx, obj, patch); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to patch %q: %s", req.Name, err)
+	}
+
+	w.recorder.Eventf(obj, corev1.EventTypeNormal, "CABundleUpdated",
+		"Updated caBundle of webhooks %v to root CA [%s]", updated, util.CertificateFingerprints(rootCA))
+
+	return ctrl.Result{}, nil
+}
+
+// setWebhookCABundles sets the caBundle of every webhook of the webhook
+// configuration to the root CA, returning the names of the webhooks which
+// were changed.
+func setWebhookCABundles(obj client.Object, rootCA []byte) []string {
+	var updated []string
+	set := func(name string, clientConfig *admissionregistrationv1.WebhookClientConfig) {
+		if !bytes.Equal(clientConfig.CABundle, rootCA) {
+			clientConfig.CABundle = rootCA
+			updated = append(updated, name)
+		}
+	}
+
+	switch obj := obj.(type) {
+	case *admissionregistrationv1.MutatingWebhookConfiguration:
+		for i := range obj.Webhooks {
+			set(obj.Webhooks[i].Name, &obj.Webhooks[i].ClientConfig)
+		}
+	case *admissionregistrationv1.ValidatingWebhookConfiguration:
+		for i := range obj.Webhooks {
+			set(obj.Webhooks[i].Name, &obj.Webhooks[i].ClientConfig)
+		}
+	}
+
+	return updated
+}
+
+// webhookRequeuer requeues every webhook configuration when the root CA
+// changes.
+type webhookRequeuer struct {
+	log          logr.Logger
+	client       client.Client
+	rootCAEvents <-chan struct{}
+
+	mutating, validating chan<- event.GenericEvent
+}
+
+// Start will requeue every webhook configuration on root CA change events,
+// until the context is cancelled.
+func (w *webhookRequeuer) Start(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-w.rootCAEvents:
+			w.requeueAll(ctx)
+		}
+	}
+}
+
+// requeueAll sends a requeue event for every webhook configuration.
+func (w *webhookRequeuer) requeueAll(ctx context.Context) {
+	var objects []client.Object
+
+	mutating := new(admissionregistrationv1.MutatingWebhookConfigurationList)
+	if err := w.client.List(ctx, mutating); err != nil {
+		w.log.Error(err, "failed to list mutating webhook configurations to requeue")
+	}
+	for i := range mutating.Items {
+		objects = append(objects, &mutating.Items[i])
+	}
+
+	validating := new(admissionregistrationv1.ValidatingWebhookConfigurationList)
+	if err := w.client.List(ctx, validating); err != nil {
+		w.log.Error(err, "failed to list validating webhook configurations to requeue")
+	}
+	for i := range validating.Items {
+		objects = append(objects, &validating.Items[i])
+	}
+
+	for _, obj := range objects {
+		requeueEvents := w.mutating
+		if _, ok := obj.(*admissionregistrationv1.ValidatingWebhookConfiguration); ok {
+			requeueEvents = w.validating
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case requeueEvents <- event.GenericEvent{Object: obj}:
+		}
+	}
+}
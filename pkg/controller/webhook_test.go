@@ -0,0 +1,150 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/klogr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestWebhookCABundleReconcile(t *testing.T) {
+	selector := &webhookSelector{
+		labels: labels.SelectorFromSet(labels.Set{"app": "sidecar-injector"}),
+		names:  sets.NewString("istiod-istio-system"),
+	}
+
+	mutating := func(name string, labels map[string]string, caBundles ...string) *admissionregistrationv1.MutatingWebhookConfiguration {
+		obj := &admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		}
+		for i, caBundle := range caBundles {
+			obj.Webhooks = append(obj.Webhooks, admissionregistrationv1.MutatingWebhook{
+				Name:         string(rune('a'+i)) + ".sidecar-injector.istio.io",
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte(caBundle)},
+			})
+		}
+		return obj
+	}
+
+	validating := func(name string, caBundles ...string) *admissionregistrationv1.ValidatingWebhookConfiguration {
+		obj := &admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+		}
+		for i, caBundle := range caBundles {
+			obj.Webhooks = append(obj.Webhooks, admissionregistrationv1.ValidatingWebhook{
+				Name:         string(rune('a'+i)) + ".validation.istio.io",
+				ClientConfig: admissionregistrationv1.WebhookClientConfig{CABundle: []byte(caBundle)},
+			})
+		}
+		return obj
+	}
+
+	tests := map[string]struct {
+		existing    client.Object
+		expCABundle []string
+		expEvents   int
+	}{
+		"if mutating webhook is selected by label with a stale caBundle, should update all webhooks": {
+			existing:    mutating("istio-sidecar-injector", map[string]string{"app": "sidecar-injector"}, "old-root", "root"),
+			expCABundle: []string{"root", "root"},
+			expEvents:   1,
+		},
+		"if mutating webhook is selected with the root caBundle, should not update": {
+			existing:    mutating("istio-sidecar-injector", map[string]string{"app": "sidecar-injector"}, "root"),
+			expCABundle: []string{"root"},
+			expEvents:   0,
+		},
+		"if mutating webhook is not selected, should not update": {
+			existing:    mutating("other", map[string]string{"app": "other"}, "old-root"),
+			expCABundle: []string{"old-root"},
+			expEvents:   0,
+		},
+		"if validating webhook is selected by name with a stale caBundle, should update": {
+			existing:    validating("istiod-istio-system", ""),
+			expCABundle: []string{"root"},
+			expEvents:   1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			fakeClient := fakeclient.NewClientBuilder().WithObjects(test.existing).Build()
+			recorder := record.NewFakeRecorder(10)
+
+			newObject := func() client.Object { return new(admissionregistrationv1.MutatingWebhookConfiguration) }
+			if _, ok := test.existing.(*admissionregistrationv1.ValidatingWebhookConfiguration); ok {
+				newObject = func() client.Object { return new(admissionregistrationv1.ValidatingWebhookConfiguration) }
+			}
+
+			w := &webhookCABundle{
+				log:       klogr.New(),
+				client:    fakeClient,
+				recorder:  recorder,
+				rootCAs:   &fakeRootCAs{rootCA: []byte("root")},
+				selector:  selector,
+				newObject: newObject,
+			}
+
+			if _, err := w.Reconcile(context.TODO(), ctrl.Request{
+				NamespacedName: types.NamespacedName{Name: test.existing.GetName()},
+			}); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			obj := newObject()
+			if err := fakeClient.Get(context.TODO(), types.NamespacedName{Name: test.existing.GetName()}, obj); err != nil {
+				t.Fatal(err)
+			}
+
+			var caBundles []string
+			switch obj := obj.(type) {
+			case *admissionregistrationv1.MutatingWebhookConfiguration:
+				for _, webhook := range obj.Webhooks {
+					caBundles = append(caBundles, string(webhook.ClientConfig.CABundle))
+				}
+			case *admissionregistrationv1.ValidatingWebhookConfiguration:
+				for _, webhook := range obj.Webhooks {
+					caBundles = append(caBundles, string(webhook.ClientConfig.CABundle))
+				}
+			}
+
+			if len(caBundles) != len(test.expCABundle) {
+				t.Fatalf("unexpected number of webhooks, exp=%d got=%d", len(test.expCABundle), len(caBundles))
+			}
+			for i := range caBundles {
+				if caBundles[i] != test.expCABundle[i] {
+					t.Errorf("unexpected caBundle of webhook %d, exp=%q got=%q", i, test.expCABundle[i], caBundles[i])
+				}
+			}
+
+			if len(recorder.Events) != test.expEvents {
+				t.Errorf("unexpected number of events, exp=%d got=%d", test.expEvents, len(recorder.Events))
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admission
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	pkiutil "istio.io/istio/security/pkg/pki/util"
+	admissionv1 "k8s.io/api/admission/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/cert-manager/istio-csr/pkg/server/internal/extensions"
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+const (
+	// Path is the path the CertificateRequest validating webhook is served on.
+	Path = "/validate-certificaterequest"
+)
+
+// CertificateRequest is a validating admission webhook which protects the
+// configured issuer from CertificateRequests not created by istio-csr.
+// CertificateRequests referencing the issuer are only admitted if created by
+// istio-csr itself, by an allowed user whose request passes the same CSR
+// checks made by istio-csr, or by a trusted user whose request is a valid
+// non-CA CSR, such as cert-manager requesting istiod's serving certificate.
+type CertificateRequest struct {
+	log logr.Logger
+
+	issuerRef cmmeta.ObjectReference
+	namespace string
+	username  string
+	allowed   map[string]struct{}
+	trusted   map[string]struct{}
+}
+
+// New returns a new CertificateRequest admission webhook. username is the
+// Kubernetes username of istio-csr, allowedUsernames are other users that may
+// create workload CertificateRequests for the issuer, and trustedUsernames are
+// users that may create any non-CA CertificateRequest for the issuer.
+func New(log logr.Logger, issuerRef cmmeta.ObjectReference, namespace, username string,
+	allowedUsernames, trustedUsernames []string) *CertificateRequest {
+	allowed := make(map[string]struct{})
+	for _, username := range allowedUsernames {
+		allowed[username] = struct{}{}
+	}
+
+	trusted := make(map[string]struct{})
+	for _, username := range trustedUsernames {
+		trusted[username] = struct{}{}
+	}
+
+	return &CertificateRequest{
+		log:       log.WithName("admission"),
+		issuerRef: issuerRef,
+		namespace: namespace,
+		username:  username,
+		allowed:   allowed,
+		trusted:   trusted,
+	}
+}
+
+// Handle validates CertificateRequest create requests.
+func (c *CertificateRequest) Handle(_ context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1.Create {
+		return admission.Allowed("")
+	}
+
+	cr := new(cmapi.CertificateRequest)
+	if err := json.Unmarshal(req.Object.Raw, cr); err != nil {
+		return admission.Errored(http.StatusBadRequest, fmt.Errorf("failed to decode CertificateRequest: %s", err))
+	}
+
+	// Namespaced issuers can only be referenced from their own namespace
+	if !util.IssuerRefEqual(cr.Spec.IssuerRef, c.issuerRef) ||
+		((len(cr.Spec.IssuerRef.Kind) == 0 || cr.Spec.IssuerRef.Kind == "Issuer") && req.Namespace != c.namespace) {
+		return admission.Allowed("")
+	}
+
+	log := c.log.WithValues("namespace", req.Namespace, "name", cr.Name, "username", req.UserInfo.Username)
+
+	// istio-csr validates its own requests before creating them
+	if req.UserInfo.Username == c.username {
+		return admission.Allowed("")
+	}
+
+	// Trusted users, such as cert-manager issuing istiod's serving certificate,
+	// request certificates with DNS names rather than workload identities
+	if _, ok := c.trusted[req.UserInfo.Username]; ok {
+		if err := validateTrustedCertificateRequest(cr); err != nil {
+			log.Info("denying invalid CertificateRequest from trusted user", "error", err.Error())
+			return admission.Denied(err.Error())
+		}
+		return admission.Allowed("")
+	}
+
+	if _, ok := c.allowed[req.UserInfo.Username]; !ok {
+		log.Info("denying CertificateRequest from user not allowed to use the istio issuer")
+		return admission.Denied(fmt.Sprintf("user %q is not allowed to create CertificateRequests for issuer %q",
+			req.UserInfo.Username, c.issuerRef.Name))
+	}
+
+	if err := validateCertificateRequest(cr); err != nil {
+		log.Info("denying invalid CertificateRequest", "error", err.Error())
+		return admission.Denied(err.Error())
+	}
+
+	return admission.Allowed("")
+}
+
+// validateTrustedCertificateRequest checks that the given CertificateRequest
+// from a trusted user is a validly signed CSR which doesn't request a CA
+// certificate. Its subject and SANs are not restricted.
+func validateTrustedCertificateRequest(cr *cmapi.CertificateRequest) error {
+	_, err := parseCertificateRequest(cr)
+	return err
+}
+
+// validateCertificateRequest runs the same checks over the CSR of the given
+// CertificateRequest as istio-csr does over incoming requests.
+func validateCertificateRequest(cr *cmapi.CertificateRequest) error {
+	csr, err := parseCertificateRequest(cr)
+	if err != nil {
+		return err
+	}
+
+	if err := extensions.ValidateCSRSubject(csr); err != nil {
+		return err
+	}
+
+	if len(csr.URIs) == 0 {
+		return errors.New("CSR must contain at least one URI SAN")
+	}
+
+	return extensions.ValidateCSRExtentions(csr)
+}
+
+// parseCertificateRequest returns the signature checked CSR of the given
+// CertificateRequest, which must not request a CA certificate.
+func parseCertificateRequest(cr *cmapi.CertificateRequest) (*x509.CertificateRequest, error) {
+	if cr.Spec.IsCA {
+		return nil, errors.New("CertificateRequest must not request a CA certificate")
+	}
+
+	csr, err := pkiutil.ParsePemEncodedCSR(cr.Spec.Request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode CSR: %s", err)
+	}
+
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("CSR failed signature check: %s", err)
+	}
+
+	return csr, nil
+}
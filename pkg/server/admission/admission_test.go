@@ -0,0 +1,168 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	cmapi "github.com/jetstack/cert-manager/pkg/apis/certmanager/v1"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2/klogr"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+const (
+	istioCSRUsername = "system:serviceaccount:cert-manager:cert-manager-istio-csr"
+	allowedUsername  = "system:serviceaccount:istio-system:istiod"
+	trustedUsername  = "system:serviceaccount:cert-manager:cert-manager"
+)
+
+func TestHandle(t *testing.T) {
+	issuerRef := cmmeta.ObjectReference{
+		Name:  "istio-ca",
+		Kind:  "Issuer",
+		Group: "cert-manager.io",
+	}
+
+	validCSR := gen.MustCSR(t, gen.SetCSRIdentities([]string{"spiffe://cluster.local/ns/foo/sa/bar"}))
+
+	tests := map[string]struct {
+		username  string
+		namespace string
+		issuerRef cmmeta.ObjectReference
+		csr       []byte
+		isCA      bool
+		expAllow  bool
+	}{
+		"if CertificateRequest references another issuer, allow": {
+			username:  "foo",
+			namespace: "istio-system",
+			issuerRef: cmmeta.ObjectReference{Name: "other-ca"},
+			csr:       validCSR,
+			expAllow:  true,
+		},
+		"if CertificateRequest references issuer from another namespace, allow": {
+			username:  "foo",
+			namespace: "other-ns",
+			issuerRef: issuerRef,
+			csr:       validCSR,
+			expAllow:  true,
+		},
+		"if CertificateRequest created by istio-csr, allow": {
+			username:  istioCSRUsername,
+			namespace: "istio-system",
+			issuerRef: issuerRef,
+			csr:       gen.MustCSR(t, gen.SetCSRDNS([]string{"cert-manager-istio-csr.cert-manager.svc"})),
+			expAllow:  true,
+		},
+		"if CertificateRequest created by unknown user, deny": {
+			username:  "foo",
+			namespace: "istio-system",
+			issuerRef: issuerRef,
+			csr:       validCSR,
+			expAllow:  false,
+		},
+		"if CertificateRequest created by allowed user with valid CSR, allow": {
+			username:  allowedUsername,
+			namespace: "istio-system",
+			issuerRef: issuerRef,
+			csr:       validCSR,
+			expAllow:  true,
+		},
+		"if CertificateRequest created by allowed user with DNS names, deny": {
+			username:  allowedUsername,
+			namespace: "istio-system",
+			issuerRef: issuerRef,
+			csr: gen.MustCSR(t,
+				gen.SetCSRIdentities([]string{"spiffe://cluster.local/ns/foo/sa/bar"}),
+				gen.SetCSRDNS([]string{"example.com"}),
+			),
+			expAllow: false,
+		},
+		"if CertificateRequest created by allowed user with no identities, deny": {
+			username:  allowedUsername,
+			namespace: "istio-system",
+			issuerRef: issuerRef,
+			csr:       gen.MustCSR(t),
+			expAllow:  false,
+		},
+		"if CertificateRequest created by trusted user for the chart's istiod Certificate, allow": {
+			username:  trustedUsername,
+			namespace: "istio-system",
+			issuerRef: issuerRef,
+			csr: gen.MustCSR(t,
+				gen.SetCSRIdentities([]string{"spiffe://cluster.local/ns/istio-system/sa/istiod-service-account"}),
+				gen.SetCSRDNS([]string{"istiod.istio-system.svc"}),
+			),
+			expAllow: true,
+		},
+		"if CertificateRequest created by trusted user with DNS names only, allow": {
+			username:  trustedUsername,
+			namespace: "istio-system",
+			issuerRef: issuerRef,
+			csr:       gen.MustCSR(t, gen.SetCSRDNS([]string{"istiod.istio-system.svc"})),
+			expAllow:  true,
+		},
+		"if CertificateRequest created by trusted user requests a CA, deny": {
+			username:  trustedUsername,
+			namespace: "istio-system",
+			issuerRef: issuerRef,
+			csr:       gen.MustCSR(t, gen.SetCSRDNS([]string{"istiod.istio-system.svc"})),
+			isCA:      true,
+			expAllow:  false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cr := &cmapi.CertificateRequest{
+				Spec: cmapi.CertificateRequestSpec{
+					Request:   test.csr,
+					IssuerRef: test.issuerRef,
+					IsCA:      test.isCA,
+				},
+			}
+			raw, err := json.Marshal(cr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := New(klogr.New(), issuerRef, "istio-system", istioCSRUsername,
+				[]string{allowedUsername}, []string{trustedUsername})
+			resp := c.Handle(context.TODO(), admission.Request{
+				AdmissionRequest: admissionv1.AdmissionRequest{
+					Operation: admissionv1.Create,
+					Namespace: test.namespace,
+					UserInfo:  authenticationv1.UserInfo{Username: test.username},
+					Object:    runtime.RawExtension{Raw: raw},
+				},
+			})
+
+			if resp.Allowed != test.expAllow {
+				t.Errorf("unexpected allowed, exp=%t got=%t (%v)",
+					test.expAllow, resp.Allowed, resp.Result)
+			}
+		})
+	}
+}
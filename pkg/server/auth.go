@@ -18,31 +18,41 @@ package server
 
 import (
 	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/url"
 	"sort"
 	"strings"
+	"time"
 
+	"github.com/go-logr/logr"
+	"istio.io/istio/pkg/spiffe"
 	pkiutil "istio.io/istio/security/pkg/pki/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
 
+	"github.com/cert-manager/istio-csr/pkg/server/internal/authz"
 	"github.com/cert-manager/istio-csr/pkg/server/internal/extensions"
+	"github.com/cert-manager/istio-csr/pkg/server/internal/policy"
+	"github.com/cert-manager/istio-csr/pkg/util"
 )
 
 // authRequest will authenticate the request and authorize the CSR is valid for
-// the identity
-func (s *Server) authRequest(ctx context.Context, csrPEM []byte) (string, bool) {
+// the identity. If authorized, the parsed CSR is also returned.
+func (s *Server) authRequest(ctx context.Context, csrPEM []byte) (string, *x509.CertificateRequest, bool) {
 	caller, err := s.auther.Authenticate(ctx)
 	if err != nil {
 		// TODO: pass in logger with request context
 		s.log.Error(err, "failed to authenticate request")
-		return "", false
+		return "", nil, false
 	}
 
 	// request authentication has no identities, so error
 	if len(caller.Identities) == 0 {
 		s.log.Error(errors.New("request sent with no identity"), "")
-		return "", false
+		return "", nil, false
 	}
 
 	// return concatenated list of verified ids
@@ -52,40 +62,132 @@ func (s *Server) authRequest(ctx context.Context, csrPEM []byte) (string, bool)
 	csr, err := pkiutil.ParsePemEncodedCSR(csrPEM)
 	if err != nil {
 		log.Error(err, "failed to decode CSR")
-		return identities, false
+		return identities, nil, false
 	}
 
 	if err := csr.CheckSignature(); err != nil {
 		log.Error(err, "CSR failed signature check")
-		return identities, false
+		return identities, nil, false
 	}
 
-	// if the csr contains any other options set, error
-	if len(csr.DNSNames) > 0 || len(csr.IPAddresses) > 0 ||
-		len(csr.Subject.CommonName) > 0 || len(csr.EmailAddresses) > 0 {
-		log.Error(errors.New("forbidden extensions"), "",
-			"dns", csr.DNSNames,
-			"ips", csr.IPAddresses,
-			"common-name", csr.Subject.CommonName,
-			"emails", csr.EmailAddresses)
+	// if running in FIPS mode, only accept FIPS-approved keys
+	if s.fips {
+		if err := util.ValidateFIPSPublicKey(csr.PublicKey); err != nil {
+			log.Error(err, "forbidden public key")
+			return identities, nil, false
+		}
+	}
 
-		return identities, false
+	// if the csr contains any other options set, error
+	if err := extensions.ValidateCSRSubject(csr); err != nil {
+		log.Error(err, "forbidden extensions")
+		return identities, nil, false
 	}
 
 	// ensure csr extensions are valid
 	if err := extensions.ValidateCSRExtentions(csr); err != nil {
 		log.Error(err, "forbidden extensions")
-		return identities, false
+		return identities, nil, false
 	}
 
 	// ensure identity matches requests URIs
 	if !identitiesMatch(caller.Identities, csr.URIs) {
 		log.Error(fmt.Errorf("%v != %v", caller.Identities, csr.URIs), "failed to match URIs with identities")
-		return identities, false
+		return identities, nil, false
 	}
 
 	// return positive authn of given csr
-	return identities, true
+	return identities, csr, true
+}
+
+// evaluatePolicy will evaluate the configured authorization policies against
+// the authorized CSR and requested duration. Returns a Denial error if an
+// enforced policy denies the request.
+func (s *Server) evaluatePolicy(ctx context.Context, log logr.Logger, csr *x509.CertificateRequest, duration time.Duration) error {
+	if s.policy == nil || s.policy.Empty() {
+		return nil
+	}
+
+	req := &policy.Request{
+		CSR:      csr,
+		Duration: duration,
+	}
+	req.Identities, req.Namespace, req.ServiceAccount = callerIdentity(csr)
+
+	// Only look up the caller's namespace if a policy needs its labels
+	if len(req.Namespace) > 0 && s.policy.NamespaceLabels() {
+		lister, err := s.namespaceLister(ctx)
+		if err != nil {
+			return err
+		}
+
+		ns, err := lister.Get(req.Namespace)
+		if err != nil {
+			return fmt.Errorf("failed to get namespace %q for policy evaluation: %s", req.Namespace, err)
+		}
+		req.NamespaceLabels = ns.Labels
+	}
+
+	if denial := s.policy.Evaluate(log, req); denial != nil {
+		return denial
+	}
+
+	return nil
+}
+
+// namespaceLister returns the lister of the cached caller namespaces. The
+// cluster-wide Namespace informer is started and synced the first time it is
+// needed, so that namespaces are only watched once a loaded policy references
+// their labels.
+func (s *Server) namespaceLister(ctx context.Context) (corelisters.NamespaceLister, error) {
+	s.namespacesMu.Lock()
+	defer s.namespacesMu.Unlock()
+
+	informer := s.namespaces.Core().V1().Namespaces()
+	if !s.namespacesSynced {
+		s.log.Info("starting namespace informer for policies referencing namespace labels")
+		s.namespaces.Start(s.namespacesStopCh)
+		if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+			return nil, errors.New("failed to wait for namespace informer to sync")
+		}
+		s.namespacesSynced = true
+	}
+
+	return informer.Lister(), nil
+}
+
+// reviewRequest will consult the external authorization webhook with the
+// authorized CSR and requested duration.
+func (s *Server) reviewRequest(ctx context.Context, csr *x509.CertificateRequest, duration time.Duration) (*authz.Decision, error) {
+	req := &authz.ReviewRequest{
+		CSR: authz.CSRSummary{
+			PublicKeyAlgorithm: csr.PublicKeyAlgorithm.String(),
+			SignatureAlgorithm: csr.SignatureAlgorithm.String(),
+		},
+		Duration: metav1.Duration{Duration: duration},
+	}
+	req.Identities, req.Namespace, req.ServiceAccount = callerIdentity(csr)
+	req.CSR.URIs = req.Identities
+
+	return s.authz.Review(ctx, req)
+}
+
+// callerIdentity returns the identities of the given authorized CSR, along with
+// the namespace and service account of the first identity. Istio workloads
+// request a single identity of their service account.
+func callerIdentity(csr *x509.CertificateRequest) ([]string, string, string) {
+	var identities []string
+	for _, uri := range csr.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	if len(identities) > 0 {
+		if id, err := spiffe.ParseIdentity(identities[0]); err == nil {
+			return identities, id.Namespace, id.ServiceAccount
+		}
+	}
+
+	return identities, "", ""
 }
 
 // identitiesMatch will ensure that two list of identities given from the
@@ -18,13 +18,23 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"fmt"
 	"net/url"
 	"testing"
+	"time"
 
+	pkiutil "istio.io/istio/security/pkg/pki/util"
 	"istio.io/istio/security/pkg/server/ca/authenticate"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/klog/v2/klogr"
 
+	"github.com/cert-manager/istio-csr/pkg/server/internal/policy"
 	"github.com/cert-manager/istio-csr/test/gen"
 )
 
@@ -122,9 +132,15 @@ func newMockAuthn(ids []string, errMsg string) *mockAuthenticator {
 }
 
 func TestAuthRequest(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	tests := map[string]struct {
 		authn       *mockAuthenticator
 		inpCSR      []byte
+		fips        bool
 		expIdenties string
 		expAuth     bool
 	}{
@@ -222,6 +238,35 @@ func TestAuthRequest(t *testing.T) {
 			expIdenties: "spiffe://foo",
 			expAuth:     true,
 		},
+		"if fips and csr has a FIPS-approved key, return true": {
+			authn: newMockAuthn([]string{"spiffe://foo"}, ""),
+			inpCSR: gen.MustCSR(t,
+				gen.SetCSRIdentities([]string{"spiffe://foo"}),
+			),
+			fips:        true,
+			expIdenties: "spiffe://foo",
+			expAuth:     true,
+		},
+		"if fips and csr has an Ed25519 key, error": {
+			authn: newMockAuthn([]string{"spiffe://foo"}, ""),
+			inpCSR: gen.MustCSR(t,
+				gen.SetCSRIdentities([]string{"spiffe://foo"}),
+				gen.SetCSRSigner(edKey),
+			),
+			fips:        true,
+			expIdenties: "spiffe://foo",
+			expAuth:     false,
+		},
+		"if not fips and csr has an Ed25519 key, return true": {
+			authn: newMockAuthn([]string{"spiffe://foo"}, ""),
+			inpCSR: gen.MustCSR(t,
+				gen.SetCSRIdentities([]string{"spiffe://foo"}),
+				gen.SetCSRSigner(edKey),
+			),
+			fips:        false,
+			expIdenties: "spiffe://foo",
+			expAuth:     true,
+		},
 	}
 
 	for name, test := range tests {
@@ -229,9 +274,10 @@ func TestAuthRequest(t *testing.T) {
 			s := &Server{
 				log:    klogr.New(),
 				auther: test.authn,
+				fips:   test.fips,
 			}
 
-			identities, authed := s.authRequest(context.TODO(), test.inpCSR)
+			identities, _, authed := s.authRequest(context.TODO(), test.inpCSR)
 			if identities != test.expIdenties {
 				t.Errorf("unexpected identities response, exp=%s got=%s",
 					test.expIdenties, identities)
@@ -244,3 +290,92 @@ func TestAuthRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestEvaluatePolicy(t *testing.T) {
+	payments := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "payments", Labels: map[string]string{"team": "payments"}},
+	}
+
+	tests := map[string]struct {
+		policies   string
+		namespaces []runtime.Object
+		expErr     bool
+		expDenial  bool
+		expStarted bool
+	}{
+		"if policies don't reference namespace labels, should not look up the namespace": {
+			policies: `
+- name: allow-all
+  expression: "true"`,
+			namespaces: nil,
+			expErr:     false,
+			expDenial:  false,
+		},
+		"if policies reference namespace labels and namespace matches, should allow": {
+			policies: `
+- name: team
+  expression: "namespaceLabels['team'] == 'payments'"`,
+			namespaces: []runtime.Object{payments},
+			expErr:     false,
+			expDenial:  false,
+			expStarted: true,
+		},
+		"if policies reference namespace labels and namespace doesn't match, should deny": {
+			policies: `
+- name: team
+  expression: "namespaceLabels['team'] == 'checkout'"`,
+			namespaces: []runtime.Object{payments},
+			expErr:     true,
+			expDenial:  true,
+			expStarted: true,
+		},
+		"if policies reference namespace labels and namespace doesn't exist, should error": {
+			policies: `
+- name: team
+  expression: "namespaceLabels['team'] == 'payments'"`,
+			namespaces: nil,
+			expErr:     true,
+			expDenial:  false,
+			expStarted: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			engine, err := policy.New(klogr.New(), nil, "test-ns", "test-name")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := engine.Load(test.policies); err != nil {
+				t.Fatal(err)
+			}
+
+			// The namespace informer is registered, but not started
+			namespaces := informers.NewSharedInformerFactory(fake.NewSimpleClientset(test.namespaces...), 0)
+			namespaces.Core().V1().Namespaces().Informer()
+
+			s := &Server{log: klogr.New(), policy: engine, namespaces: namespaces, namespacesStopCh: ctx.Done()}
+
+			csr, err := pkiutil.ParsePemEncodedCSR(gen.MustCSR(t,
+				gen.SetCSRIdentities([]string{"spiffe://cluster.local/ns/payments/sa/api"}),
+			))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.evaluatePolicy(ctx, klogr.New(), csr, time.Hour)
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+			if _, ok := err.(*policy.Denial); ok != test.expDenial {
+				t.Errorf("unexpected denial, exp=%t got=%v", test.expDenial, err)
+			}
+			if s.namespacesSynced != test.expStarted {
+				t.Errorf("unexpected namespace informer started, exp=%t got=%t", test.expStarted, s.namespacesSynced)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authz
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Review is the body which is sent to, and returned by, the authorization
+// webhook.
+type Review struct {
+	Request  *ReviewRequest  `json:"request,omitempty"`
+	Response *ReviewResponse `json:"response,omitempty"`
+}
+
+// ReviewRequest describes the request to be authorized.
+type ReviewRequest struct {
+	Identities     []string        `json:"identities"`
+	Namespace      string          `json:"namespace"`
+	ServiceAccount string          `json:"serviceAccount"`
+	CSR            CSRSummary      `json:"csr"`
+	Duration       metav1.Duration `json:"duration"`
+}
+
+// CSRSummary is a summary of the requested certificate signing request.
+type CSRSummary struct {
+	URIs               []string `json:"uris"`
+	PublicKeyAlgorithm string   `json:"publicKeyAlgorithm"`
+	SignatureAlgorithm string   `json:"signatureAlgorithm"`
+}
+
+// ReviewResponse is the decision of the webhook. If Duration is set and
+// smaller than the requested duration, the certificate will be requested with
+// that duration instead.
+type ReviewResponse struct {
+	Allowed  bool             `json:"allowed"`
+	Reason   string           `json:"reason,omitempty"`
+	Duration *metav1.Duration `json:"duration,omitempty"`
+}
+
+// Decision is the result of a review.
+type Decision struct {
+	Allowed  bool
+	Reason   string
+	Duration time.Duration
+}
+
+// Options are options for the authorization webhook client.
+type Options struct {
+	URL      string
+	CABundle []byte
+	Timeout  time.Duration
+	FailOpen bool
+}
+
+// Client posts reviews to an external authorization webhook.
+type Client struct {
+	log      logr.Logger
+	url      string
+	client   *http.Client
+	failOpen bool
+}
+
+// New returns a new authorization webhook client. The webhook URL must be
+// HTTPS. If a CA bundle is given, it will be used to verify the webhook's
+// serving certificate instead of the system roots.
+func New(log logr.Logger, opts Options) (*Client, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse authorization webhook URL: %s", err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("authorization webhook URL must be https: %q", opts.URL)
+	}
+
+	tlsConfig := new(tls.Config)
+	if len(opts.CABundle) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(opts.CABundle) {
+			return nil, errors.New("failed to parse authorization webhook CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &Client{
+		log: log.WithName("authorization-webhook").WithValues("url", opts.URL),
+		url: opts.URL,
+		client: &http.Client{
+			Timeout: opts.Timeout,
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		failOpen: opts.FailOpen,
+	}, nil
+}
+
+// Review sends the request to the webhook and returns its decision. If the
+// webhook could not be reached or returned an invalid response, the request is
+// allowed if configured to fail open, otherwise an error is returned.
+func (c *Client) Review(ctx context.Context, req *ReviewRequest) (*Decision, error) {
+	resp, err := c.post(ctx, req)
+	if err != nil {
+		if c.failOpen {
+			c.log.Error(err, "failed to review request, failing open", "identities", req.Identities)
+			return &Decision{Allowed: true, Duration: req.Duration.Duration}, nil
+		}
+
+		return nil, err
+	}
+
+	decision := &Decision{
+		Allowed:  resp.Allowed,
+		Reason:   resp.Reason,
+		Duration: req.Duration.Duration,
+	}
+
+	// Only ever allow the webhook to lower the requested duration
+	if resp.Duration != nil && resp.Duration.Duration > 0 {
+		if resp.Duration.Duration < decision.Duration {
+			decision.Duration = resp.Duration.Duration
+		} else {
+			c.log.V(3).Info("ignoring webhook duration larger than requested",
+				"requested", req.Duration.Duration, "returned", resp.Duration.Duration)
+		}
+	}
+
+	return decision, nil
+}
+
+// post sends the review request to the webhook, and returns the decoded
+// response.
+func (c *Client) post(ctx context.Context, req *ReviewRequest) (*ReviewResponse, error) {
+	body, err := json.Marshal(&Review{Request: req})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode review: %s", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build review request: %s", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send review: %s", err)
+	}
+	defer httpResp.Body.Close()
+
+	// Only read a bounded response from the webhook
+	respBody, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read review response: %s", err)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected review response status code %d: %s",
+			httpResp.StatusCode, respBody)
+	}
+
+	var review Review
+	if err := json.Unmarshal(respBody, &review); err != nil {
+		return nil, fmt.Errorf("failed to decode review response: %s", err)
+	}
+
+	if review.Response == nil {
+		return nil, errors.New("review response is empty")
+	}
+
+	return review.Response, nil
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/klogr"
+)
+
+func TestReview(t *testing.T) {
+	allow := func(w http.ResponseWriter, review *Review) {
+		json.NewEncoder(w).Encode(&Review{Response: &ReviewResponse{Allowed: true}})
+	}
+
+	tests := map[string]struct {
+		handler     func(http.ResponseWriter, *Review)
+		failOpen    bool
+		expErr      bool
+		expAllowed  bool
+		expDuration time.Duration
+	}{
+		"if webhook allows, return allowed with requested duration": {
+			handler:     allow,
+			expErr:      false,
+			expAllowed:  true,
+			expDuration: time.Hour,
+		},
+		"if webhook denies, return denied": {
+			handler: func(w http.ResponseWriter, review *Review) {
+				json.NewEncoder(w).Encode(&Review{Response: &ReviewResponse{Allowed: false, Reason: "no"}})
+			},
+			expErr:      false,
+			expAllowed:  false,
+			expDuration: time.Hour,
+		},
+		"if webhook lowers duration, return lowered duration": {
+			handler: func(w http.ResponseWriter, review *Review) {
+				json.NewEncoder(w).Encode(&Review{Response: &ReviewResponse{
+					Allowed:  true,
+					Duration: &metav1.Duration{Duration: time.Minute},
+				}})
+			},
+			expErr:      false,
+			expAllowed:  true,
+			expDuration: time.Minute,
+		},
+		"if webhook raises duration, return requested duration": {
+			handler: func(w http.ResponseWriter, review *Review) {
+				json.NewEncoder(w).Encode(&Review{Response: &ReviewResponse{
+					Allowed:  true,
+					Duration: &metav1.Duration{Duration: time.Hour * 2},
+				}})
+			},
+			expErr:      false,
+			expAllowed:  true,
+			expDuration: time.Hour,
+		},
+		"if webhook returns bad status and fail closed, error": {
+			handler: func(w http.ResponseWriter, review *Review) {
+				w.WriteHeader(http.StatusInternalServerError)
+			},
+			failOpen: false,
+			expErr:   true,
+		},
+		"if webhook returns empty response and fail closed, error": {
+			handler: func(w http.ResponseWriter, review *Review) {
+				json.NewEncoder(w).Encode(&Review{})
+			},
+			failOpen: false,
+			expErr:   true,
+		},
+		"if webhook times out and fail closed, error": {
+			handler: func(w http.ResponseWriter, review *Review) {
+				time.Sleep(time.Millisecond * 500)
+				allow(w, review)
+			},
+			failOpen: false,
+			expErr:   true,
+		},
+		"if webhook times out and fail open, return allowed": {
+			handler: func(w http.ResponseWriter, review *Review) {
+				time.Sleep(time.Millisecond * 500)
+				allow(w, review)
+			},
+			failOpen:    true,
+			expErr:      false,
+			expAllowed:  true,
+			expDuration: time.Hour,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var review Review
+				if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+					t.Errorf("unexpected review request: %v", err)
+				}
+				test.handler(w, &review)
+			}))
+			defer server.Close()
+
+			caBundle := pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: server.Certificate().Raw,
+			})
+
+			client, err := New(klogr.New(), Options{
+				URL:      server.URL,
+				CABundle: caBundle,
+				Timeout:  time.Millisecond * 100,
+				FailOpen: test.failOpen,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decision, err := client.Review(context.TODO(), &ReviewRequest{
+				Identities: []string{"spiffe://cluster.local/ns/foo/sa/bar"},
+				Namespace:  "foo",
+				Duration:   metav1.Duration{Duration: time.Hour},
+			})
+			if test.expErr != (err != nil) {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if decision.Allowed != test.expAllowed {
+				t.Errorf("unexpected allowed, exp=%t got=%t", test.expAllowed, decision.Allowed)
+			}
+			if decision.Duration != test.expDuration {
+				t.Errorf("unexpected duration, exp=%s got=%s", test.expDuration, decision.Duration)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := map[string]struct {
+		opts   Options
+		expErr bool
+	}{
+		"if URL is not https, error": {
+			opts:   Options{URL: "http://example.com"},
+			expErr: true,
+		},
+		"if CA bundle is invalid, error": {
+			opts:   Options{URL: "https://example.com", CABundle: []byte("bad")},
+			expErr: true,
+		},
+		"if URL is https and no CA bundle, no error": {
+			opts:   Options{URL: "https://example.com"},
+			expErr: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(klogr.New(), test.opts)
+			if test.expErr != (err != nil) {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
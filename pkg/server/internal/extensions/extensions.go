@@ -55,6 +55,19 @@ var (
 	}
 )
 
+// ValidateCSRSubject validates the given certificate signing request contains
+// no DNS names, IP addresses, common name or email addresses. Istio
+// certificates only contain URI SANs.
+func ValidateCSRSubject(csr *x509.CertificateRequest) error {
+	if len(csr.DNSNames) > 0 || len(csr.IPAddresses) > 0 ||
+		len(csr.Subject.CommonName) > 0 || len(csr.EmailAddresses) > 0 {
+		return fmt.Errorf("forbidden subject: dns=%v ips=%v common-name=%q emails=%v",
+			csr.DNSNames, csr.IPAddresses, csr.Subject.CommonName, csr.EmailAddresses)
+	}
+
+	return nil
+}
+
 // ValidateCSRExtentions validates the given certificate signing request
 // contains only valid extensions, including URI sans, key usages, and extended
 // key usages. Any other extensions will error.
@@ -0,0 +1,178 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/go-logr/logr"
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Strategy is how requests are assigned to the target issuer during a
+// migration.
+type Strategy string
+
+const (
+	// StrategyIdentity assigns requests by a stable hash of the caller's
+	// identities, so that each workload identity is migrated independently.
+	StrategyIdentity Strategy = "Identity"
+
+	// StrategyNamespace assigns requests by a stable hash of the caller's
+	// namespace, so that namespaces are migrated as a whole.
+	StrategyNamespace Strategy = "Namespace"
+)
+
+var (
+	targetPercentage = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "certmanager",
+		Subsystem: "istio_csr",
+		Name:      "migration_target_percentage",
+		Help:      "The percentage of requests assigned to the migration target issuer.",
+	})
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "certmanager",
+		Subsystem: "istio_csr",
+		Name:      "migration_requests_total",
+		Help:      "The number of requests assigned to the migration source and target issuers.",
+	}, []string{"issuer"})
+
+	fallbacksTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "certmanager",
+		Subsystem: "istio_csr",
+		Name:      "migration_fallbacks_total",
+		Help:      "The number of requests assigned to the migration target issuer which fell back to the source issuer, since the issued certificate is not trusted by the root CA.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(targetPercentage, requestsTotal, fallbacksTotal)
+}
+
+// Options configure a migration from a source to a target issuer.
+type Options struct {
+	Source     cmmeta.ObjectReference
+	Target     cmmeta.ObjectReference
+	Percentage int
+	Strategy   Strategy
+}
+
+// Router assigns requests to either the source or target issuer of a
+// migration. Assignment is stable, so a caller is always assigned the same
+// issuer for a given percentage, and callers assigned the target issuer remain
+// so as the percentage is raised.
+type Router struct {
+	log  logr.Logger
+	opts Options
+}
+
+// New returns a new Router for the given migration.
+func New(log logr.Logger, opts Options) *Router {
+	log = log.WithName("migration")
+	log.Info("migrating requests between issuers",
+		"source", opts.Source, "target", opts.Target,
+		"percentage", opts.Percentage, "strategy", opts.Strategy)
+
+	targetPercentage.Set(float64(opts.Percentage))
+
+	return &Router{
+		log:  log,
+		opts: opts,
+	}
+}
+
+// IssuerFor returns the issuer that a request from the caller with the given
+// identities and namespace should be signed by.
+func (r *Router) IssuerFor(identities, namespace string) cmmeta.ObjectReference {
+	key := identities
+	if r.opts.Strategy == StrategyNamespace {
+		key = namespace
+	}
+
+	if bucket(key) < r.opts.Percentage {
+		requestsTotal.WithLabelValues("target").Inc()
+		r.log.V(3).Info("assigned request to target issuer", "identities", identities, "namespace", namespace)
+		return r.opts.Target
+	}
+
+	requestsTotal.WithLabelValues("source").Inc()
+	r.log.V(3).Info("assigned request to source issuer", "identities", identities, "namespace", namespace)
+	return r.opts.Source
+}
+
+// IsTarget returns true if the issuer is the migration target issuer.
+func (r *Router) IsTarget(issuerRef cmmeta.ObjectReference) bool {
+	return issuerRef == r.opts.Target
+}
+
+// Fallback records that a request assigned to the target issuer was not
+// trusted by the root CA, and returns the source issuer to sign it instead.
+func (r *Router) Fallback(identities, namespace string, err error) cmmeta.ObjectReference {
+	fallbacksTotal.Inc()
+	r.log.Error(err, "certificate signed by target issuer is not trusted by the root CA, falling back to source issuer",
+		"identities", identities, "namespace", namespace)
+	return r.opts.Source
+}
+
+// VerifyTrusted returns an error if the PEM encoded certificate, with the
+// issuer's CA certificates, does not chain to one of the PEM encoded root CAs.
+// A CA returned by the issuer which is not itself in the root CAs is not
+// trusted.
+func VerifyTrusted(certPEM, caPEM, rootCAs []byte) error {
+	block, rest := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return errors.New("failed to decode certificate PEM")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %s", err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootCAs) {
+		return errors.New("root CA contains no certificates")
+	}
+
+	// The issued chain may contain intermediates after the leaf
+	intermediates := x509.NewCertPool()
+	intermediates.AppendCertsFromPEM(rest)
+	intermediates.AppendCertsFromPEM(caPEM)
+
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("certificate is not trusted by the root CA: %s", err)
+	}
+
+	return nil
+}
+
+// bucket returns a stable bucket in the range [0, 100) for the given key.
+func bucket(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % 100)
+}
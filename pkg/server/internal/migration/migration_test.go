@@ -0,0 +1,167 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package migration
+
+import (
+	"fmt"
+	"testing"
+
+	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+var (
+	source = cmmeta.ObjectReference{Name: "source", Kind: "Issuer", Group: "cert-manager.io"}
+	target = cmmeta.ObjectReference{Name: "target", Kind: "Issuer", Group: "cert-manager.io"}
+)
+
+func TestIssuerFor(t *testing.T) {
+	tests := map[string]struct {
+		percentage int
+		strategy   Strategy
+		expTarget  func(targeted int) bool
+	}{
+		"if percentage is 0, all requests should go to the source issuer": {
+			percentage: 0,
+			strategy:   StrategyIdentity,
+			expTarget:  func(targeted int) bool { return targeted == 0 },
+		},
+		"if percentage is 100, all requests should go to the target issuer": {
+			percentage: 100,
+			strategy:   StrategyIdentity,
+			expTarget:  func(targeted int) bool { return targeted == 1000 },
+		},
+		"if percentage is 50, roughly half of requests should go to the target issuer": {
+			percentage: 50,
+			strategy:   StrategyIdentity,
+			expTarget:  func(targeted int) bool { return targeted > 400 && targeted < 600 },
+		},
+		"if strategy is namespace, all requests from the same namespace should go to the same issuer": {
+			percentage: 50,
+			strategy:   StrategyNamespace,
+			expTarget:  func(targeted int) bool { return targeted == 0 || targeted == 1000 },
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := New(klogr.New(), Options{Source: source, Target: target, Percentage: test.percentage, Strategy: test.strategy})
+
+			var targeted int
+			for i := 0; i < 1000; i++ {
+				identity := fmt.Sprintf("spiffe://cluster.local/ns/sandbox/sa/sa-%d", i)
+				if r.IssuerFor(identity, "sandbox") == target {
+					targeted++
+				}
+			}
+
+			if !test.expTarget(targeted) {
+				t.Errorf("unexpected number of requests assigned to target issuer: %d", targeted)
+			}
+		})
+	}
+}
+
+func TestIssuerForStable(t *testing.T) {
+	identity := "spiffe://cluster.local/ns/sandbox/sa/sleep"
+
+	// Once assigned to the target, raising the percentage must not move the
+	// identity back to the source.
+	var targeted bool
+	for percentage := 0; percentage <= 100; percentage += 10 {
+		r := New(klogr.New(), Options{Source: source, Target: target, Percentage: percentage, Strategy: StrategyIdentity})
+		isTarget := r.IssuerFor(identity, "sandbox") == target
+		if targeted && !isTarget {
+			t.Fatalf("identity moved back to source issuer at percentage %d", percentage)
+		}
+		targeted = isTarget
+	}
+
+	if !targeted {
+		t.Error("expected identity to be assigned to target issuer at 100 percent")
+	}
+}
+
+func TestVerifyTrusted(t *testing.T) {
+	sourceRoot := gen.MustCertificate(t, gen.SetCertificateCommonName("source-root"), gen.SetCertificateIsCA(true))
+	targetRoot := gen.MustCertificate(t, gen.SetCertificateCommonName("target-root"), gen.SetCertificateIsCA(true))
+	targetIntermediate := gen.MustCertificate(t, gen.SetCertificateCommonName("target-intermediate"),
+		gen.SetCertificateIsCA(true), gen.SetCertificateParent(targetRoot))
+	leaf := gen.MustCertificate(t, gen.SetCertificateCommonName("leaf"), gen.SetCertificateParent(targetRoot))
+	intermediateLeaf := gen.MustCertificate(t, gen.SetCertificateCommonName("leaf"), gen.SetCertificateParent(targetIntermediate))
+
+	tests := map[string]struct {
+		cert, ca, rootCAs []byte
+		expErr            bool
+	}{
+		"if the issuer's root CA is in the root CA bundle, should be trusted": {
+			cert:    leaf,
+			ca:      targetRoot,
+			rootCAs: append(append([]byte{}, sourceRoot...), targetRoot...),
+			expErr:  false,
+		},
+		"if the issuer's root CA is not in the root CA bundle, should not be trusted": {
+			cert:    leaf,
+			ca:      targetRoot,
+			rootCAs: sourceRoot,
+			expErr:  true,
+		},
+		"if the issuer returns an intermediate chaining to the root CA bundle, should be trusted": {
+			cert:    intermediateLeaf,
+			ca:      targetIntermediate,
+			rootCAs: targetRoot,
+			expErr:  false,
+		},
+		"if the issuer returns an intermediate in the certificate chain, should be trusted": {
+			cert:    append(append([]byte{}, intermediateLeaf...), targetIntermediate...),
+			rootCAs: targetRoot,
+			expErr:  false,
+		},
+		"if the certificate is not PEM encoded, should error": {
+			cert:    []byte("not a certificate"),
+			rootCAs: targetRoot,
+			expErr:  true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := VerifyTrusted(test.cert, test.ca, test.rootCAs)
+			if (err != nil) != test.expErr {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
+
+func TestFallback(t *testing.T) {
+	r := New(klogr.New(), Options{Source: source, Target: target, Percentage: 100, Strategy: StrategyIdentity})
+
+	issuerRef := r.IssuerFor("spiffe://cluster.local/ns/sandbox/sa/sleep", "sandbox")
+	if !r.IsTarget(issuerRef) {
+		t.Fatalf("expected request to be assigned to target issuer, got=%v", issuerRef)
+	}
+
+	if issuerRef := r.Fallback("spiffe://cluster.local/ns/sandbox/sa/sleep", "sandbox", fmt.Errorf("untrusted")); issuerRef != source {
+		t.Errorf("expected fallback to source issuer, got=%v", issuerRef)
+	}
+	if r.IsTarget(source) {
+		t.Error("expected source issuer to not be the target")
+	}
+}
@@ -0,0 +1,364 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// PoliciesKey is the key in the policy ConfigMap which holds the YAML
+	// encoded list of policies.
+	PoliciesKey = "policies.yaml"
+)
+
+// Mode is the mode a policy is run in.
+type Mode string
+
+const (
+	// ModeEnforce will deny requests which fail the policy.
+	ModeEnforce Mode = "Enforce"
+
+	// ModeAudit will only log requests which fail the policy.
+	ModeAudit Mode = "Audit"
+)
+
+// Policy is a single authorization policy. The Expression must evaluate to
+// true for the request to be allowed.
+type Policy struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	Mode       Mode   `json:"mode,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// Request is the input to policy evaluation.
+type Request struct {
+	Identities      []string
+	Namespace       string
+	ServiceAccount  string
+	CSR             *x509.CertificateRequest
+	Duration        time.Duration
+	NamespaceLabels map[string]string
+}
+
+// Denial describes the enforced policy that denied a request.
+type Denial struct {
+	Policy  string
+	Message string
+}
+
+func (d *Denial) Error() string {
+	return fmt.Sprintf("denied by policy %q: %s", d.Policy, d.Message)
+}
+
+type program struct {
+	Policy
+	prg cel.Program
+
+	// namespaceLabels is true if the expression references namespaceLabels.
+	namespaceLabels bool
+}
+
+// Engine evaluates CEL authorization policies over incoming requests. The set
+// of policies is loaded from a ConfigMap which is watched for changes. While
+// the ConfigMap is deleted, every request is denied.
+type Engine struct {
+	log logr.Logger
+	env *cel.Env
+
+	kubeClient kubernetes.Interface
+	namespace  string
+	name       string
+
+	mu       sync.RWMutex
+	programs []*program
+
+	// missing is true if the policy ConfigMap has been deleted since the
+	// policies were last loaded.
+	missing bool
+}
+
+// New returns a new policy Engine which will source its policies from the
+// ConfigMap with the given namespace and name.
+func New(log logr.Logger, kubeClient kubernetes.Interface, namespace, name string) (*Engine, error) {
+	env, err := cel.NewEnv(
+		cel.Declarations(
+			decls.NewVar("caller", decls.NewMapType(decls.String, decls.Dyn)),
+			decls.NewVar("csr", decls.NewMapType(decls.String, decls.Dyn)),
+			decls.NewVar("duration", decls.Duration),
+			decls.NewVar("namespaceLabels", decls.NewMapType(decls.String, decls.String)),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build CEL environment: %s", err)
+	}
+
+	return &Engine{
+		log:        log.WithName("policy").WithValues("configmap", namespace+"/"+name),
+		env:        env,
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		name:       name,
+	}, nil
+}
+
+// Start will begin watching the policy ConfigMap, and block until the initial
+// set of policies has been loaded. Returns error if the ConfigMap doesn't exist
+// or its policies fail to load, rather than allowing all requests.
+func (e *Engine) Start(ctx context.Context) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(e.kubeClient, 0,
+		informers.WithNamespace(e.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", e.name).String()
+		}),
+	)
+
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			e.onConfigMap(obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			e.onConfigMap(obj)
+		},
+		DeleteFunc: func(_ interface{}) {
+			e.log.Error(errors.New("policy configmap deleted"), "denying all requests until the configmap is recreated")
+			e.mu.Lock()
+			e.programs = nil
+			e.missing = true
+			e.mu.Unlock()
+		},
+	})
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return errors.New("failed to wait for policy configmap informer to sync")
+	}
+
+	cm, err := factory.Core().V1().ConfigMaps().Lister().ConfigMaps(e.namespace).Get(e.name)
+	if err != nil {
+		return fmt.Errorf("failed to get policy configmap %s/%s: %s", e.namespace, e.name, err)
+	}
+
+	if err := e.Load(cm.Data[PoliciesKey]); err != nil {
+		return fmt.Errorf("failed to load policies from configmap %s/%s: %s", e.namespace, e.name, err)
+	}
+
+	return nil
+}
+
+// onConfigMap loads the policies from the given ConfigMap. If the policies fail
+// to load, the existing policies are kept.
+func (e *Engine) onConfigMap(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	if err := e.Load(cm.Data[PoliciesKey]); err != nil {
+		e.log.Error(err, "failed to load policies, keeping existing policies")
+	}
+}
+
+// Load parses and compiles the given YAML encoded list of policies, replacing
+// the current set. If any policy fails to compile, the current set is
+// unchanged and an error is returned.
+func (e *Engine) Load(data string) error {
+	var policies []Policy
+	if err := yaml.Unmarshal([]byte(data), &policies); err != nil {
+		return fmt.Errorf("failed to decode policies: %s", err)
+	}
+
+	programs := make([]*program, 0, len(policies))
+	names := make(map[string]struct{})
+	for _, policy := range policies {
+		if len(policy.Name) == 0 {
+			return errors.New("policy name must not be empty")
+		}
+		if _, ok := names[policy.Name]; ok {
+			return fmt.Errorf("duplicate policy name %q", policy.Name)
+		}
+		names[policy.Name] = struct{}{}
+
+		switch policy.Mode {
+		case "":
+			policy.Mode = ModeEnforce
+		case ModeEnforce, ModeAudit:
+		default:
+			return fmt.Errorf("policy %q has unknown mode %q", policy.Name, policy.Mode)
+		}
+
+		if len(policy.Message) == 0 {
+			policy.Message = "request does not satisfy " + policy.Expression
+		}
+
+		ast, iss := e.env.Compile(policy.Expression)
+		if iss.Err() != nil {
+			return fmt.Errorf("failed to compile policy %q: %s", policy.Name, iss.Err())
+		}
+		if !proto.Equal(ast.ResultType(), decls.Bool) && !proto.Equal(ast.ResultType(), decls.Dyn) {
+			return fmt.Errorf("policy %q expression must evaluate to a bool", policy.Name)
+		}
+
+		prg, err := e.env.Program(ast)
+		if err != nil {
+			return fmt.Errorf("failed to build program for policy %q: %s", policy.Name, err)
+		}
+
+		checked, err := cel.AstToCheckedExpr(ast)
+		if err != nil {
+			return fmt.Errorf("failed to check policy %q: %s", policy.Name, err)
+		}
+
+		var namespaceLabels bool
+		for _, ref := range checked.GetReferenceMap() {
+			if ref.GetName() == "namespaceLabels" {
+				namespaceLabels = true
+			}
+		}
+
+		programs = append(programs, &program{Policy: policy, prg: prg, namespaceLabels: namespaceLabels})
+	}
+
+	e.mu.Lock()
+	e.programs = programs
+	e.missing = false
+	e.mu.Unlock()
+
+	e.log.Info("loaded policies", "count", len(programs))
+
+	return nil
+}
+
+// Empty returns true if no policies are currently loaded, and the policy
+// ConfigMap has not been deleted.
+func (e *Engine) Empty() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.programs) == 0 && !e.missing
+}
+
+// NamespaceLabels returns true if any loaded policy references the labels of
+// the caller's namespace, so that they need to be looked up.
+func (e *Engine) NamespaceLabels() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, p := range e.programs {
+		if p.namespaceLabels {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate runs every loaded policy against the request. A Denial is returned
+// for the first enforced policy which does not allow the request. Policies
+// which fail to evaluate, or do not evaluate to a bool, are treated as having
+// denied the request. If the policy ConfigMap has been deleted, every request
+// is denied.
+func (e *Engine) Evaluate(log logr.Logger, req *Request) *Denial {
+	e.mu.RLock()
+	programs, missing := e.programs, e.missing
+	e.mu.RUnlock()
+
+	if missing {
+		return &Denial{
+			Policy:  e.name,
+			Message: fmt.Sprintf("policy configmap %s/%s does not exist", e.namespace, e.name),
+		}
+	}
+
+	if len(programs) == 0 {
+		return nil
+	}
+
+	input := map[string]interface{}{
+		"caller": map[string]interface{}{
+			"identities":     req.Identities,
+			"namespace":      req.Namespace,
+			"serviceAccount": req.ServiceAccount,
+		},
+		"csr":             csrInput(req.CSR),
+		"duration":        ptypes.DurationProto(req.Duration),
+		"namespaceLabels": req.NamespaceLabels,
+	}
+
+	for _, p := range programs {
+		log := log.WithValues("policy", p.Name, "mode", p.Mode)
+
+		allowed := false
+		val, _, err := p.prg.Eval(input)
+		if err != nil {
+			log.Error(err, "failed to evaluate policy")
+		} else if b, ok := val.Value().(bool); ok {
+			allowed = b
+		}
+
+		if allowed {
+			continue
+		}
+
+		if p.Mode == ModeAudit {
+			log.Info("request would have been denied by audited policy", "message", p.Message)
+			continue
+		}
+
+		return &Denial{
+			Policy:  p.Name,
+			Message: p.Message,
+		}
+	}
+
+	return nil
+}
+
+// csrInput builds the CEL input of the given CSR.
+func csrInput(csr *x509.CertificateRequest) map[string]interface{} {
+	if csr == nil {
+		return nil
+	}
+
+	uris := make([]string, len(csr.URIs))
+	for i, uri := range csr.URIs {
+		uris[i] = uri.String()
+	}
+
+	return map[string]interface{}{
+		"uris":               uris,
+		"publicKeyAlgorithm": csr.PublicKeyAlgorithm.String(),
+		"signatureAlgorithm": csr.SignatureAlgorithm.String(),
+	}
+}
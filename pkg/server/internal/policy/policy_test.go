@@ -0,0 +1,333 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"crypto/x509"
+	"net/url"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/klogr"
+)
+
+func TestLoad(t *testing.T) {
+	tests := map[string]struct {
+		data   string
+		expErr bool
+	}{
+		"if no policies, no error": {
+			data:   "",
+			expErr: false,
+		},
+		"if policy has no name, error": {
+			data:   `- expression: "true"`,
+			expErr: true,
+		},
+		"if policy names are duplicated, error": {
+			data: `
+- name: foo
+  expression: "true"
+- name: foo
+  expression: "false"`,
+			expErr: true,
+		},
+		"if policy has unknown mode, error": {
+			data: `
+- name: foo
+  mode: Warn
+  expression: "true"`,
+			expErr: true,
+		},
+		"if policy expression does not compile, error": {
+			data: `
+- name: foo
+  expression: "caller.namespace =="`,
+			expErr: true,
+		},
+		"if policy expression is dynamically typed, no error": {
+			data: `
+- name: foo
+  expression: "caller.namespace"`,
+			expErr: false,
+		},
+		"if policy expression returns a string, error": {
+			data: `
+- name: foo
+  expression: "'foo'"`,
+			expErr: true,
+		},
+		"if policies are valid, no error": {
+			data: `
+- name: foo
+  mode: Audit
+  expression: "duration <= duration('1h')"
+- name: bar
+  expression: "!caller.identities.exists(id, id.startsWith('spiffe://cluster.local/ns/blocked'))"`,
+			expErr: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, err := New(klogr.New(), nil, "test-ns", "test-name")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = e.Load(test.data)
+			if test.expErr != (err != nil) {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	const policies = `
+- name: payments-max-duration
+  expression: "!caller.namespace.startsWith('payments-') || duration <= duration('1h')"
+  message: payments certificates must not be longer than 1h
+- name: blocked-identities
+  expression: "!caller.identities.exists(id, id.startsWith('spiffe://cluster.local/ns/blocked/'))"
+- name: audited-labels
+  mode: Audit
+  expression: "'team' in namespaceLabels"
+- name: rsa-only
+  expression: "csr.publicKeyAlgorithm == 'RSA'"
+`
+
+	tests := map[string]struct {
+		req       *Request
+		expPolicy string
+	}{
+		"if request satisfies all policies, allow": {
+			req:       newRequest("default", "sleep", time.Hour*24),
+			expPolicy: "",
+		},
+		"if payments request is within 1h, allow": {
+			req:       newRequest("payments-eu", "api", time.Hour),
+			expPolicy: "",
+		},
+		"if payments request is longer than 1h, deny": {
+			req:       newRequest("payments-eu", "api", time.Hour*2),
+			expPolicy: "payments-max-duration",
+		},
+		"if identity is blocked, deny": {
+			req:       newRequest("blocked", "api", time.Hour),
+			expPolicy: "blocked-identities",
+		},
+		"if CSR is not RSA, deny": {
+			req: func() *Request {
+				req := newRequest("default", "sleep", time.Hour)
+				req.CSR.PublicKeyAlgorithm = x509.ECDSA
+				return req
+			}(),
+			expPolicy: "rsa-only",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, err := New(klogr.New(), nil, "test-ns", "test-name")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := e.Load(policies); err != nil {
+				t.Fatal(err)
+			}
+
+			var policy string
+			if denial := e.Evaluate(klogr.New(), test.req); denial != nil {
+				policy = denial.Policy
+			}
+
+			if policy != test.expPolicy {
+				t.Errorf("unexpected denying policy, exp=%q got=%q",
+					test.expPolicy, policy)
+			}
+		})
+	}
+}
+
+func TestNamespaceLabels(t *testing.T) {
+	tests := map[string]struct {
+		data string
+		exp  bool
+	}{
+		"if no policies, should not need namespace labels": {
+			data: "",
+			exp:  false,
+		},
+		"if no policy references namespace labels, should not need them": {
+			data: `
+- name: foo
+  expression: "caller.namespace != 'namespaceLabels'"`,
+			exp: false,
+		},
+		"if a policy references namespace labels, should need them": {
+			data: `
+- name: foo
+  expression: "true"
+- name: bar
+  expression: "namespaceLabels['team'] == 'payments'"`,
+			exp: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, err := New(klogr.New(), nil, "test-ns", "test-name")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := e.Load(test.data); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := e.NamespaceLabels(); got != test.exp {
+				t.Errorf("unexpected namespace labels, exp=%t got=%t", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestStart(t *testing.T) {
+	const policies = `
+- name: deny-all
+  expression: "false"
+`
+
+	tests := map[string]struct {
+		existing []runtime.Object
+		expErr   bool
+	}{
+		"if policy configmap doesn't exist, should error": {
+			existing: nil,
+			expErr:   true,
+		},
+		"if policy configmap has invalid policies, should error": {
+			existing: []runtime.Object{policyConfigMap("- expression: \"true\"")},
+			expErr:   true,
+		},
+		"if policy configmap has valid policies, should load them": {
+			existing: []runtime.Object{policyConfigMap(policies)},
+			expErr:   false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e, err := New(klogr.New(), fake.NewSimpleClientset(test.existing...), "test-ns", "test-name")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = e.Start(ctx)
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+			if !test.expErr && e.Empty() {
+				t.Error("expected policies to be loaded")
+			}
+		})
+	}
+}
+
+func TestStartConfigMapDeleted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	kubeClient := fake.NewSimpleClientset(policyConfigMap(`
+- name: allow-all
+  expression: "true"
+`))
+
+	e, err := New(klogr.New(), kubeClient, "test-ns", "test-name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if denial := e.Evaluate(klogr.New(), newRequest("default", "sleep", time.Hour)); denial != nil {
+		t.Fatalf("expected loaded policies to allow the request, got=%v", denial)
+	}
+
+	if err := kubeClient.CoreV1().ConfigMaps("test-ns").Delete(ctx, "test-name", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the informer time to observe the deletion
+	time.Sleep(time.Millisecond * 200)
+
+	if e.Empty() {
+		t.Error("expected engine to not be empty after configmap deleted")
+	}
+	if denial := e.Evaluate(klogr.New(), newRequest("default", "sleep", time.Hour)); denial == nil {
+		t.Error("expected request to be denied after configmap deleted")
+	}
+
+	if _, err := kubeClient.CoreV1().ConfigMaps("test-ns").Create(ctx, policyConfigMap(`
+- name: allow-all
+  expression: "true"
+`), metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the informer time to observe the creation
+	time.Sleep(time.Millisecond * 200)
+
+	if denial := e.Evaluate(klogr.New(), newRequest("default", "sleep", time.Hour)); denial != nil {
+		t.Errorf("expected recreated policies to allow the request, got=%v", denial)
+	}
+}
+
+func policyConfigMap(policies string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-name", Namespace: "test-ns"},
+		Data:       map[string]string{PoliciesKey: policies},
+	}
+}
+
+func newRequest(namespace, serviceAccount string, duration time.Duration) *Request {
+	id := "spiffe://cluster.local/ns/" + namespace + "/sa/" + serviceAccount
+	uri, _ := url.Parse(id)
+
+	return &Request{
+		Identities:     []string{id},
+		Namespace:      namespace,
+		ServiceAccount: serviceAccount,
+		CSR: &x509.CertificateRequest{
+			URIs:               []*url.URL{uri},
+			PublicKeyAlgorithm: x509.RSA,
+		},
+		Duration:        duration,
+		NamespaceLabels: map[string]string{},
+	}
+}
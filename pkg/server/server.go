@@ -19,8 +19,11 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -34,8 +37,13 @@ import (
 	securityapi "istio.io/api/security/v1alpha1"
 	"istio.io/istio/security/pkg/server/ca/authenticate"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
 
 	"github.com/cert-manager/istio-csr/cmd/app/options"
+	"github.com/cert-manager/istio-csr/pkg/cleanup"
+	"github.com/cert-manager/istio-csr/pkg/server/internal/authz"
+	"github.com/cert-manager/istio-csr/pkg/server/internal/migration"
+	"github.com/cert-manager/istio-csr/pkg/server/internal/policy"
 	"github.com/cert-manager/istio-csr/pkg/util"
 	"github.com/cert-manager/istio-csr/pkg/util/healthz"
 )
@@ -44,6 +52,11 @@ const (
 	IdentitiesAnnotationKey = "istio.cert-manager.io/identities"
 )
 
+// RootCAs provides the root CA bundle which is distributed to workloads.
+type RootCAs interface {
+	RootCA() []byte
+}
+
 // Server is the implementation of the istio CreateCertificate service
 type Server struct {
 	log logr.Logger
@@ -53,8 +66,36 @@ type Server struct {
 
 	maxDuration time.Duration
 
-	issuerRef   cmmeta.ObjectReference
-	preserveCRs bool
+	// fips, if true, only accepts FIPS-approved public keys in CSRs.
+	fips bool
+
+	issuerRef  cmmeta.ObjectReference
+	approveCRs bool
+
+	// migration is the optional router assigning requests to either the
+	// configured issuer or the migration target issuer. Certificates signed
+	// by the target issuer are only returned if trusted by rootCAs.
+	migration *migration.Router
+	rootCAs   RootCAs
+
+	// cleanup is used to delete created CertificateRequests once they are no
+	// longer needed.
+	cleanup *cleanup.Cleaner
+
+	// policy is the optional set of authorization policies that requests must
+	// satisfy. namespaces caches the labels of callers' namespaces, which are
+	// only looked up if a loaded policy references them. The cluster-wide
+	// Namespace informer is started the first time a policy needs namespace
+	// labels, and runs until namespacesStopCh is closed.
+	policy           *policy.Engine
+	namespaces       informers.SharedInformerFactory
+	namespacesMu     sync.Mutex
+	namespacesSynced bool
+	namespacesStopCh <-chan struct{}
+
+	// authz is the optional external authorization webhook consulted before
+	// signing.
+	authz *authz.Client
 
 	readyz *healthz.Check
 }
@@ -62,21 +103,81 @@ type Server struct {
 func New(log logr.Logger,
 	cmOptions *options.CertManagerOptions,
 	kubeOptions *options.KubeOptions,
+	tlsOptions *options.TLSOptions,
+	authzOptions *options.AuthzOptions,
+	rootCAs RootCAs,
+	cleanup *cleanup.Cleaner,
 	readyz *healthz.Check,
-) *Server {
-	return &Server{
+) (*Server, error) {
+	s := &Server{
 		log:         log.WithName("certificate-provider"),
 		client:      kubeOptions.CMClient,
 		auther:      kubeOptions.Auther,
 		maxDuration: cmOptions.MaximumClientCertificateDuration,
+		fips:        tlsOptions.FIPS,
 		issuerRef:   cmOptions.IssuerRef,
-		preserveCRs: cmOptions.PreserveCRs,
+		approveCRs:  cmOptions.ApproveCRs,
+		rootCAs:     rootCAs,
+		cleanup:     cleanup,
 		readyz:      readyz,
 	}
+
+	if cmOptions.MigrationIssuerRef != nil {
+		s.migration = migration.New(s.log, migration.Options{
+			Source:     cmOptions.IssuerRef,
+			Target:     *cmOptions.MigrationIssuerRef,
+			Percentage: cmOptions.MigrationPercentage,
+			Strategy:   migration.Strategy(cmOptions.MigrationStrategy),
+		})
+	}
+
+	if len(authzOptions.PolicyConfigMapName) > 0 {
+		engine, err := policy.New(s.log, kubeOptions.KubeClient,
+			authzOptions.PolicyConfigMapNamespace, authzOptions.PolicyConfigMapName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build policy engine: %s", err)
+		}
+		s.policy = engine
+		// The namespace informer is registered, but only started once a loaded
+		// policy references namespace labels
+		s.namespaces = informers.NewSharedInformerFactory(kubeOptions.KubeClient, 0)
+		s.namespaces.Core().V1().Namespaces().Informer()
+	}
+
+	if len(authzOptions.WebhookURL) > 0 {
+		client, err := authz.New(s.log, authz.Options{
+			URL:      authzOptions.WebhookURL,
+			CABundle: authzOptions.WebhookCABundle,
+			Timeout:  authzOptions.WebhookTimeout,
+			FailOpen: authzOptions.WebhookFailOpen,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to build authorization webhook client: %s", err)
+		}
+		s.authz = client
+	}
+
+	return s, nil
 }
 
 // Run is a blocking func that will run the client facing certificate service
 func (s *Server) Run(ctx context.Context, tlsConfig *tls.Config, listenAddress string) error {
+	// Load authorization policies, and the namespace labels they are
+	// evaluated with if referenced, before serving any requests
+	if s.policy != nil {
+		s.namespacesStopCh = ctx.Done()
+
+		if err := s.policy.Start(ctx); err != nil {
+			return err
+		}
+
+		if s.policy.NamespaceLabels() {
+			if _, err := s.namespaceLister(ctx); err != nil {
+				return err
+			}
+		}
+	}
+
 	// Setup the grpc server using the passed TLS config
 	creds := credentials.NewTLS(tlsConfig)
 	grpcServer := grpc.NewServer(grpc.Creds(creds))
@@ -109,7 +210,7 @@ func (s *Server) Run(ctx context.Context, tlsConfig *tls.Config, listenAddress s
 // and sign CSRs requests from istio clients.
 func (s *Server) CreateCertificate(ctx context.Context, icr *securityapi.IstioCertificateRequest) (*securityapi.IstioCertificateResponse, error) {
 	// authn incoming requests, and build concatenated identities for labelling
-	identities, ok := s.authRequest(ctx, []byte(icr.Csr))
+	identities, csr, ok := s.authRequest(ctx, []byte(icr.Csr))
 	if !ok {
 		return nil, status.Error(codes.Unauthenticated, "request authenticate failure")
 	}
@@ -121,11 +222,83 @@ func (s *Server) CreateCertificate(ctx context.Context, icr *securityapi.IstioCe
 		duration = s.maxDuration
 	}
 
+	// Ensure the request satisfies all authorization policies
+	if err := s.evaluatePolicy(ctx, s.log.WithValues("identities", identities), csr, duration); err != nil {
+		s.log.Error(err, "request denied", "identities", identities)
+		if denial, ok := err.(*policy.Denial); ok {
+			return nil, status.Error(codes.PermissionDenied, denial.Error())
+		}
+		return nil, status.Error(codes.Internal, "failed to evaluate authorization policies")
+	}
+
+	// Consult the external authorization webhook, which may lower the duration
+	if s.authz != nil {
+		decision, err := s.reviewRequest(ctx, csr, duration)
+		if err != nil {
+			s.log.Error(err, "failed to review request with authorization webhook", "identities", identities)
+			return nil, status.Error(codes.Unavailable, "failed to review request with authorization webhook")
+		}
+
+		if !decision.Allowed {
+			s.log.Error(errors.New(decision.Reason), "request denied by authorization webhook", "identities", identities)
+			return nil, status.Errorf(codes.PermissionDenied, "denied by authorization webhook: %s", decision.Reason)
+		}
+
+		duration = decision.Duration
+	}
+
+	// Use the migration target issuer if this request has been assigned to it
+	issuerRef := s.issuerRef
+	var namespace string
+	if s.migration != nil {
+		_, namespace, _ = callerIdentity(csr)
+		issuerRef = s.migration.IssuerFor(identities, namespace)
+	}
+
+	cr, err := s.signRequest(ctx, icr, identities, duration, issuerRef)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only return certificates of the migration target issuer which workloads
+	// trust, falling back to the source issuer otherwise
+	if s.migration != nil && s.migration.IsTarget(issuerRef) {
+		if err := migration.VerifyTrusted(cr.Status.Certificate, cr.Status.CA, s.rootCAs.RootCA()); err != nil {
+			issuerRef = s.migration.Fallback(identities, namespace, err)
+			cr, err = s.signRequest(ctx, icr, identities, duration, issuerRef)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Parse returned signed certificate
+	respCertChain := []string{string(cr.Status.Certificate)}
+	if len(cr.Status.CA) > 0 {
+		// If the request returns a CA certificate, add to the response chain
+		respCertChain = append(respCertChain, string(cr.Status.CA))
+	}
+
+	// Build client response object
+	response := &securityapi.IstioCertificateResponse{
+		CertChain: respCertChain,
+	}
+
+	// Return response to the client
+	return response, nil
+}
+
+// signRequest creates a CertificateRequest for the workload CSR, signed by
+// the given issuer, and waits for it to become ready. Returns a gRPC status
+// error on failure.
+func (s *Server) signRequest(ctx context.Context, icr *securityapi.IstioCertificateRequest,
+	identities string, duration time.Duration, issuerRef cmmeta.ObjectReference) (*cmapi.CertificateRequest, error) {
 	// Build cert-manager CertificateRequest based on the configured issuer
 	cr := &cmapi.CertificateRequest{
 		ObjectMeta: metav1.ObjectMeta{
 			// Random non-conflicted name
 			GenerateName: "istio-",
+			Labels:       util.CertificateRequestLabels(),
 			Annotations: map[string]string{
 				// Label identities to resource for auditing
 				IdentitiesAnnotationKey: identities,
@@ -139,7 +312,7 @@ func (s *Server) CreateCertificate(ctx context.Context, icr *securityapi.IstioCe
 			IsCA:      false,
 			Request:   []byte(icr.Csr),
 			Usages:    []cmapi.KeyUsage{cmapi.UsageClientAuth, cmapi.UsageServerAuth},
-			IssuerRef: s.issuerRef,
+			IssuerRef: issuerRef,
 		},
 	}
 
@@ -154,9 +327,17 @@ func (s *Server) CreateCertificate(ctx context.Context, icr *securityapi.IstioCe
 
 	// If we are not preserving created CertificateRequests which have either
 	// successully been signed or failed, delete in Kubernetes
-	defer func() {
-		go s.deleteOrPreserveCertificateRequest(log, cr)
-	}()
+	defer s.cleanup.Delete(cr.Name)
+
+	// Approve the CertificateRequest, recording the validation that has been
+	// done on this request
+	if s.approveCRs {
+		cr, err = util.ApproveCertificateRequest(ctx, s.client, cr, s.approvalMessage(identities, duration))
+		if err != nil {
+			log.Error(err, "failed to approve CertificateRequest")
+			return nil, status.Error(codes.Internal, "failed to sign certificate request")
+		}
+	}
 
 	// Wait for a minute for the CertificateRequest to become ready
 	cr, err = util.WaitForCertificateRequestReady(ctx, log, s.client, cr.Name, time.Minute)
@@ -164,39 +345,27 @@ func (s *Server) CreateCertificate(ctx context.Context, icr *securityapi.IstioCe
 		return nil, status.Error(codes.DeadlineExceeded, "timeout exceeded waiting for certificate request to be signed")
 	}
 
-	// Parse returned signed certificate
-	respCertChain := []string{string(cr.Status.Certificate)}
-	if len(cr.Status.CA) > 0 {
-		// If the request returns a CA certificate, add to the response chain
-		respCertChain = append(respCertChain, string(cr.Status.CA))
-	}
-
-	// Build client response object
-	response := &securityapi.IstioCertificateResponse{
-		CertChain: respCertChain,
-	}
-
-	log.V(3).Info("workload CertificateRequest signed", "identities", identities)
+	log.V(3).Info("workload CertificateRequest signed", "identities", identities, "issuer", issuerRef.Name)
 
-	// Return response to the client
-	return response, nil
+	return cr, nil
 }
 
-// deleteOrPreserveCertificateRequest will delete the given CertificateRequest
-// if server not configured to preserve. Exit early if server configured to
-// preserve, or passed CertificateRequest is nil.
-func (s *Server) deleteOrPreserveCertificateRequest(log logr.Logger, cr *cmapi.CertificateRequest) {
-	if s.preserveCRs || cr == nil {
-		return
+// approvalMessage returns the message of the Approved condition of workload
+// CertificateRequests, which records the validation done by the server.
+func (s *Server) approvalMessage(identities string, duration time.Duration) string {
+	checks := []string{
+		fmt.Sprintf("authenticated caller as %q", identities),
+		"verified CSR signature, identities and extensions",
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-
-	if err := s.client.Delete(ctx, cr.Name, metav1.DeleteOptions{}); err != nil {
-		log.Error(err, "failed to delete CertificateRequest")
-		return
+	if s.policy != nil {
+		checks = append(checks, "satisfied authorization policies")
+	}
+	if s.authz != nil {
+		checks = append(checks, "allowed by authorization webhook")
 	}
 
-	log.V(3).Info("deleted workload CertificateRequest")
+	checks = append(checks, fmt.Sprintf("duration limited to %s", duration))
+
+	return "istio-csr " + strings.Join(checks, ", ")
 }
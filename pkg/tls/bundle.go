@@ -0,0 +1,174 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+const (
+	// pruneInterval is the interval at which retired root CAs are pruned from
+	// the trust bundle.
+	pruneInterval = time.Minute
+)
+
+// retiredRootCA is a previous root CA certificate which is kept in the trust
+// bundle until its retirement time, so that certificates signed before a
+// rotation continue to be trusted.
+type retiredRootCA struct {
+	pem      []byte
+	retireAt time.Time
+}
+
+// splitRootCAs returns each certificate of the given root CA bundle as its own
+// PEM block. Blocks which fail to parse are ignored.
+func splitRootCAs(rootCA []byte) [][]byte {
+	if len(rootCA) == 0 {
+		return nil
+	}
+
+	certs, err := parseRootCAs(rootCA)
+	if err != nil {
+		return nil
+	}
+
+	var pems [][]byte
+	for _, cert := range certs {
+		pems = append(pems, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+
+	return pems
+}
+
+// containsPEM returns true if the list of PEM blocks contains the given block.
+func containsPEM(pems [][]byte, block []byte) bool {
+	for _, p := range pems {
+		if bytes.Equal(p, block) {
+			return true
+		}
+	}
+	return false
+}
+
+// rotateRootCA sets the current root CA. Certificates of the previous root CA
+// which are not present in the new root CA are retained in the trust bundle
+// until their retirement time. Must be called with the lock held.
+func (p *Provider) rotateRootCA(rootCA []byte) {
+	// The root CA persisted by a previous instance is retired on the first
+	// rotation, as if it had been the current root CA.
+	previous := p.rootCA
+	if previous == nil {
+		previous = p.persistedRootCA
+	}
+	p.persistedRootCA = nil
+
+	oldCerts := splitRootCAs(previous)
+	newCerts := splitRootCAs(rootCA)
+	retireAt := p.now().Add(p.rootCARetention)
+
+	// Drop any retired certificates which are again part of the current root
+	var retired []retiredRootCA
+	for _, r := range p.retiredRootCAs {
+		if !containsPEM(newCerts, r.pem) {
+			retired = append(retired, r)
+		}
+	}
+
+	if p.rootCARetention > 0 {
+		for _, cert := range oldCerts {
+			if containsPEM(newCerts, cert) {
+				continue
+			}
+
+			p.log.Info("retaining previous root CA in trust bundle",
+				"fingerprint", util.CertificateFingerprints(cert), "retire-at", retireAt)
+			retired = append(retired, retiredRootCA{pem: cert, retireAt: retireAt})
+		}
+	}
+
+	p.rootCA = rootCA
+	p.retiredRootCAs = retired
+}
+
+// trustBundle returns the current root CA, followed by all retired root CAs
+// which have not yet been pruned. Must be called with the lock held.
+func (p *Provider) trustBundle() []byte {
+	if len(p.retiredRootCAs) == 0 {
+		return p.rootCA
+	}
+
+	bundle := append([]byte{}, p.rootCA...)
+	for _, r := range p.retiredRootCAs {
+		if len(bundle) > 0 && bundle[len(bundle)-1] != '\n' {
+			bundle = append(bundle, '\n')
+		}
+		bundle = append(bundle, r.pem...)
+	}
+
+	return bundle
+}
+
+// pruneRetiredRootCAs removes retired root CAs from the trust bundle which
+// have passed their retirement time, updating the TLS config and notifying
+// subscribers.
+func (p *Provider) pruneRetiredRootCAs() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+
+	var retired []retiredRootCA
+	for _, r := range p.retiredRootCAs {
+		if now.Before(r.retireAt) {
+			retired = append(retired, r)
+			continue
+		}
+
+		p.log.Info("pruning retired root CA from trust bundle",
+			"fingerprint", util.CertificateFingerprints(r.pem), "retired-at", r.retireAt)
+	}
+
+	if len(retired) == len(p.retiredRootCAs) {
+		return
+	}
+
+	p.retiredRootCAs = retired
+
+	if p.tlsCert != nil {
+		tlsConfig, err := p.buildTLSConfig(p.tlsCert, p.trustBundle())
+		if err != nil {
+			p.log.Error(err, "failed to update TLS config with pruned trust bundle")
+			return
+		}
+		p.tlsConfig = tlsConfig
+	}
+
+	p.notifyRootCASubscribers()
+}
+
+// runRootCAPruner periodically prunes retired root CAs from the trust bundle,
+// until the context is cancelled.
+func (p *Provider) runRootCAPruner(ctx context.Context) {
+	wait.Until(p.pruneRetiredRootCAs, pruneInterval, ctx.Done())
+}
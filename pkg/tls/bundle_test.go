@@ -0,0 +1,114 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+func TestTrustBundleRotation(t *testing.T) {
+	rootA := gen.MustCertificate(t, gen.SetCertificateCommonName("root-a"), gen.SetCertificateIsCA(true))
+	rootB := gen.MustCertificate(t, gen.SetCertificateCommonName("root-b"), gen.SetCertificateIsCA(true))
+	rootC := gen.MustCertificate(t, gen.SetCertificateCommonName("root-c"), gen.SetCertificateIsCA(true))
+
+	now := time.Now()
+	p := &Provider{
+		log:             klogr.New(),
+		rootCARetention: time.Hour,
+		now:             func() time.Time { return now },
+	}
+	events := p.SubscribeRootCAEvents()
+
+	expBundle := func(exp ...[]byte) {
+		t.Helper()
+		if bundle := p.RootCA(); !bytes.Equal(bundle, bytes.Join(exp, nil)) {
+			t.Errorf("unexpected trust bundle, exp=%s got=%s", bytes.Join(exp, nil), bundle)
+		}
+	}
+
+	if err := p.setRootCA(rootA, "test"); err != nil {
+		t.Fatal(err)
+	}
+	expBundle(rootA)
+
+	// Rotating should retain the previous root
+	now = now.Add(time.Minute)
+	if err := p.setRootCA(rootB, "test"); err != nil {
+		t.Fatal(err)
+	}
+	expBundle(rootB, rootA)
+
+	// Rotating again should retain both previous roots
+	now = now.Add(time.Minute * 30)
+	if err := p.setRootCA(rootC, "test"); err != nil {
+		t.Fatal(err)
+	}
+	expBundle(rootC, rootA, rootB)
+
+	// Drain events
+	<-events
+
+	// Pruning before retirement should not change the bundle
+	p.pruneRetiredRootCAs()
+	expBundle(rootC, rootA, rootB)
+	select {
+	case <-events:
+		t.Error("unexpected root CA event when nothing was pruned")
+	default:
+	}
+
+	// root-a should be pruned after an hour since it was retired
+	now = now.Add(time.Minute * 30)
+	p.pruneRetiredRootCAs()
+	expBundle(rootC, rootB)
+	<-events
+
+	// Rotating back to a retired root should remove it from the retired roots
+	if err := p.setRootCA(rootB, "test"); err != nil {
+		t.Fatal(err)
+	}
+	expBundle(rootB, rootC)
+
+	// Everything should be pruned eventually
+	now = now.Add(time.Hour * 2)
+	p.pruneRetiredRootCAs()
+	expBundle(rootB)
+}
+
+func TestTrustBundleNoRetention(t *testing.T) {
+	rootA := gen.MustCertificate(t, gen.SetCertificateCommonName("root-a"), gen.SetCertificateIsCA(true))
+	rootB := gen.MustCertificate(t, gen.SetCertificateCommonName("root-b"), gen.SetCertificateIsCA(true))
+
+	p := &Provider{log: klogr.New(), now: time.Now}
+
+	if err := p.setRootCA(rootA, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.setRootCA(rootB, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if bundle := p.RootCA(); !bytes.Equal(bundle, rootB) {
+		t.Errorf("expected previous root to not be retained, got=%s", bundle)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr"
+	"istio.io/istio/pkg/spiffe"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/cert-manager/istio-csr/cmd/app/options"
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+const (
+	// Keys of the istio plug-in CA Secret.
+	caCertsCertKey      = "ca-cert.pem"
+	caCertsKeyKey       = "ca-key.pem"
+	caCertsRootCertKey  = "root-cert.pem"
+	caCertsCertChainKey = "cert-chain.pem"
+)
+
+// caCerts issues and renews an intermediate CA through the provider's issuer,
+// writing it to an istio plug-in CA Secret, for istiod's built-in CA to sign
+// workload certificates with. It is run by the leader only.
+type caCerts struct {
+	log        logr.Logger
+	provider   *Provider
+	kubeClient kubernetes.Interface
+
+	namespace    string
+	secretName   string
+	ttl          time.Duration
+	keyAlgorithm util.KeyAlgorithm
+
+	// rootCAEvents receives an event every time the root CA changes, to
+	// update root-cert.pem of the Secret.
+	rootCAEvents <-chan struct{}
+}
+
+// newCACerts returns the plug-in intermediate CA issuer, which is started as
+// a leader election runnable.
+func (p *Provider) newCACerts(kubeClient kubernetes.Interface, opts *options.TLSOptions) *caCerts {
+	return &caCerts{
+		log:          p.log.WithName("cacerts").WithValues("secret", opts.CACertsNamespace+"/"+opts.CACertsSecretName),
+		provider:     p,
+		kubeClient:   kubeClient,
+		namespace:    opts.CACertsNamespace,
+		secretName:   opts.CACertsSecretName,
+		ttl:          opts.CACertsDuration,
+		keyAlgorithm: opts.CACertsKeyAlgorithm,
+		rootCAEvents: p.SubscribeRootCAEvents(),
+	}
+}
+
+// Start issues the plug-in intermediate CA, and renews it in the same way as
+// the serving certificate, until the context is canceled.
+func (c *caCerts) Start(ctx context.Context) error {
+	c.log.Info("fetching initial plug-in CA certificate")
+	cert := mustFetch(ctx, c.log, c.fetchCertificate)
+	if cert == nil {
+		return nil
+	}
+
+	// Keep root-cert.pem of the Secret consistent with the distributed root
+	// CA, including changes made while another replica was the leader
+	go func() {
+		for {
+			if err := c.updateRootCA(ctx); err != nil {
+				c.log.Error(err, "failed to update plug-in CA secret root certificate")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.rootCAEvents:
+			}
+		}
+	}()
+
+	renewLoop(ctx, c.log, c.provider.renewalFraction, c.provider.now, cert, c.fetchCertificate)
+
+	return nil
+}
+
+// fetchCertificate requests a new intermediate CA certificate and private key,
+// and writes them to the Secret. If the Secret already holds a CA certificate
+// which is not yet due for renewal, for example issued before a restart or by
+// another replica, it is used instead.
+func (c *caCerts) fetchCertificate(ctx context.Context) (*x509.Certificate, error) {
+	if cert := c.loadSecret(ctx); cert != nil {
+		c.log.Info("using existing plug-in CA certificate")
+		return cert, nil
+	}
+
+	cr, pk, err := c.provider.requestCertificate(ctx, c.log, certificateOptions{
+		organization: spiffe.GetTrustDomain(),
+		isCA:         true,
+		duration:     c.ttl,
+		keyAlgorithm: c.keyAlgorithm,
+	}, "istiod-ca", "istio plug-in CA certificate")
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM, err := firstPEMBlock(cr.Status.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	// The chain is made up of the CA certificate and any intermediates
+	// returned by the issuer, followed by the issuer's root CA.
+	chain := cr.Status.Certificate
+	if len(cr.Status.CA) > 0 && !bytes.Contains(chain, cr.Status.CA) {
+		chain = append(append(bytes.TrimSuffix(chain, []byte("\n")), '\n'), cr.Status.CA...)
+	}
+
+	return cert, c.writeSecret(ctx, certPEM, pk, chain)
+}
+
+// loadSecret loads the CA certificate, private key and chain from the Secret,
+// returning the CA certificate if they are a valid CA key pair of the key
+// algorithm, FIPS-approved if FIPS is enabled, and the certificate is not yet
+// due for renewal. Otherwise returns nil.
+func (c *caCerts) loadSecret(ctx context.Context) *x509.Certificate {
+	secret, err := c.kubeClient.CoreV1().Secrets(c.namespace).Get(ctx, c.secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+
+	certPEM, pkPEM, chainPEM := secret.Data[caCertsCertKey], secret.Data[caCertsKeyKey], secret.Data[caCertsCertChainKey]
+	if len(chainPEM) == 0 {
+		return nil
+	}
+
+	tlsCert, err := tls.X509KeyPair(certPEM, pkPEM)
+	if err != nil {
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil || !cert.IsCA {
+		return nil
+	}
+
+	if c.provider.fips {
+		if err := util.ValidateFIPSPublicKey(cert.PublicKey); err != nil {
+			c.log.Info("reissuing plug-in CA certificate with a key which isn't FIPS-approved", "reason", err.Error())
+			return nil
+		}
+	}
+
+	if !util.PublicKeyMatchesAlgorithm(cert.PublicKey, c.keyAlgorithm) {
+		c.log.Info("reissuing plug-in CA certificate with a key of another algorithm", "key-algorithm", c.keyAlgorithm)
+		return nil
+	}
+
+	if dueForRenewal(cert, c.provider.renewalFraction, c.provider.now()) {
+		return nil
+	}
+
+	return cert
+}
+
+// writeSecret writes the CA certificate, private key and chain, and the root
+// CA, to the Secret, creating it if it doesn't exist.
+func (c *caCerts) writeSecret(ctx context.Context, cert, pk, chain []byte) error {
+	return writeSecret(ctx, c.log, c.kubeClient, c.namespace, c.secretName, corev1.SecretTypeOpaque, map[string][]byte{
+		caCertsCertKey:      cert,
+		caCertsKeyKey:       pk,
+		caCertsCertChainKey: chain,
+		caCertsRootCertKey:  c.provider.RootCA(),
+	})
+}
+
+// updateRootCA updates only root-cert.pem of the Secret, leaving the CA
+// certificate, private key and chain as they are.
+func (c *caCerts) updateRootCA(ctx context.Context) error {
+	return updateSecretKey(ctx, c.log, c.kubeClient, c.namespace, c.secretName, caCertsRootCertKey, c.provider.RootCA())
+}
+
+// parseCertificate parses the first PEM encoded certificate of the bundle.
+func parseCertificate(bundle []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(bundle)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("failed to decode certificate PEM")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// firstPEMBlock returns the first PEM encoded certificate of the bundle.
+func firstPEMBlock(bundle []byte) ([]byte, error) {
+	block, _ := pem.Decode(bundle)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("failed to decode certificate PEM")
+	}
+	return pem.EncodeToMemory(block), nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+func TestCACertsLoadSecret(t *testing.T) {
+	now := time.Now()
+	pk := gen.PrivateKey()
+
+	ca := gen.MustCertificate(t, gen.SetCertificateIsCA(true),
+		gen.SetCertificateNotBefore(now.Add(-time.Hour)), gen.SetCertificateNotAfter(now.Add(time.Hour*2)))
+	expCert, err := parseCertificate(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dueCA := gen.MustCertificate(t, gen.SetCertificateIsCA(true),
+		gen.SetCertificateNotBefore(now.Add(-time.Hour*2)), gen.SetCertificateNotAfter(now.Add(time.Hour)))
+	leaf := gen.MustCertificate(t,
+		gen.SetCertificateNotBefore(now.Add(-time.Hour)), gen.SetCertificateNotAfter(now.Add(time.Hour*2)))
+
+	secret := func(data map[string][]byte) []runtime.Object {
+		return []runtime.Object{&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "cacerts", Namespace: "istio-system"},
+			Type:       corev1.SecretTypeOpaque,
+			Data:       data,
+		}}
+	}
+
+	tests := map[string]struct {
+		existing     []runtime.Object
+		keyAlgorithm util.KeyAlgorithm
+		fips         bool
+		expLoad      bool
+	}{
+		"if secret doesn't exist, should not load": {
+			existing: nil,
+			expLoad:  false,
+		},
+		"if secret holds a valid CA not due for renewal, should load": {
+			existing: secret(map[string][]byte{"ca-cert.pem": ca, "ca-key.pem": pk, "cert-chain.pem": ca}),
+			expLoad:  true,
+		},
+		"if secret holds a valid CA with a FIPS-approved key and FIPS is enabled, should load": {
+			existing: secret(map[string][]byte{"ca-cert.pem": ca, "ca-key.pem": pk, "cert-chain.pem": ca}),
+			fips:     true,
+			expLoad:  true,
+		},
+		"if secret holds a valid CA with a key of another algorithm, should not load": {
+			existing:     secret(map[string][]byte{"ca-cert.pem": ca, "ca-key.pem": pk, "cert-chain.pem": ca}),
+			keyAlgorithm: util.KeyAlgorithmECDSAP256,
+			expLoad:      false,
+		},
+		"if secret holds a CA due for renewal, should not load": {
+			existing: secret(map[string][]byte{"ca-cert.pem": dueCA, "ca-key.pem": pk, "cert-chain.pem": dueCA}),
+			expLoad:  false,
+		},
+		"if secret holds a certificate which is not a CA, should not load": {
+			existing: secret(map[string][]byte{"ca-cert.pem": leaf, "ca-key.pem": pk, "cert-chain.pem": leaf}),
+			expLoad:  false,
+		},
+		"if secret has no certificate chain, should not load": {
+			existing: secret(map[string][]byte{"ca-cert.pem": ca, "ca-key.pem": pk}),
+			expLoad:  false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			keyAlgorithm := test.keyAlgorithm
+			if len(keyAlgorithm) == 0 {
+				keyAlgorithm = util.KeyAlgorithmRSA2048
+			}
+
+			c := &caCerts{
+				log:          klogr.New(),
+				provider:     &Provider{log: klogr.New(), now: func() time.Time { return now }, renewalFraction: 2.0 / 3.0, fips: test.fips},
+				kubeClient:   fake.NewSimpleClientset(test.existing...),
+				namespace:    "istio-system",
+				secretName:   "cacerts",
+				keyAlgorithm: keyAlgorithm,
+			}
+
+			cert := c.loadSecret(context.TODO())
+			if load := cert != nil; load != test.expLoad {
+				t.Fatalf("unexpected load, exp=%t got=%t", test.expLoad, load)
+			}
+
+			if test.expLoad && !bytes.Equal(cert.Raw, expCert.Raw) {
+				t.Errorf("expected CA certificate to be loaded from secret")
+			}
+		})
+	}
+}
+
+func TestCACertsWriteSecret(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset()
+
+	c := &caCerts{
+		log:        klogr.New(),
+		provider:   &Provider{log: klogr.New(), now: time.Now, rootCA: []byte("root")},
+		kubeClient: kubeClient,
+		namespace:  "istio-system",
+		secretName: "cacerts",
+	}
+
+	if err := c.writeSecret(context.TODO(), []byte("cert"), []byte("key"), []byte("chain")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another leader renewed the CA in the meantime, which must be kept
+	secret, err := kubeClient.CoreV1().Secrets("istio-system").Get(context.TODO(), "cacerts", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Data["ca-cert.pem"] = []byte("renewed-cert")
+	secret.Data["ca-key.pem"] = []byte("renewed-key")
+	if _, err := kubeClient.CoreV1().Secrets("istio-system").Update(context.TODO(), secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Root CA changed, only root-cert.pem should follow
+	c.provider.rootCA = []byte("new-root")
+	if err := c.updateRootCA(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err = kubeClient.CoreV1().Secrets("istio-system").Get(context.TODO(), "cacerts", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := map[string]string{
+		"ca-cert.pem":    "renewed-cert",
+		"ca-key.pem":     "renewed-key",
+		"cert-chain.pem": "chain",
+		"root-cert.pem":  "new-root",
+	}
+	if len(secret.Data) != len(exp) {
+		t.Errorf("unexpected secret keys, exp=%v got=%s", exp, secret.Data)
+	}
+	for k, v := range exp {
+		if string(secret.Data[k]) != v {
+			t.Errorf("unexpected secret data %q, exp=%q got=%q", k, v, secret.Data[k])
+		}
+	}
+	if secret.Type != corev1.SecretTypeOpaque {
+		t.Errorf("unexpected secret type, exp=%q got=%q", corev1.SecretTypeOpaque, secret.Type)
+	}
+}
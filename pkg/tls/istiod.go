@@ -0,0 +1,214 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-logr/logr"
+	"istio.io/istio/pkg/spiffe"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/cert-manager/istio-csr/cmd/app/options"
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+// istiodCertificate issues and renews istiod's serving certificate through
+// the provider's issuer, writing it to a kubernetes.io/tls Secret along with
+// the trust bundle. It is run by the leader only.
+type istiodCertificate struct {
+	log        logr.Logger
+	provider   *Provider
+	kubeClient kubernetes.Interface
+
+	namespace    string
+	secretName   string
+	dnsNames     []string
+	uris         []*url.URL
+	ttl          time.Duration
+	keyAlgorithm util.KeyAlgorithm
+
+	// rootCAEvents receives an event every time the root CA changes, to
+	// update the trust bundle of the Secret.
+	rootCAEvents <-chan struct{}
+}
+
+// istiodDNSNames returns the DNS names of the istiod service of every
+// revision. The default revision is served by the service itself, and other
+// revisions by the service suffixed with the revision name.
+func istiodDNSNames(service, namespace string, revisions []string) []string {
+	names := sets.NewString()
+	for _, revision := range append([]string{"default"}, revisions...) {
+		name := service
+		if len(revision) > 0 && revision != "default" {
+			name = service + "-" + revision
+		}
+		names.Insert(fmt.Sprintf("%s.%s.svc", name, namespace))
+	}
+	return names.List()
+}
+
+// istiodURI returns the SPIFFE identity of istiod's service account in the
+// trust domain, which istiod's serving certificate carries alongside its DNS
+// names.
+func istiodURI(trustDomain, namespace, serviceAccount string) *url.URL {
+	return &url.URL{
+		Scheme: "spiffe",
+		Host:   trustDomain,
+		Path:   fmt.Sprintf("/ns/%s/sa/%s", namespace, serviceAccount),
+	}
+}
+
+// newIstiodCertificate returns istiod's serving certificate issuer, which is
+// started as a leader election runnable.
+func (p *Provider) newIstiodCertificate(kubeClient kubernetes.Interface, opts *options.TLSOptions) *istiodCertificate {
+	return &istiodCertificate{
+		log:          p.log.WithName("istiod").WithValues("secret", opts.IstiodNamespace+"/"+opts.IstiodCertificateSecretName),
+		provider:     p,
+		kubeClient:   kubeClient,
+		namespace:    opts.IstiodNamespace,
+		secretName:   opts.IstiodCertificateSecretName,
+		dnsNames:     istiodDNSNames(opts.IstiodServiceName, opts.IstiodNamespace, opts.IstiodRevisions),
+		uris:         []*url.URL{istiodURI(spiffe.GetTrustDomain(), opts.IstiodNamespace, opts.IstiodServiceAccountName)},
+		ttl:          opts.IstiodCertificateDuration,
+		keyAlgorithm: opts.IstiodCertificateKeyAlgorithm,
+		rootCAEvents: p.SubscribeRootCAEvents(),
+	}
+}
+
+// Start issues istiod's serving certificate, and renews it in the same way as
+// the serving certificate, until the context is canceled.
+func (c *istiodCertificate) Start(ctx context.Context) error {
+	c.log.Info("fetching initial istiod serving certificate", "dns-names", c.dnsNames, "uris", c.uris)
+	cert := mustFetch(ctx, c.log, c.fetchCertificate)
+	if cert == nil {
+		return nil
+	}
+
+	// Keep the trust bundle of the Secret up to date with the root CA,
+	// including changes made while another replica was the leader
+	go func() {
+		for {
+			if err := c.updateRootCA(ctx); err != nil {
+				c.log.Error(err, "failed to update istiod secret trust bundle")
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.rootCAEvents:
+			}
+		}
+	}()
+
+	renewLoop(ctx, c.log, c.provider.renewalFraction, c.provider.now, cert, c.fetchCertificate)
+
+	return nil
+}
+
+// fetchCertificate requests a new istiod serving certificate and private key,
+// and writes them to the Secret. If the Secret already holds a certificate for
+// the DNS names and URIs which is not yet due for renewal, for example issued before a
+// restart or by another replica, it is used instead.
+func (c *istiodCertificate) fetchCertificate(ctx context.Context) (*x509.Certificate, error) {
+	if cert := c.loadSecret(ctx); cert != nil {
+		c.log.Info("using existing istiod serving certificate")
+		return cert, nil
+	}
+
+	cr, pk, err := c.provider.requestCertificate(ctx, c.log, certificateOptions{
+		dnsNames:     c.dnsNames,
+		uris:         c.uris,
+		duration:     c.ttl,
+		keyAlgorithm: c.keyAlgorithm,
+	}, "istiod", "istiod serving certificate")
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := parseCertificate(cr.Status.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	return cert, c.writeSecret(ctx, cr.Status.Certificate, pk)
+}
+
+// loadSecret loads the certificate and private key from the Secret, returning
+// the certificate if they are valid for the DNS names and URIs, and the
+// certificate is not yet due for renewal. Otherwise returns nil.
+func (c *istiodCertificate) loadSecret(ctx context.Context) *x509.Certificate {
+	secret, err := c.kubeClient.CoreV1().Secrets(c.namespace).Get(ctx, c.secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+
+	certPEM, pkPEM := secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey]
+	tlsCert, err := tls.X509KeyPair(certPEM, pkPEM)
+	if err != nil {
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+
+	if !sets.NewString(cert.DNSNames...).HasAll(c.dnsNames...) {
+		return nil
+	}
+
+	uris := sets.NewString()
+	for _, uri := range cert.URIs {
+		uris.Insert(uri.String())
+	}
+	for _, uri := range c.uris {
+		if !uris.Has(uri.String()) {
+			return nil
+		}
+	}
+
+	if dueForRenewal(cert, c.provider.renewalFraction, c.provider.now()) {
+		return nil
+	}
+
+	return cert
+}
+
+// writeSecret writes the certificate and private key, and the trust bundle,
+// to the Secret, creating it if it doesn't exist.
+func (c *istiodCertificate) writeSecret(ctx context.Context, cert, pk []byte) error {
+	return writeSecret(ctx, c.log, c.kubeClient, c.namespace, c.secretName, corev1.SecretTypeTLS, map[string][]byte{
+		corev1.TLSCertKey:              cert,
+		corev1.TLSPrivateKeyKey:        pk,
+		corev1.ServiceAccountRootCAKey: c.provider.RootCA(),
+	})
+}
+
+// updateRootCA updates only the trust bundle of the Secret, leaving the
+// certificate and private key as they are.
+func (c *istiodCertificate) updateRootCA(ctx context.Context) error {
+	return updateSecretKey(ctx, c.log, c.kubeClient, c.namespace, c.secretName, corev1.ServiceAccountRootCAKey, c.provider.RootCA())
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+func TestIstiodDNSNames(t *testing.T) {
+	tests := map[string]struct {
+		revisions []string
+		exp       []string
+	}{
+		"if no revisions, should return the istiod service": {
+			revisions: nil,
+			exp:       []string{"istiod.istio-system.svc"},
+		},
+		"if default revision, should return the istiod service once": {
+			revisions: []string{"default", ""},
+			exp:       []string{"istiod.istio-system.svc"},
+		},
+		"if revisions, should return the istiod service and a service per revision": {
+			revisions: []string{"default", "canary", "1-10"},
+			exp: []string{
+				"istiod-1-10.istio-system.svc",
+				"istiod-canary.istio-system.svc",
+				"istiod.istio-system.svc",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := istiodDNSNames("istiod", "istio-system", test.revisions)
+			if !reflect.DeepEqual(got, test.exp) {
+				t.Errorf("unexpected DNS names, exp=%v got=%v", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestIstiodWriteSecret(t *testing.T) {
+	tests := map[string]struct {
+		existing []runtime.Object
+		expErr   bool
+		expData  map[string][]byte
+	}{
+		"if secret doesn't exist, should create it": {
+			existing: nil,
+			expErr:   false,
+			expData: map[string][]byte{
+				"tls.crt": []byte("cert"),
+				"tls.key": []byte("key"),
+				"ca.crt":  []byte("root"),
+			},
+		},
+		"if secret exists, should update it and preserve other keys": {
+			existing: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "istiod-tls", Namespace: "istio-system"},
+				Type:       corev1.SecretTypeTLS,
+				Data: map[string][]byte{
+					"tls.crt": []byte("old-cert"),
+					"tls.key": []byte("old-key"),
+					"ca.crt":  []byte("old-root"),
+					"other":   []byte("other"),
+				},
+			}},
+			expErr: false,
+			expData: map[string][]byte{
+				"tls.crt": []byte("cert"),
+				"tls.key": []byte("key"),
+				"ca.crt":  []byte("root"),
+				"other":   []byte("other"),
+			},
+		},
+		"if secret exists with a different type, should error and not update it": {
+			existing: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "istiod-tls", Namespace: "istio-system"},
+				Type:       corev1.SecretTypeOpaque,
+				Data:       map[string][]byte{"other": []byte("other")},
+			}},
+			expErr:  true,
+			expData: map[string][]byte{"other": []byte("other")},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset(test.existing...)
+
+			c := &istiodCertificate{
+				log:        klogr.New(),
+				provider:   &Provider{log: klogr.New(), now: time.Now, rootCA: []byte("root")},
+				kubeClient: kubeClient,
+				namespace:  "istio-system",
+				secretName: "istiod-tls",
+			}
+
+			err := c.writeSecret(context.TODO(), []byte("cert"), []byte("key"))
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			secret, err := kubeClient.CoreV1().Secrets("istio-system").Get(context.TODO(), "istiod-tls", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(secret.Data, test.expData) {
+				t.Errorf("unexpected secret data, exp=%s got=%s", test.expData, secret.Data)
+			}
+
+			if !test.expErr && secret.Labels[util.ManagedByLabelKey] != util.ManagedByLabelValue {
+				t.Errorf("expected secret to have managed-by label, got=%v", secret.Labels)
+			}
+		})
+	}
+}
+
+func TestIstiodUpdateRootCA(t *testing.T) {
+	tests := map[string]struct {
+		existing []runtime.Object
+		expData  map[string][]byte
+	}{
+		"if secret doesn't exist, should not create it": {
+			existing: nil,
+			expData:  nil,
+		},
+		"if secret exists, should update only ca.crt": {
+			existing: []runtime.Object{&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "istiod-tls", Namespace: "istio-system"},
+				Type:       corev1.SecretTypeTLS,
+				Data: map[string][]byte{
+					"tls.crt": []byte("other-cert"),
+					"tls.key": []byte("other-key"),
+					"ca.crt":  []byte("old-root"),
+				},
+			}},
+			expData: map[string][]byte{
+				"tls.crt": []byte("other-cert"),
+				"tls.key": []byte("other-key"),
+				"ca.crt":  []byte("root"),
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset(test.existing...)
+
+			c := &istiodCertificate{
+				log:        klogr.New(),
+				provider:   &Provider{log: klogr.New(), now: time.Now, rootCA: []byte("root")},
+				kubeClient: kubeClient,
+				namespace:  "istio-system",
+				secretName: "istiod-tls",
+			}
+
+			if err := c.updateRootCA(context.TODO()); err != nil {
+				t.Fatal(err)
+			}
+
+			secret, err := kubeClient.CoreV1().Secrets("istio-system").Get(context.TODO(), "istiod-tls", metav1.GetOptions{})
+			if test.expData == nil {
+				if !apierrors.IsNotFound(err) {
+					t.Errorf("expected secret to not exist, got=%v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(secret.Data, test.expData) {
+				t.Errorf("unexpected secret data, exp=%s got=%s", test.expData, secret.Data)
+			}
+		})
+	}
+}
+
+func TestIstiodURI(t *testing.T) {
+	got := istiodURI("cluster.local", "istio-system", "istiod-service-account").String()
+	if exp := "spiffe://cluster.local/ns/istio-system/sa/istiod-service-account"; got != exp {
+		t.Errorf("unexpected URI, exp=%s got=%s", exp, got)
+	}
+}
+
+func TestIstiodLoadSecret(t *testing.T) {
+	const istiodSPIFFE = "spiffe://cluster.local/ns/istio-system/sa/istiod-service-account"
+
+	tests := map[string]struct {
+		dnsNames []string
+		uris     []string
+		expCert  bool
+	}{
+		"if certificate has the DNS names and URI, should use it": {
+			dnsNames: []string{"istiod.istio-system.svc"},
+			uris:     []string{istiodSPIFFE},
+			expCert:  true,
+		},
+		"if certificate is missing the URI, should reissue": {
+			dnsNames: []string{"istiod.istio-system.svc"},
+			uris:     nil,
+			expCert:  false,
+		},
+		"if certificate has a different URI, should reissue": {
+			dnsNames: []string{"istiod.istio-system.svc"},
+			uris:     []string{"spiffe://cluster.local/ns/istio-system/sa/other"},
+			expCert:  false,
+		},
+		"if certificate is missing a DNS name, should reissue": {
+			dnsNames: []string{"istiod-canary.istio-system.svc"},
+			uris:     []string{istiodSPIFFE},
+			expCert:  false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			certPEM := gen.MustCertificate(t,
+				gen.SetCertificateDNSNames(test.dnsNames),
+				gen.SetCertificateURIs(test.uris),
+			)
+
+			kubeClient := fake.NewSimpleClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "istiod-tls", Namespace: "istio-system"},
+				Type:       corev1.SecretTypeTLS,
+				Data: map[string][]byte{
+					"tls.crt": certPEM,
+					"tls.key": gen.PrivateKey(),
+				},
+			})
+
+			c := &istiodCertificate{
+				log:        klogr.New(),
+				provider:   &Provider{log: klogr.New(), now: time.Now, renewalFraction: 0.66},
+				kubeClient: kubeClient,
+				namespace:  "istio-system",
+				secretName: "istiod-tls",
+				dnsNames:   []string{"istiod.istio-system.svc"},
+				uris:       []*url.URL{istiodURI("cluster.local", "istio-system", "istiod-service-account")},
+			}
+
+			if cert := c.loadSecret(context.TODO()); (cert != nil) != test.expCert {
+				t.Errorf("unexpected certificate, exp=%t got=%v", test.expCert, cert)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"context"
+	"crypto/x509"
+	"math"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// fetchBackoff is the backoff between attempts to fetch a certificate after
+// a failure. The delay doubles on every failure up to the cap, and is
+// jittered so that replicas don't retry in lockstep.
+var fetchBackoff = wait.Backoff{
+	Duration: time.Second * 2,
+	Factor:   2,
+	Jitter:   0.5,
+	Steps:    math.MaxInt32,
+	Cap:      time.Minute * 5,
+}
+
+// fetchFunc fetches a new certificate, returning the issued certificate.
+type fetchFunc func(context.Context) (*x509.Certificate, error)
+
+// renewalTime returns the time at which the fraction of the certificate's
+// duration, from its NotBefore to NotAfter, has elapsed.
+func renewalTime(cert *x509.Certificate, fraction float64) time.Time {
+	duration := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(time.Duration(float64(duration) * fraction))
+}
+
+// dueForRenewal returns true if the renewal time of the certificate has been
+// reached at the given time.
+func dueForRenewal(cert *x509.Certificate, fraction float64, now time.Time) bool {
+	return !now.Before(renewalTime(cert, fraction))
+}
+
+// mustFetch is a blocking func that will call fetch until it succeeds, backing
+// off exponentially with jitter between failures. Returns the fetched
+// certificate, or nil if the context has been canceled.
+func mustFetch(ctx context.Context, log logr.Logger, fetch fetchFunc) *x509.Certificate {
+	backoff := fetchBackoff
+
+	for {
+		// Fetch a new certificate, signed by cert-manager.
+		cert, err := fetch(ctx)
+		if err == nil {
+			log.Info("fetched new certificate", "not-after", cert.NotAfter)
+			return cert
+		}
+
+		delay := backoff.Step()
+		log.Error(err, "failed to fetch new certificate, retrying", "backoff", delay)
+
+		// Cancel if the context has been canceled. Retry after the backoff.
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// renewLoop is a blocking func that will renew the certificate once the
+// fraction of its issued duration has elapsed, and then every renewed
+// certificate in the same way, until the context is canceled.
+func renewLoop(ctx context.Context, log logr.Logger, fraction float64, now func() time.Time,
+	cert *x509.Certificate, fetch fetchFunc) {
+	for cert != nil {
+		// Create a new timer every loop, from the issued certificate's validity
+		renewal := renewalTime(cert, fraction)
+		timer := time.NewTimer(renewal.Sub(now()))
+
+		log.Info("scheduled certificate renewal", "renewal-time", renewal, "not-after", cert.NotAfter)
+
+		select {
+		case <-ctx.Done():
+			log.Info("closing renewal", "ctx", ctx.Err())
+			timer.Stop()
+			return
+		case <-timer.C:
+			// Ensure we stop the timer after every tick to release resources
+			timer.Stop()
+		}
+
+		// Renew certificate at every tick
+		log.Info("renewing certificate")
+		cert = mustFetch(ctx, log, fetch)
+	}
+}
+
+// checkReadiness sets the provider ready if it has a serving certificate which
+// has not yet entered the danger window before its expiry. Returns whether it
+// is ready, and the duration until the serving certificate enters the danger
+// window.
+func (p *Provider) checkReadiness() (bool, time.Duration) {
+	p.mu.RLock()
+	var notAfter time.Time
+	if p.tlsCert != nil && p.tlsCert.Leaf != nil {
+		notAfter = p.tlsCert.Leaf.NotAfter
+	}
+	p.mu.RUnlock()
+
+	until := notAfter.Add(-p.expiryDangerWindow).Sub(p.now())
+	ready := !notAfter.IsZero() && until > 0
+
+	if p.readyz != nil {
+		p.readyz.Set(ready)
+	}
+
+	return ready, until
+}
+
+// runReadiness keeps the readiness check up to date with the expiry of the
+// serving certificate, re-checking when the serving certificate changes or
+// enters the danger window, until the context is canceled. The provider is
+// then set not ready.
+func (p *Provider) runReadiness(ctx context.Context) {
+	var wasReady bool
+
+	for {
+		ready, until := p.checkReadiness()
+		if wasReady && !ready {
+			p.log.Error(nil, "serving certificate is within the expiry danger window, marking not ready",
+				"danger-window", p.expiryDangerWindow)
+		}
+		if !wasReady && ready {
+			p.log.Info("serving certificate is outside of the expiry danger window, marking ready")
+		}
+		wasReady = ready
+
+		// Once within the danger window, only a new serving certificate can
+		// change readiness.
+		var (
+			timer        *time.Timer
+			dangerWindow <-chan time.Time
+		)
+		if ready {
+			timer = time.NewTimer(until)
+			dangerWindow = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if p.readyz != nil {
+				p.readyz.Set(false)
+			}
+		case <-p.servingCertificateEvents:
+		case <-dangerWindow:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
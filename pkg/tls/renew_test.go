@@ -0,0 +1,192 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/pkg/util/healthz"
+)
+
+func TestRenewalTime(t *testing.T) {
+	notBefore := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		duration time.Duration
+		fraction float64
+		exp      time.Time
+	}{
+		"if 2/3 of a 24h certificate, should renew after 16h": {
+			duration: time.Hour * 24,
+			fraction: 2.0 / 3.0,
+			exp:      notBefore.Add(time.Hour * 16),
+		},
+		"if 2/3 of a certificate clamped to 1h by the issuer, should renew after 40m": {
+			duration: time.Hour,
+			fraction: 2.0 / 3.0,
+			exp:      notBefore.Add(time.Minute * 40),
+		},
+		"if 1/2 of a 24h certificate, should renew after 12h": {
+			duration: time.Hour * 24,
+			fraction: 0.5,
+			exp:      notBefore.Add(time.Hour * 12),
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(test.duration)}
+			if got := renewalTime(cert, test.fraction); !got.Equal(test.exp) {
+				t.Errorf("unexpected renewal time, exp=%s got=%s", test.exp, got)
+			}
+		})
+	}
+}
+
+func TestMustFetch(t *testing.T) {
+	defer func(backoff wait.Backoff) { fetchBackoff = backoff }(fetchBackoff)
+	fetchBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 2, Jitter: 0.5, Steps: math.MaxInt32, Cap: time.Millisecond * 4}
+
+	t.Run("if fetch fails, should retry until it succeeds", func(t *testing.T) {
+		expCert := &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}
+
+		var attempts int
+		cert := mustFetch(context.TODO(), klogr.New(), func(context.Context) (*x509.Certificate, error) {
+			attempts++
+			if attempts < 4 {
+				return nil, errors.New("failed")
+			}
+			return expCert, nil
+		})
+
+		if cert != expCert {
+			t.Errorf("unexpected certificate, exp=%v got=%v", expCert, cert)
+		}
+		if attempts != 4 {
+			t.Errorf("unexpected number of attempts, exp=4 got=%d", attempts)
+		}
+	})
+
+	t.Run("if context is canceled while failing, should return nil", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		cert := mustFetch(ctx, klogr.New(), func(context.Context) (*x509.Certificate, error) {
+			cancel()
+			return nil, errors.New("failed")
+		})
+
+		if cert != nil {
+			t.Errorf("expected nil certificate, got=%v", cert)
+		}
+	})
+}
+
+func TestRenewLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Now()
+
+	// Issuer clamped the certificate, so that it is already due for renewal
+	// at 2/3 of its duration, although far from 2/3 of the requested duration.
+	clamped := &x509.Certificate{NotBefore: now.Add(-time.Minute * 50), NotAfter: now.Add(time.Minute * 10)}
+	renewed := &x509.Certificate{NotBefore: now, NotAfter: now.Add(time.Hour * 24)}
+
+	fetched := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		renewLoop(ctx, klogr.New(), 2.0/3.0, time.Now, clamped, func(context.Context) (*x509.Certificate, error) {
+			close(fetched)
+			return renewed, nil
+		})
+		close(done)
+	}()
+
+	select {
+	case <-fetched:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected clamped certificate to be renewed")
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected renewal loop to return after context canceled")
+	}
+}
+
+func TestCheckReadiness(t *testing.T) {
+	now := time.Now()
+
+	tests := map[string]struct {
+		notAfter time.Time
+		expReady bool
+	}{
+		"if no serving certificate, should not be ready": {
+			expReady: false,
+		},
+		"if serving certificate expires after the danger window, should be ready": {
+			notAfter: now.Add(time.Hour),
+			expReady: true,
+		},
+		"if serving certificate expires within the danger window, should not be ready": {
+			notAfter: now.Add(time.Minute * 4),
+			expReady: false,
+		},
+		"if serving certificate has expired, should not be ready": {
+			notAfter: now.Add(-time.Minute),
+			expReady: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := healthz.New()
+			p := &Provider{
+				log:                klogr.New(),
+				now:                func() time.Time { return now },
+				expiryDangerWindow: time.Minute * 5,
+				readyz:             h.Register(),
+			}
+			if !test.notAfter.IsZero() {
+				p.tlsCert = &tls.Certificate{Leaf: &x509.Certificate{NotAfter: test.notAfter}}
+			}
+
+			ready, until := p.checkReadiness()
+			if ready != test.expReady {
+				t.Errorf("unexpected readiness, exp=%t got=%t", test.expReady, ready)
+			}
+			if err := h.Check(nil); (err == nil) != test.expReady {
+				t.Errorf("unexpected readiness check, exp=%t got=%v", test.expReady, err)
+			}
+			if ready && until != test.notAfter.Add(-time.Minute*5).Sub(now) {
+				t.Errorf("unexpected duration until danger window, got=%s", until)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+const (
+	// Keys of the root CA retention ConfigMap.
+	retentionRootCAKey  = "root-ca.pem"
+	retentionRetiredKey = "retired-root-cas.json"
+)
+
+// retiredRootCAJSON is the persisted form of a retired root CA.
+type retiredRootCAJSON struct {
+	PEM      string    `json:"pem"`
+	RetireAt time.Time `json:"retireAt"`
+}
+
+// rootCARetentionStore persists the current root CA and retired root CAs in a
+// ConfigMap, so that retired root CAs remain in the trust bundle across
+// restarts and leader changes until their retirement time.
+type rootCARetentionStore struct {
+	log        logr.Logger
+	kubeClient kubernetes.Interface
+
+	namespace string
+	name      string
+}
+
+// load returns the persisted root CA and retired root CAs which have not yet
+// passed their retirement time. Returns nothing if the ConfigMap doesn't
+// exist.
+func (s *rootCARetentionStore) load(ctx context.Context, now time.Time) ([]byte, []retiredRootCA, error) {
+	cm, err := s.kubeClient.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get root CA retention configmap %s/%s: %s", s.namespace, s.name, err)
+	}
+
+	retired, err := decodeRetiredRootCAs(cm.Data[retentionRetiredKey])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid root CA retention configmap %s/%s: %s", s.namespace, s.name, err)
+	}
+
+	var rootCA []byte
+	if data := cm.Data[retentionRootCAKey]; len(data) > 0 {
+		rootCA = []byte(data)
+	}
+
+	return rootCA, pruneRetired(rootCA, retired, now), nil
+}
+
+// write persists the root CA and retired root CAs, merged with the retired
+// root CAs already persisted by other replicas. Retired root CAs which are
+// part of the root CA, or have passed their retirement time, are dropped.
+func (s *rootCARetentionStore) write(ctx context.Context, rootCA []byte, retired []retiredRootCA, now time.Time) error {
+	cm, err := s.kubeClient.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to get root CA retention configmap %s/%s: %s", s.namespace, s.name, err)
+	}
+
+	exists := err == nil
+	if !exists {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: s.namespace,
+				Name:      s.name,
+			},
+		}
+	}
+
+	// Keep the later retirement time of root CAs known to both
+	if persisted, err := decodeRetiredRootCAs(cm.Data[retentionRetiredKey]); err == nil {
+		retired = mergeRetired(retired, persisted)
+	} else {
+		s.log.Error(err, "overwriting invalid retired root CAs")
+	}
+
+	data, err := encodeRetiredRootCAs(pruneRetired(rootCA, retired, now))
+	if err != nil {
+		return err
+	}
+
+	expData := map[string]string{
+		retentionRootCAKey:  string(rootCA),
+		retentionRetiredKey: data,
+	}
+	if exists && reflect.DeepEqual(cm.Data, expData) {
+		return nil
+	}
+
+	cm = cm.DeepCopy()
+	cm.Data = expData
+	if cm.Labels == nil {
+		cm.Labels = make(map[string]string)
+	}
+	cm.Labels[util.ManagedByLabelKey] = util.ManagedByLabelValue
+
+	if exists {
+		_, err = s.kubeClient.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+	} else {
+		_, err = s.kubeClient.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write root CA retention configmap %s/%s: %s", s.namespace, s.name, err)
+	}
+
+	s.log.V(2).Info("persisted retired root CAs", "count", len(retired))
+
+	return nil
+}
+
+// loadRetainedRootCAs seeds the retired root CAs from the retention store, and
+// the root CA to retire on the first rotation.
+func (p *Provider) loadRetainedRootCAs(ctx context.Context) error {
+	rootCA, retired, err := p.retention.load(ctx, p.now())
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.persistedRootCA = rootCA
+	p.retiredRootCAs = retired
+
+	if len(retired) > 0 {
+		p.log.Info("loaded retired root CAs", "count", len(retired))
+	}
+
+	return nil
+}
+
+// runRootCARetention persists the root CA and retired root CAs every time they
+// change, retrying with backoff on failure, until the context is canceled.
+func (p *Provider) runRootCARetention(ctx context.Context, events <-chan struct{}) {
+	for {
+		backoff := fetchBackoff
+		for {
+			p.mu.RLock()
+			rootCA := p.rootCA
+			retired := append([]retiredRootCA{}, p.retiredRootCAs...)
+			p.mu.RUnlock()
+
+			if len(rootCA) == 0 {
+				break
+			}
+
+			err := p.retention.write(ctx, rootCA, retired, p.now())
+			if err == nil {
+				break
+			}
+
+			delay := backoff.Step()
+			p.log.Error(err, "failed to persist retired root CAs, retrying", "backoff", delay)
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+		}
+	}
+}
+
+// mergeRetired returns the union of both lists of retired root CAs. Root CAs
+// in both lists are retired at the later of their retirement times.
+func mergeRetired(a, b []retiredRootCA) []retiredRootCA {
+	merged := append([]retiredRootCA{}, a...)
+	for _, r := range b {
+		found := false
+		for i := range merged {
+			if bytes.Equal(merged[i].pem, r.pem) {
+				found = true
+				if r.retireAt.After(merged[i].retireAt) {
+					merged[i].retireAt = r.retireAt
+				}
+			}
+		}
+		if !found {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// pruneRetired drops retired root CAs which are part of the root CA, or have
+// passed their retirement time.
+func pruneRetired(rootCA []byte, retired []retiredRootCA, now time.Time) []retiredRootCA {
+	current := splitRootCAs(rootCA)
+
+	var pruned []retiredRootCA
+	for _, r := range retired {
+		if containsPEM(current, r.pem) || !now.Before(r.retireAt) {
+			continue
+		}
+		pruned = append(pruned, r)
+	}
+	return pruned
+}
+
+// encodeRetiredRootCAs encodes the retired root CAs, ordered by retirement
+// time, to JSON.
+func encodeRetiredRootCAs(retired []retiredRootCA) (string, error) {
+	list := make([]retiredRootCAJSON, 0, len(retired))
+	for _, r := range retired {
+		list = append(list, retiredRootCAJSON{PEM: string(r.pem), RetireAt: r.retireAt.UTC()})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].RetireAt.Before(list[j].RetireAt)
+	})
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode retired root CAs: %s", err)
+	}
+	return string(data), nil
+}
+
+// decodeRetiredRootCAs decodes the JSON encoded retired root CAs.
+func decodeRetiredRootCAs(data string) ([]retiredRootCA, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var list []retiredRootCAJSON
+	if err := json.Unmarshal([]byte(data), &list); err != nil {
+		return nil, fmt.Errorf("failed to decode retired root CAs: %s", err)
+	}
+
+	var retired []retiredRootCA
+	for _, r := range list {
+		retired = append(retired, retiredRootCA{pem: []byte(r.PEM), retireAt: r.RetireAt})
+	}
+	return retired, nil
+}
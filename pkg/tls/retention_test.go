@@ -0,0 +1,166 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+func TestRootCARetentionAcrossProviders(t *testing.T) {
+	rootA := gen.MustCertificate(t, gen.SetCertificateCommonName("root-a"), gen.SetCertificateIsCA(true))
+	rootB := gen.MustCertificate(t, gen.SetCertificateCommonName("root-b"), gen.SetCertificateIsCA(true))
+	rootC := gen.MustCertificate(t, gen.SetCertificateCommonName("root-c"), gen.SetCertificateIsCA(true))
+
+	now := time.Now()
+	kubeClient := fake.NewSimpleClientset()
+
+	newProvider := func() *Provider {
+		return &Provider{
+			log:             klogr.New(),
+			rootCARetention: time.Hour,
+			now:             func() time.Time { return now },
+			retention:       newTestRetentionStore(kubeClient),
+		}
+	}
+
+	persist := func(p *Provider) {
+		t.Helper()
+		p.mu.RLock()
+		rootCA, retired := p.rootCA, p.retiredRootCAs
+		p.mu.RUnlock()
+		if err := p.retention.write(context.TODO(), rootCA, retired, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expBundle := func(p *Provider, exp ...[]byte) {
+		t.Helper()
+		if bundle := p.RootCA(); !bytes.Equal(bundle, bytes.Join(exp, nil)) {
+			t.Errorf("unexpected trust bundle, exp=%s got=%s", bytes.Join(exp, nil), bundle)
+		}
+	}
+
+	// First provider rotates from root-a to root-b, retaining root-a
+	first := newProvider()
+	if err := first.loadRetainedRootCAs(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.setRootCA(rootA, "test"); err != nil {
+		t.Fatal(err)
+	}
+	persist(first)
+	if err := first.setRootCA(rootB, "test"); err != nil {
+		t.Fatal(err)
+	}
+	persist(first)
+	expBundle(first, rootB, rootA)
+
+	// A second provider, such as after a restart or leader change, should
+	// still serve the retired root-a alongside root-b
+	now = now.Add(time.Minute * 10)
+	second := newProvider()
+	if err := second.loadRetainedRootCAs(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.setRootCA(rootB, "test"); err != nil {
+		t.Fatal(err)
+	}
+	expBundle(second, rootB, rootA)
+
+	// root-a should still be pruned at its original retirement time
+	now = now.Add(time.Minute * 50)
+	second.pruneRetiredRootCAs()
+	expBundle(second, rootB)
+
+	// A third provider starting with a root rotated while no instance was
+	// running should retire the persisted root-b
+	persist(second)
+	third := newProvider()
+	if err := third.loadRetainedRootCAs(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := third.setRootCA(rootC, "test"); err != nil {
+		t.Fatal(err)
+	}
+	expBundle(third, rootC, rootB)
+}
+
+func TestRootCARetentionWriteMerges(t *testing.T) {
+	rootA := gen.MustCertificate(t, gen.SetCertificateCommonName("root-a"), gen.SetCertificateIsCA(true))
+	rootB := gen.MustCertificate(t, gen.SetCertificateCommonName("root-b"), gen.SetCertificateIsCA(true))
+	rootC := gen.MustCertificate(t, gen.SetCertificateCommonName("root-c"), gen.SetCertificateIsCA(true))
+
+	now := time.Now()
+	store := newTestRetentionStore(fake.NewSimpleClientset())
+
+	// One replica retired root-a, another root-b and root-a later
+	if err := store.write(context.TODO(), rootC, []retiredRootCA{
+		{pem: rootA, retireAt: now.Add(time.Hour)},
+	}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.write(context.TODO(), rootC, []retiredRootCA{
+		{pem: rootA, retireAt: now.Add(time.Hour * 2)},
+		{pem: rootB, retireAt: now.Add(time.Minute)},
+	}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	rootCA, retired, err := store.load(context.TODO(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rootCA, rootC) {
+		t.Errorf("unexpected persisted root CA, exp=%s got=%s", rootC, rootCA)
+	}
+	if len(retired) != 2 {
+		t.Fatalf("expected 2 retired root CAs, got=%d", len(retired))
+	}
+	if !bytes.Equal(retired[0].pem, rootB) || !bytes.Equal(retired[1].pem, rootA) {
+		t.Errorf("unexpected retired root CAs order, exp root-b then root-a")
+	}
+	if !retired[1].retireAt.Equal(now.Add(time.Hour * 2)) {
+		t.Errorf("expected later retirement time of root-a to be kept, got=%s", retired[1].retireAt)
+	}
+
+	// Expired retired root CAs should not be loaded
+	_, retired, err = store.load(context.TODO(), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(retired) != 1 || !bytes.Equal(retired[0].pem, rootA) {
+		t.Errorf("expected only root-a to remain retired, got=%d", len(retired))
+	}
+}
+
+func newTestRetentionStore(kubeClient kubernetes.Interface) *rootCARetentionStore {
+	return &rootCARetentionStore{
+		log:        klogr.New(),
+		kubeClient: kubeClient,
+		namespace:  "istio-system",
+		name:       "cert-manager-istio-csr-root-ca-retention",
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// parseRootCAs parses a PEM encoded root CA bundle. The bundle must contain at
+// least one certificate, and only certificates.
+func parseRootCAs(rootCA []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for rest := rootCA; len(bytes.TrimSpace(rest)) > 0; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return nil, errors.New("failed to decode root CA PEM")
+		}
+
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block type in root CA bundle: %q", block.Type)
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse root CA certificate: %s", err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found in root CA bundle")
+	}
+
+	return certs, nil
+}
+
+// loadRootCAFile reads the root CA bundle at the given path, and sets it as
+// the root CA.
+func (p *Provider) loadRootCAFile(path string) error {
+	rootCA, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read root CA certificate file %s: %s", path, err)
+	}
+
+	return p.setRootCA(rootCA, "file "+path)
+}
+
+// setRootCA validates the given root CA bundle, loaded from source. If it
+// differs from the current root CA, the root CA and TLS config are updated,
+// and subscribers notified.
+func (p *Provider) setRootCA(rootCA []byte, source string) error {
+	if _, err := parseRootCAs(rootCA); err != nil {
+		return fmt.Errorf("invalid root CA from %s: %s", source, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if bytes.Equal(p.rootCA, rootCA) {
+		return nil
+	}
+
+	p.rotateRootCA(rootCA)
+
+	// Update the client verification pool if we are already serving
+	if p.tlsCert != nil {
+		tlsConfig, err := p.buildTLSConfig(p.tlsCert, p.trustBundle())
+		if err != nil {
+			return err
+		}
+		p.tlsConfig = tlsConfig
+
+		p.log.Info("root CA changed, updated root CA", "source", source)
+	}
+
+	p.notifyRootCASubscribers()
+
+	return nil
+}
+
+// watchRootCAFile reloads the root CA whenever the file at the given path
+// changes, until the context is cancelled. The parent directory is watched so
+// that the atomic symlink swap of mounted Secrets and ConfigMaps is observed.
+func (p *Provider) watchRootCAFile(ctx context.Context, path string) error {
+	return watchDir(ctx, p.log.WithValues("file", path), filepath.Dir(path), func() {
+		if err := p.loadRootCAFile(path); err != nil {
+			p.log.Error(err, "failed to reload root CA, continuing to use existing root CA")
+		}
+	})
+}
+
+// rootCAFromObject returns the root CA held in the given key of the Secret or
+// ConfigMap.
+func rootCAFromObject(obj interface{}, key string) []byte {
+	switch o := obj.(type) {
+	case *corev1.Secret:
+		return o.Data[key]
+	case *corev1.ConfigMap:
+		return []byte(o.Data[key])
+	default:
+		return nil
+	}
+}
+
+// watchRootCAObject sources the root CA from the key of the given Secret or
+// ConfigMap. The initial root CA is loaded before returning, after which the
+// object is watched and the root CA updated on change, until the context is
+// cancelled.
+func (p *Provider) watchRootCAObject(ctx context.Context, kubeClient kubernetes.Interface,
+	kind, namespace, name, key string) error {
+	source := fmt.Sprintf("%s %s/%s key %q", kind, namespace, name, key)
+	log := p.log.WithValues("source", source)
+
+	factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+
+	var (
+		obj      interface{}
+		err      error
+		informer cache.SharedIndexInformer
+	)
+
+	switch kind {
+	case "Secret":
+		obj, err = kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		informer = factory.Core().V1().Secrets().Informer()
+	case "ConfigMap":
+		obj, err = kubeClient.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		informer = factory.Core().V1().ConfigMaps().Informer()
+	default:
+		return fmt.Errorf("unsupported root CA source kind %q", kind)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to get root CA %s: %s", source, err)
+	}
+
+	// Load the initial root CA, which must be valid
+	rootCA := rootCAFromObject(obj, key)
+	if len(rootCA) == 0 {
+		return fmt.Errorf("root CA %s is empty or missing", source)
+	}
+	if err := p.setRootCA(rootCA, source); err != nil {
+		return err
+	}
+
+	onObject := func(obj interface{}) {
+		rootCA := rootCAFromObject(obj, key)
+		if len(rootCA) == 0 {
+			log.Info("root CA source key is empty or missing, continuing to use existing root CA")
+			return
+		}
+
+		if err := p.setRootCA(rootCA, source); err != nil {
+			log.Error(err, "failed to load root CA, continuing to use existing root CA")
+		}
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: onObject,
+		UpdateFunc: func(_, obj interface{}) {
+			onObject(obj)
+		},
+		DeleteFunc: func(_ interface{}) {
+			log.Info("root CA source deleted, continuing to use existing root CA")
+		},
+	})
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to wait for root CA %s informer to sync", source)
+	}
+
+	return nil
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+func TestParseRootCAs(t *testing.T) {
+	rootA := gen.MustCertificate(t, gen.SetCertificateCommonName("root-a"), gen.SetCertificateIsCA(true))
+	rootB := gen.MustCertificate(t, gen.SetCertificateCommonName("root-b"), gen.SetCertificateIsCA(true))
+
+	tests := map[string]struct {
+		rootCA   []byte
+		expCerts int
+		expErr   bool
+	}{
+		"if bundle is empty, error": {
+			rootCA: []byte("\n"),
+			expErr: true,
+		},
+		"if bundle is not PEM, error": {
+			rootCA: []byte("not a certificate"),
+			expErr: true,
+		},
+		"if bundle contains a non-certificate block, error": {
+			rootCA: append(rootA, gen.MustCSR(t)...),
+			expErr: true,
+		},
+		"if bundle contains a single certificate, return it": {
+			rootCA:   rootA,
+			expCerts: 1,
+		},
+		"if bundle contains multiple certificates, return all": {
+			rootCA:   append(append([]byte{}, rootA...), rootB...),
+			expCerts: 2,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			certs, err := parseRootCAs(test.rootCA)
+			if (err != nil) != test.expErr {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			if len(certs) != test.expCerts {
+				t.Errorf("unexpected number of certificates, exp=%d got=%d", test.expCerts, len(certs))
+			}
+		})
+	}
+}
+
+func TestWatchRootCAFile(t *testing.T) {
+	rootA := gen.MustCertificate(t, gen.SetCertificateCommonName("root-a"), gen.SetCertificateIsCA(true))
+	rootB := gen.MustCertificate(t, gen.SetCertificateCommonName("root-b"), gen.SetCertificateIsCA(true))
+
+	dir, err := ioutil.TempDir("", "istio-csr-root-ca-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Mimic the Kubernetes atomic writer, where the file is a symlink through
+	// a data directory symlink which is swapped on update.
+	writeData := func(name string, data []byte) {
+		dataDir := filepath.Join(dir, name)
+		if err := os.Mkdir(dataDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dataDir, "ca.pem"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(name, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeData("v1", rootA)
+	path := filepath.Join(dir, "ca.pem")
+	if err := os.Symlink(filepath.Join("..data", "ca.pem"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p := &Provider{log: klogr.New(), now: time.Now}
+	events := p.SubscribeRootCAEvents()
+
+	if err := p.loadRootCAFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.watchRootCAFile(ctx, path); err != nil {
+		t.Fatal(err)
+	}
+	<-events
+
+	// An invalid bundle should not replace the root CA
+	writeData("v2", []byte("not a certificate"))
+	time.Sleep(time.Millisecond * 200)
+	if rootCA := p.RootCA(); !bytes.Equal(rootCA, rootA) {
+		t.Errorf("expected root CA to be unchanged after invalid update, got=%s", rootCA)
+	}
+
+	writeData("v3", rootB)
+	select {
+	case <-events:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for root CA event")
+	}
+
+	if rootCA := p.RootCA(); !bytes.Equal(rootCA, rootB) {
+		t.Errorf("unexpected root CA after update, exp=%s got=%s", rootB, rootCA)
+	}
+}
+
+func TestWatchRootCAObject(t *testing.T) {
+	rootA := gen.MustCertificate(t, gen.SetCertificateCommonName("root-a"), gen.SetCertificateIsCA(true))
+	rootB := gen.MustCertificate(t, gen.SetCertificateCommonName("root-b"), gen.SetCertificateIsCA(true))
+
+	secret := func(data []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "cert-manager", Name: "istio-ca"},
+			Data:       map[string][]byte{"ca.crt": data},
+		}
+	}
+
+	t.Run("if source does not exist, error", func(t *testing.T) {
+		p := &Provider{log: klogr.New(), now: time.Now}
+		err := p.watchRootCAObject(context.TODO(), fake.NewSimpleClientset(), "Secret", "cert-manager", "istio-ca", "ca.crt")
+		if err == nil {
+			t.Error("expected error, got none")
+		}
+	})
+
+	t.Run("if source key is invalid, error", func(t *testing.T) {
+		p := &Provider{log: klogr.New(), now: time.Now}
+		err := p.watchRootCAObject(context.TODO(), fake.NewSimpleClientset(secret([]byte("not a certificate"))),
+			"Secret", "cert-manager", "istio-ca", "ca.crt")
+		if err == nil {
+			t.Error("expected error, got none")
+		}
+	})
+
+	t.Run("if source is updated, root CA should be updated", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		kubeClient := fake.NewSimpleClientset(secret(rootA))
+		p := &Provider{log: klogr.New(), now: time.Now}
+		events := p.SubscribeRootCAEvents()
+
+		if err := p.watchRootCAObject(ctx, kubeClient, "Secret", "cert-manager", "istio-ca", "ca.crt"); err != nil {
+			t.Fatal(err)
+		}
+		<-events
+
+		if rootCA := p.RootCA(); !bytes.Equal(rootCA, rootA) {
+			t.Errorf("unexpected initial root CA, exp=%s got=%s", rootA, rootCA)
+		}
+
+		if _, err := kubeClient.CoreV1().Secrets("cert-manager").Update(ctx, secret(rootB), metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-events:
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for root CA event")
+		}
+
+		if rootCA := p.RootCA(); !bytes.Equal(rootCA, rootB) {
+			t.Errorf("unexpected root CA after update, exp=%s got=%s", rootB, rootCA)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+// writeSecret writes the data to the Secret of the given type, creating it if
+// it doesn't exist. Keys of an existing Secret which are not in data are
+// preserved. Returns an error if an existing Secret is of a different type.
+func writeSecret(ctx context.Context, log logr.Logger, kubeClient kubernetes.Interface,
+	namespace, name string, secretType corev1.SecretType, data map[string][]byte) error {
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		log.Info("creating secret")
+		_, err = kubeClient.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels: map[string]string{
+					util.ManagedByLabelKey: util.ManagedByLabelValue,
+				},
+			},
+			Type: secretType,
+			Data: data,
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to create secret %s/%s: %s", namespace, name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get secret %s/%s: %s", namespace, name, err)
+	}
+
+	if secret.Type != secretType {
+		return fmt.Errorf("secret %s/%s has type %q, expected %q", namespace, name, secret.Type, secretType)
+	}
+
+	if secret.Labels == nil {
+		secret.Labels = make(map[string]string)
+	}
+	secret.Labels[util.ManagedByLabelKey] = util.ManagedByLabelValue
+
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	for k, v := range data {
+		secret.Data[k] = v
+	}
+
+	log.Info("updating secret")
+	if _, err := kubeClient.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update secret %s/%s: %s", namespace, name, err)
+	}
+
+	return nil
+}
+
+// updateSecretKey updates a single key of an existing Secret, re-reading it so
+// that every other key is left unchanged. Does nothing if the Secret doesn't
+// exist, or the key already holds the value.
+func updateSecretKey(ctx context.Context, log logr.Logger, kubeClient kubernetes.Interface,
+	namespace, name, key string, value []byte) error {
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get secret %s/%s: %s", namespace, name, err)
+	}
+
+	if bytes.Equal(secret.Data[key], value) {
+		return nil
+	}
+
+	secret = secret.DeepCopy()
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data[key] = value
+
+	log.Info("updating secret key", "key", key)
+	if _, err := kubeClient.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update secret %s/%s: %s", namespace, name, err)
+	}
+
+	return nil
+}
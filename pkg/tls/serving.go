@@ -0,0 +1,265 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+// setServingCertificate sets the serving certificate and private key, loaded
+// from source, as the latest TLS config for this provider to be fetched by new
+// client connections, returning the parsed certificate. If no custom root CA
+// is configured, the given CA is set as the root CA, and subscribers notified
+// if it has changed.
+func (p *Provider) setServingCertificate(certPEM, pkPEM, caPEM []byte, source string) (*x509.Certificate, error) {
+	tlsCert, err := tls.X509KeyPair(certPEM, pkPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid serving certificate from %s: %s", source, err)
+	}
+
+	tlsCert.Leaf, err = x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse serving certificate from %s: %s", source, err)
+	}
+
+	if p.fips {
+		if err := util.ValidateFIPSPublicKey(tlsCert.Leaf.PublicKey); err != nil {
+			return nil, fmt.Errorf("forbidden serving certificate key from %s: %s", source, err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// If we are not using a custom root CA, then overwrite the existing with
+	// what was given, and notify subscribers if it has changed.
+	if !p.customRootCA && len(caPEM) > 0 && !bytes.Equal(p.rootCA, caPEM) {
+		if p.rootCA != nil {
+			p.log.Info("root CA has changed", "source", source)
+		}
+
+		p.rotateRootCA(caPEM)
+		p.notifyRootCASubscribers()
+	}
+
+	tlsConfig, err := p.buildTLSConfig(&tlsCert, p.trustBundle())
+	if err != nil {
+		return nil, err
+	}
+
+	p.tlsCert = &tlsCert
+	p.tlsConfig = tlsConfig
+
+	select {
+	case p.servingCertificateEvents <- struct{}{}:
+	default:
+	}
+
+	return tlsCert.Leaf, nil
+}
+
+// loadServingCertificate validates the certificate, private key and CA of a
+// kubernetes.io/tls Secret loaded from source, and sets them as the serving
+// certificate. The CA is required if no custom root CA is configured.
+func (p *Provider) loadServingCertificate(certPEM, pkPEM, caPEM []byte, source string) error {
+	if !p.customRootCA && len(caPEM) == 0 {
+		return fmt.Errorf("serving certificate from %s has no %s, and no root CA is configured", source, corev1.ServiceAccountRootCAKey)
+	}
+
+	// Ignore reloads of unchanged contents
+	loaded := bytes.Join([][]byte{certPEM, pkPEM, caPEM}, nil)
+	p.mu.RLock()
+	unchanged := bytes.Equal(p.loadedServingCertificate, loaded)
+	p.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	if _, err := p.setServingCertificate(certPEM, pkPEM, caPEM, source); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.loadedServingCertificate = loaded
+	p.mu.Unlock()
+
+	p.log.Info("loaded serving certificate", "source", source)
+
+	return nil
+}
+
+// loadServingCertificateDir loads the serving certificate from the files of
+// the mounted kubernetes.io/tls Secret directory.
+func (p *Provider) loadServingCertificateDir(dir string) error {
+	read := func(key string, optional bool) ([]byte, error) {
+		data, err := ioutil.ReadFile(filepath.Join(dir, key))
+		if optional && os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read serving certificate file: %s", err)
+		}
+		return data, nil
+	}
+
+	certPEM, err := read(corev1.TLSCertKey, false)
+	if err != nil {
+		return err
+	}
+	pkPEM, err := read(corev1.TLSPrivateKeyKey, false)
+	if err != nil {
+		return err
+	}
+	caPEM, err := read(corev1.ServiceAccountRootCAKey, true)
+	if err != nil {
+		return err
+	}
+
+	return p.loadServingCertificate(certPEM, pkPEM, caPEM, "directory "+dir)
+}
+
+// watchServingCertificateDir reloads the serving certificate whenever the
+// mounted Secret directory changes, until the context is cancelled.
+func (p *Provider) watchServingCertificateDir(ctx context.Context, dir string) error {
+	return watchDir(ctx, p.log.WithValues("directory", dir), dir, func() {
+		if err := p.loadServingCertificateDir(dir); err != nil {
+			p.log.Error(err, "failed to reload serving certificate, continuing to use existing serving certificate")
+		}
+	})
+}
+
+// watchServingCertificateSecret sources the serving certificate from the
+// kubernetes.io/tls Secret. The initial serving certificate is loaded before
+// returning, after which the Secret is watched and the serving certificate
+// updated on change, until the context is cancelled.
+func (p *Provider) watchServingCertificateSecret(ctx context.Context, kubeClient kubernetes.Interface, namespace, name string) error {
+	source := fmt.Sprintf("Secret %s/%s", namespace, name)
+	log := p.log.WithValues("source", source)
+
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get serving certificate %s: %s", source, err)
+	}
+
+	load := func(secret *corev1.Secret) error {
+		return p.loadServingCertificate(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey],
+			secret.Data[corev1.ServiceAccountRootCAKey], source)
+	}
+
+	// Load the initial serving certificate, which must be valid
+	if err := load(secret); err != nil {
+		return err
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+	informer := factory.Core().V1().Secrets().Informer()
+
+	onObject := func(obj interface{}) {
+		secret, ok := obj.(*corev1.Secret)
+		if !ok {
+			return
+		}
+		if err := load(secret); err != nil {
+			log.Error(err, "failed to load serving certificate, continuing to use existing serving certificate")
+		}
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: onObject,
+		UpdateFunc: func(_, obj interface{}) {
+			onObject(obj)
+		},
+		DeleteFunc: func(_ interface{}) {
+			log.Info("serving certificate secret deleted, continuing to use existing serving certificate")
+		},
+	})
+
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("failed to wait for serving certificate %s informer to sync", source)
+	}
+
+	return nil
+}
+
+// watchDir calls reload on every event in the directory, until the context is
+// cancelled. Watching the directory, rather than files, observes the atomic
+// symlink swap of mounted Secrets and ConfigMaps.
+func watchDir(ctx context.Context, log logr.Logger, dir string, reload func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %s", err)
+	}
+
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch directory %s: %s", dir, err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				log.V(3).Info("file event", "event", event.String())
+
+				// Any event in the directory may have changed the files, so always
+				// reload. Unchanged contents are ignored.
+				reload()
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error(err, "file watcher error")
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+func TestLoadServingCertificateDir(t *testing.T) {
+	pk := gen.PrivateKey()
+	certA := gen.MustCertificate(t, gen.SetCertificateCommonName("serving-a"))
+	certB := gen.MustCertificate(t, gen.SetCertificateCommonName("serving-b"))
+	rootCA := gen.MustCertificate(t, gen.SetCertificateCommonName("root"), gen.SetCertificateIsCA(true))
+	existingRootCA := gen.MustCertificate(t, gen.SetCertificateCommonName("existing-root"), gen.SetCertificateIsCA(true))
+
+	tests := map[string]struct {
+		customRootCA bool
+		files        map[string][]byte
+		expErr       bool
+		expCert      []byte
+		expRootCA    []byte
+	}{
+		"if certificate, key and CA are present, should serve certificate and set root CA": {
+			files:     map[string][]byte{"tls.crt": certB, "tls.key": pk, "ca.crt": rootCA},
+			expErr:    false,
+			expCert:   certB,
+			expRootCA: rootCA,
+		},
+		"if CA is missing and a custom root CA is configured, should serve certificate and keep root CA": {
+			customRootCA: true,
+			files:        map[string][]byte{"tls.crt": certB, "tls.key": pk},
+			expErr:       false,
+			expCert:      certB,
+			expRootCA:    existingRootCA,
+		},
+		"if CA is missing and no custom root CA is configured, should error and keep serving certificate": {
+			files:     map[string][]byte{"tls.crt": certB, "tls.key": pk},
+			expErr:    true,
+			expCert:   certA,
+			expRootCA: existingRootCA,
+		},
+		"if key is missing, should error and keep serving certificate": {
+			files:     map[string][]byte{"tls.crt": certB, "ca.crt": rootCA},
+			expErr:    true,
+			expCert:   certA,
+			expRootCA: existingRootCA,
+		},
+		"if key doesn't match certificate, should error and keep serving certificate": {
+			files:     map[string][]byte{"tls.crt": certB, "tls.key": []byte("not a key"), "ca.crt": rootCA},
+			expErr:    true,
+			expCert:   certA,
+			expRootCA: existingRootCA,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "istio-csr-serving")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			for file, data := range test.files {
+				if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			p := &Provider{log: klogr.New(), now: time.Now, customRootCA: test.customRootCA, rootCA: existingRootCA}
+			if _, err := p.setServingCertificate(certA, pk, nil, "test"); err != nil {
+				t.Fatal(err)
+			}
+
+			err = p.loadServingCertificateDir(dir)
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			expServingCertificate(t, p, test.expCert)
+			if !bytes.Equal(p.RootCA(), test.expRootCA) {
+				t.Errorf("unexpected root CA, exp=%q got=%q", test.expRootCA, p.RootCA())
+			}
+		})
+	}
+}
+
+func TestWatchServingCertificateSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pk := gen.PrivateKey()
+	certA := gen.MustCertificate(t, gen.SetCertificateCommonName("serving-a"))
+	certB := gen.MustCertificate(t, gen.SetCertificateCommonName("serving-b"))
+	rootA := gen.MustCertificate(t, gen.SetCertificateCommonName("root-a"), gen.SetCertificateIsCA(true))
+	rootB := gen.MustCertificate(t, gen.SetCertificateCommonName("root-b"), gen.SetCertificateIsCA(true))
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "istio-csr-tls", Namespace: "cert-manager"},
+		Type:       corev1.SecretTypeTLS,
+		Data:       map[string][]byte{"tls.crt": certA, "tls.key": pk, "ca.crt": rootA},
+	}
+	kubeClient := fake.NewSimpleClientset(secret)
+
+	p := &Provider{log: klogr.New(), now: time.Now}
+	events := p.SubscribeRootCAEvents()
+
+	if err := p.watchServingCertificateSecret(ctx, kubeClient, "cert-manager", "istio-csr-tls"); err != nil {
+		t.Fatal(err)
+	}
+
+	expServingCertificate(t, p, certA)
+	if !bytes.Equal(p.RootCA(), rootA) {
+		t.Fatalf("unexpected initial root CA, exp=%q got=%q", rootA, p.RootCA())
+	}
+	<-events
+
+	// Renewed certificate with a rotated root CA should be served
+	secret = secret.DeepCopy()
+	secret.Data = map[string][]byte{"tls.crt": certB, "tls.key": pk, "ca.crt": rootB}
+	if _, err := kubeClient.CoreV1().Secrets("cert-manager").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-events:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected root CA event after secret update")
+	}
+
+	expServingCertificate(t, p, certB)
+	if !bytes.Equal(p.RootCA(), rootB) {
+		t.Errorf("unexpected rotated root CA, exp=%q got=%q", rootB, p.RootCA())
+	}
+}
+
+func TestSetServingCertificateTLSProfile(t *testing.T) {
+	p := &Provider{
+		log:              klogr.New(),
+		now:              time.Now,
+		minVersion:       tls.VersionTLS12,
+		maxVersion:       tls.VersionTLS12,
+		cipherSuites:     util.FIPSCipherSuites,
+		curvePreferences: util.FIPSCurves,
+		fips:             true,
+	}
+
+	t.Run("if fips and serving key is FIPS-approved, should serve it with the TLS profile", func(t *testing.T) {
+		cert := gen.MustCertificate(t, gen.SetCertificateCommonName("serving"))
+		if _, err := p.setServingCertificate(cert, gen.PrivateKey(), nil, "test"); err != nil {
+			t.Fatal(err)
+		}
+
+		expServingCertificate(t, p, cert)
+
+		tlsConfig, err := p.getConfigForClient(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tlsConfig.MinVersion != tls.VersionTLS12 || tlsConfig.MaxVersion != tls.VersionTLS12 {
+			t.Errorf("unexpected TLS versions, min=%x max=%x", tlsConfig.MinVersion, tlsConfig.MaxVersion)
+		}
+		if !reflect.DeepEqual(tlsConfig.CipherSuites, util.FIPSCipherSuites) {
+			t.Errorf("unexpected cipher suites, exp=%v got=%v", util.FIPSCipherSuites, tlsConfig.CipherSuites)
+		}
+		if !reflect.DeepEqual(tlsConfig.CurvePreferences, util.FIPSCurves) {
+			t.Errorf("unexpected curves, exp=%v got=%v", util.FIPSCurves, tlsConfig.CurvePreferences)
+		}
+	})
+
+	t.Run("if fips and serving key is not FIPS-approved, should error", func(t *testing.T) {
+		pk, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pk.Public(), pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkDER, err := x509.MarshalECPrivateKey(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = p.setServingCertificate(
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: pkDER}),
+			nil, "test")
+		if err == nil {
+			t.Error("expected error for P-224 serving key")
+		}
+	})
+}
+
+// expServingCertificate asserts the provider's TLS config serves the given
+// PEM encoded certificate.
+func expServingCertificate(t *testing.T, p *Provider, certPEM []byte) {
+	t.Helper()
+
+	tlsConfig, err := p.getConfigForClient(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatal("failed to decode expected certificate")
+	}
+
+	if !bytes.Equal(tlsConfig.Certificates[0].Certificate[0], block.Bytes) {
+		t.Error("unexpected serving certificate")
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// servingCertificateLeaseDuration is the duration a replica holds the
+	// lease to renew the shared serving certificate for. Other replicas
+	// wait for the renewed certificate to be written to the Secret, until the
+	// lease expires.
+	servingCertificateLeaseDuration = time.Minute * 2
+
+	// servingCertificateLeaseSuffix is appended to the Secret name to name the
+	// renewal Lease, so that it cannot collide with the leader election Lease.
+	servingCertificateLeaseSuffix = "-renewal"
+)
+
+// servingCertificateStore persists the serving certificate and private key in
+// a Secret, so that they are reused by restarted and other replicas while
+// still valid. Renewal is coordinated through a Lease named after the Secret
+// with a "-renewal" suffix, so that only one replica requests a new serving
+// certificate at a time.
+type servingCertificateStore struct {
+	log        logr.Logger
+	provider   *Provider
+	kubeClient kubernetes.Interface
+
+	namespace  string
+	secretName string
+
+	lock *resourcelock.LeaseLock
+
+	// secretEvents receives an event every time the Secret is written, so
+	// that replicas waiting on another replica's renewal load it immediately.
+	secretEvents chan struct{}
+}
+
+// newServingCertificateStore returns a serving certificate store for the
+// Secret of the given name and namespace, and its renewal Lease.
+func newServingCertificateStore(p *Provider, kubeClient kubernetes.Interface, namespace, name string) *servingCertificateStore {
+	// The identity must be unique to this replica, so fall back to a random
+	// one if the hostname, which is the pod name, can't be read
+	identity, err := os.Hostname()
+	if err != nil || len(identity) == 0 {
+		identity = string(uuid.NewUUID())
+	}
+
+	return &servingCertificateStore{
+		log:        p.log.WithName("store").WithValues("secret", namespace+"/"+name),
+		provider:   p,
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		secretName: name,
+		lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name + servingCertificateLeaseSuffix},
+			Client:     kubeClient.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		secretEvents: make(chan struct{}, 1),
+	}
+}
+
+// start watches the Secret until the context is cancelled.
+func (s *servingCertificateStore) start(ctx context.Context) {
+	factory := informers.NewSharedInformerFactoryWithOptions(s.kubeClient, 0,
+		informers.WithNamespace(s.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", s.secretName).String()
+		}),
+	)
+
+	factory.Core().V1().Secrets().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { s.notify() },
+		UpdateFunc: func(interface{}, interface{}) { s.notify() },
+	})
+
+	factory.Start(ctx.Done())
+}
+
+// notify sends a non-blocking event that the Secret has been written.
+func (s *servingCertificateStore) notify() {
+	select {
+	case s.secretEvents <- struct{}{}:
+	default:
+	}
+}
+
+// fetchCertificate serves the certificate stored in the Secret if it is
+// still valid and not yet due for renewal. Otherwise, if the lease can be
+// acquired, a new serving certificate is requested and written to the Secret.
+// The lease is released however the renewal ends, so that other replicas
+// don't wait for it to expire. If another replica holds the lease, waits for
+// it to write the renewed certificate, returning error if it isn't written
+// before the lease expires.
+func (s *servingCertificateStore) fetchCertificate(ctx context.Context) (*x509.Certificate, error) {
+	if cert := s.loadSecret(ctx); cert != nil {
+		s.log.Info("using stored serving certificate")
+		return cert, nil
+	}
+
+	if err := s.tryAcquire(ctx); err != nil {
+		if cert := s.waitForSecret(ctx); cert != nil {
+			s.log.Info("using serving certificate stored by another replica")
+			return cert, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		if err := s.release(ctx); err != nil {
+			s.log.Error(err, "failed to release serving certificate lease")
+		}
+	}()
+
+	cr, pk, err := s.provider.requestServingCertificate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := s.provider.setServingCertificate(cr.Status.Certificate, pk, cr.Status.CA,
+		fmt.Sprintf("CertificateRequest %s/%s", cr.Namespace, cr.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	// Failing to store the certificate shouldn't prevent serving it. Other
+	// replicas will renew themselves once the lease is released.
+	if err := writeSecret(ctx, s.log, s.kubeClient, s.namespace, s.secretName, corev1.SecretTypeTLS, map[string][]byte{
+		corev1.TLSCertKey:              cr.Status.Certificate,
+		corev1.TLSPrivateKeyKey:        pk,
+		corev1.ServiceAccountRootCAKey: cr.Status.CA,
+	}); err != nil {
+		s.log.Error(err, "failed to store serving certificate")
+	}
+
+	return cert, nil
+}
+
+// waitForSecret waits for another replica to write a valid certificate to
+// the Secret, serving and returning it. Returns nil if none is written before
+// the lease duration has passed, or the context is cancelled.
+func (s *servingCertificateStore) waitForSecret(ctx context.Context) *x509.Certificate {
+	timer := time.NewTimer(servingCertificateLeaseDuration)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			return nil
+		case <-s.secretEvents:
+			if cert := s.loadSecret(ctx); cert != nil {
+				return cert
+			}
+		}
+	}
+}
+
+// loadSecret loads the certificate and private key from the Secret, serving
+// and returning the certificate if they are valid for the serving DNS names
+// and IP addresses, and the certificate is not yet due for renewal. Otherwise
+// returns nil.
+func (s *servingCertificateStore) loadSecret(ctx context.Context) *x509.Certificate {
+	secret, err := s.kubeClient.CoreV1().Secrets(s.namespace).Get(ctx, s.secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil
+	}
+
+	certPEM, pkPEM, caPEM := secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], secret.Data[corev1.ServiceAccountRootCAKey]
+	tlsCert, err := tls.X509KeyPair(certPEM, pkPEM)
+	if err != nil {
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+
+	if !sets.NewString(cert.DNSNames...).HasAll(s.provider.servingDNSNames...) {
+		return nil
+	}
+
+	ips := sets.NewString()
+	for _, ip := range cert.IPAddresses {
+		ips.Insert(ip.String())
+	}
+	for _, ip := range s.provider.servingIPAddresses {
+		if !ips.Has(ip.String()) {
+			return nil
+		}
+	}
+
+	if dueForRenewal(cert, s.provider.renewalFraction, s.provider.now()) {
+		return nil
+	}
+
+	cert, err = s.provider.setServingCertificate(certPEM, pkPEM, caPEM, "Secret "+s.namespace+"/"+s.secretName)
+	if err != nil {
+		s.log.Error(err, "failed to serve stored serving certificate")
+		return nil
+	}
+
+	return cert
+}
+
+// tryAcquire attempts to acquire the lease to renew the serving certificate.
+// Returns error if the lease is held by another replica and has not yet
+// expired, or it could not be acquired.
+func (s *servingCertificateStore) tryAcquire(ctx context.Context) error {
+	now := metav1.NewTime(s.provider.now())
+	record := resourcelock.LeaderElectionRecord{
+		HolderIdentity:       s.lock.Identity(),
+		LeaseDurationSeconds: int(servingCertificateLeaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	existing, _, err := s.lock.Get(ctx)
+	if apierrors.IsNotFound(err) {
+		if err := s.lock.Create(ctx, record); err != nil {
+			return fmt.Errorf("failed to create serving certificate lease %s: %s", s.lock.Describe(), err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get serving certificate lease %s: %s", s.lock.Describe(), err)
+	}
+
+	if len(existing.HolderIdentity) > 0 && existing.HolderIdentity != record.HolderIdentity {
+		expiry := existing.RenewTime.Add(time.Duration(existing.LeaseDurationSeconds) * time.Second)
+		if now.Time.Before(expiry) {
+			return fmt.Errorf("serving certificate is being renewed by %q, waiting until %s", existing.HolderIdentity, expiry)
+		}
+	}
+
+	record.LeaderTransitions = existing.LeaderTransitions
+	if existing.HolderIdentity != record.HolderIdentity {
+		record.LeaderTransitions++
+	}
+
+	// Update is conditional on the version of the lease we got, so only one
+	// replica can acquire an expired lease.
+	if err := s.lock.Update(ctx, record); err != nil {
+		return fmt.Errorf("failed to acquire serving certificate lease %s: %s", s.lock.Describe(), err)
+	}
+
+	return nil
+}
+
+// release releases the lease if it is still held by this replica, so that
+// other replicas can acquire it immediately.
+func (s *servingCertificateStore) release(ctx context.Context) error {
+	existing, _, err := s.lock.Get(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get serving certificate lease %s: %s", s.lock.Describe(), err)
+	}
+	if existing.HolderIdentity != s.lock.Identity() {
+		return nil
+	}
+
+	now := metav1.NewTime(s.provider.now())
+	if err := s.lock.Update(ctx, resourcelock.LeaderElectionRecord{
+		LeaseDurationSeconds: 1,
+		AcquireTime:          now,
+		RenewTime:            now,
+		LeaderTransitions:    existing.LeaderTransitions,
+	}); err != nil {
+		return fmt.Errorf("failed to release serving certificate lease %s: %s", s.lock.Describe(), err)
+	}
+
+	return nil
+}
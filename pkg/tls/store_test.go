@@ -0,0 +1,272 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	cmfake "github.com/jetstack/cert-manager/pkg/client/clientset/versioned/fake"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	coretesting "k8s.io/client-go/testing"
+	"k8s.io/klog/v2/klogr"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+	"github.com/cert-manager/istio-csr/test/gen"
+)
+
+func TestServingCertificateStoreLoadSecret(t *testing.T) {
+	now := time.Now()
+	pk := gen.PrivateKey()
+	fresh := gen.MustCertificate(t,
+		gen.SetCertificateNotBefore(now.Add(-time.Hour)), gen.SetCertificateNotAfter(now.Add(time.Hour*23)))
+	due := gen.MustCertificate(t,
+		gen.SetCertificateNotBefore(now.Add(-time.Hour*20)), gen.SetCertificateNotAfter(now.Add(time.Hour*4)))
+	rootCA := gen.MustCertificate(t, gen.SetCertificateCommonName("root"), gen.SetCertificateIsCA(true))
+
+	tests := map[string]struct {
+		data     map[string][]byte
+		dnsNames []string
+		expCert  bool
+	}{
+		"if secret holds a valid certificate not yet due for renewal, should serve it": {
+			data:    map[string][]byte{"tls.crt": fresh, "tls.key": pk, "ca.crt": rootCA},
+			expCert: true,
+		},
+		"if certificate is due for renewal, should return nil": {
+			data:    map[string][]byte{"tls.crt": due, "tls.key": pk, "ca.crt": rootCA},
+			expCert: false,
+		},
+		"if certificate doesn't cover the serving DNS names, should return nil": {
+			data:     map[string][]byte{"tls.crt": fresh, "tls.key": pk, "ca.crt": rootCA},
+			dnsNames: []string{"cert-manager-istio-csr.cert-manager.svc"},
+			expCert:  false,
+		},
+		"if key doesn't match certificate, should return nil": {
+			data:    map[string][]byte{"tls.crt": fresh, "tls.key": []byte("not a key"), "ca.crt": rootCA},
+			expCert: false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "istio-csr-serving", Namespace: "cert-manager"},
+				Type:       corev1.SecretTypeTLS,
+				Data:       test.data,
+			})
+
+			p := &Provider{
+				log:             klogr.New(),
+				now:             func() time.Time { return now },
+				renewalFraction: 2.0 / 3.0,
+				servingDNSNames: test.dnsNames,
+			}
+			s := newServingCertificateStore(p, kubeClient, "cert-manager", "istio-csr-serving")
+
+			cert := s.loadSecret(context.TODO())
+			if (cert != nil) != test.expCert {
+				t.Fatalf("unexpected certificate, exp=%t got=%v", test.expCert, cert)
+			}
+			if test.expCert {
+				expServingCertificate(t, p, fresh)
+			}
+		})
+	}
+}
+
+func TestServingCertificateStoreTryAcquire(t *testing.T) {
+	now := time.Now()
+
+	lease := func(holder string, renewTime time.Time) runtime.Object {
+		duration := int32(120)
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: "istio-csr-serving-renewal", Namespace: "cert-manager"},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &duration,
+				RenewTime:            &metav1.MicroTime{Time: renewTime},
+			},
+		}
+	}
+
+	tests := map[string]struct {
+		existing []runtime.Object
+		expErr   bool
+	}{
+		"if lease doesn't exist, should create and acquire it": {
+			existing: nil,
+			expErr:   false,
+		},
+		"if lease is held by another replica and not expired, should not acquire it": {
+			existing: []runtime.Object{lease("other", now.Add(-time.Minute))},
+			expErr:   true,
+		},
+		"if lease is held by another replica and expired, should acquire it": {
+			existing: []runtime.Object{lease("other", now.Add(-time.Minute*3))},
+			expErr:   false,
+		},
+		"if lease is held by this replica, should acquire it": {
+			existing: []runtime.Object{lease("this", now.Add(-time.Minute))},
+			expErr:   false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			kubeClient := fake.NewSimpleClientset(test.existing...)
+
+			p := &Provider{log: klogr.New(), now: func() time.Time { return now }}
+			s := newServingCertificateStore(p, kubeClient, "cert-manager", "istio-csr-serving")
+			s.lock.LockConfig.Identity = "this"
+
+			err := s.tryAcquire(context.TODO())
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			got, err := kubeClient.CoordinationV1().Leases("cert-manager").Get(context.TODO(), "istio-csr-serving-renewal", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expHolder := "this"
+			if test.expErr {
+				expHolder = "other"
+			}
+			if got.Spec.HolderIdentity == nil || *got.Spec.HolderIdentity != expHolder {
+				t.Errorf("unexpected lease holder, exp=%q got=%v", expHolder, got.Spec.HolderIdentity)
+			}
+		})
+	}
+}
+
+func TestServingCertificateStoreRelease(t *testing.T) {
+	now := time.Now()
+	kubeClient := fake.NewSimpleClientset()
+
+	p := &Provider{log: klogr.New(), now: func() time.Time { return now }}
+	s := newServingCertificateStore(p, kubeClient, "cert-manager", "istio-csr-serving")
+	s.lock.LockConfig.Identity = "this"
+
+	if err := s.tryAcquire(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.release(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := kubeClient.CoordinationV1().Leases("cert-manager").Get(context.TODO(), "istio-csr-serving-renewal", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Spec.HolderIdentity != nil && len(*got.Spec.HolderIdentity) > 0 {
+		t.Errorf("expected lease to have no holder, got=%q", *got.Spec.HolderIdentity)
+	}
+
+	// Another replica should acquire the released lease without waiting for
+	// it to expire
+	other := newServingCertificateStore(p, kubeClient, "cert-manager", "istio-csr-serving")
+	other.lock.LockConfig.Identity = "other"
+	if err := other.tryAcquire(context.TODO()); err != nil {
+		t.Errorf("expected released lease to be acquired, got=%v", err)
+	}
+
+	// Releasing a lease held by another replica should leave it held
+	if err := s.release(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	got, err = kubeClient.CoordinationV1().Leases("cert-manager").Get(context.TODO(), "istio-csr-serving-renewal", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Spec.HolderIdentity == nil || *got.Spec.HolderIdentity != "other" {
+		t.Errorf("expected lease to be held by other, got=%v", got.Spec.HolderIdentity)
+	}
+}
+
+func TestServingCertificateStoreFetchCertificateReleasesOnError(t *testing.T) {
+	now := time.Now()
+	kubeClient := fake.NewSimpleClientset()
+
+	cmClient := cmfake.NewSimpleClientset()
+	cmClient.PrependReactor("create", "certificaterequests", func(coretesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("issuer unavailable")
+	})
+
+	p := &Provider{
+		log:                 klogr.New(),
+		now:                 func() time.Time { return now },
+		client:              cmClient.CertmanagerV1().CertificateRequests("istio-system"),
+		servingDNSNames:     []string{"cert-manager-istio-csr.cert-manager.svc"},
+		servingKeyAlgorithm: util.KeyAlgorithmECDSAP256,
+	}
+	s := newServingCertificateStore(p, kubeClient, "cert-manager", "istio-csr-serving")
+	s.lock.LockConfig.Identity = "this"
+
+	if _, err := s.fetchCertificate(context.TODO()); err == nil {
+		t.Fatal("expected error requesting serving certificate")
+	}
+
+	got, err := kubeClient.CoordinationV1().Leases("cert-manager").Get(context.TODO(), "istio-csr-serving-renewal", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Spec.HolderIdentity != nil && len(*got.Spec.HolderIdentity) > 0 {
+		t.Errorf("expected lease to be released after failed renewal, got holder=%q", *got.Spec.HolderIdentity)
+	}
+}
+
+func TestServingCertificateStoreWaitForSecret(t *testing.T) {
+	now := time.Now()
+	pk := gen.PrivateKey()
+	cert := gen.MustCertificate(t,
+		gen.SetCertificateNotBefore(now.Add(-time.Hour)), gen.SetCertificateNotAfter(now.Add(time.Hour*23)))
+
+	kubeClient := fake.NewSimpleClientset()
+	p := &Provider{
+		log:             klogr.New(),
+		now:             func() time.Time { return now },
+		renewalFraction: 2.0 / 3.0,
+	}
+	s := newServingCertificateStore(p, kubeClient, "cert-manager", "istio-csr-serving")
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second*10)
+	defer cancel()
+	s.start(ctx)
+
+	// Another replica writes the renewed certificate while this one waits
+	go func() {
+		if err := writeSecret(ctx, klogr.New(), kubeClient, "cert-manager", "istio-csr-serving", corev1.SecretTypeTLS, map[string][]byte{
+			"tls.crt": cert,
+			"tls.key": pk,
+		}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if got := s.waitForSecret(ctx); got == nil {
+		t.Fatal("expected certificate written by another replica to be served")
+	}
+	expServingCertificate(t, p, cert)
+}
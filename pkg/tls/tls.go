@@ -18,12 +18,14 @@ package tls
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"net"
+	"net/url"
 	"sync"
 	"time"
 
@@ -32,10 +34,11 @@ import (
 	cmmeta "github.com/jetstack/cert-manager/pkg/apis/meta/v1"
 	cmclient "github.com/jetstack/cert-manager/pkg/client/clientset/versioned/typed/certmanager/v1"
 	"istio.io/istio/pkg/spiffe"
-	pkiutil "istio.io/istio/security/pkg/pki/util"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	"github.com/cert-manager/istio-csr/cmd/app/options"
+	"github.com/cert-manager/istio-csr/pkg/cleanup"
 	"github.com/cert-manager/istio-csr/pkg/util"
 	"github.com/cert-manager/istio-csr/pkg/util/healthz"
 )
@@ -49,106 +52,204 @@ type Provider struct {
 	log logr.Logger
 
 	customRootCA          bool
-	preserveCRs           bool
+	approveCRs            bool
 	servingCertificateTTL time.Duration
-	rootCA                []byte
+
+	// renewalFraction is the fraction of the issued duration of certificates
+	// after which they are renewed. The provider is not ready once the serving
+	// certificate is within expiryDangerWindow of its expiry.
+	renewalFraction    float64
+	expiryDangerWindow time.Duration
+
+	// servingDNSNames, servingIPAddresses and servingKeyAlgorithm are the
+	// SANs and key of requested serving certificates. servingIdentity is the
+	// identity recorded on their CertificateRequests.
+	servingDNSNames     []string
+	servingIPAddresses  []net.IP
+	servingKeyAlgorithm util.KeyAlgorithm
+	servingIdentity     string
+
+	// minVersion, maxVersion, cipherSuites and curvePreferences restrict the
+	// TLS handshake of the served config. If fips is true, only FIPS-approved
+	// serving keys are served.
+	minVersion       uint16
+	maxVersion       uint16
+	cipherSuites     []uint16
+	curvePreferences []tls.CurveID
+	fips             bool
+
+	// rootCA is the current root CA. retiredRootCAs are previous root CAs which
+	// remain in the trust bundle until their retirement time, after the root CA
+	// is rotated.
+	rootCA          []byte
+	retiredRootCAs  []retiredRootCA
+	rootCARetention time.Duration
+
+	// retention, if set, persists the root CA and retired root CAs so that
+	// they are retained across restarts. persistedRootCA is the root CA
+	// persisted by a previous instance, retired on the first rotation.
+	retention       *rootCARetentionStore
+	persistedRootCA []byte
+
+	// now is used to determine the retirement of root CAs
+	now func() time.Time
 
 	client    cmclient.CertificateRequestInterface
 	issuerRef cmmeta.ObjectReference
+	cleanup   *cleanup.Cleaner
 
 	mu        sync.RWMutex
 	readyz    *healthz.Check
+	tlsCert   *tls.Certificate
 	tlsConfig *tls.Config
+
+	// store, if set, persists and shares the serving certificate with other
+	// replicas.
+	store *servingCertificateStore
+
+	// servingCertificateEvents receives an event every time the serving
+	// certificate changes.
+	servingCertificateEvents chan struct{}
+
+	// loadedServingCertificate is the contents of the serving certificate
+	// source last loaded, if not requesting the serving certificate.
+	loadedServingCertificate []byte
+
+	// rootCASubscribers are notified when the root CA changes
+	rootCASubscribers []chan struct{}
+
+	// runnables issue certificates written to Secrets, and are run by the
+	// leader only.
+	runnables []manager.Runnable
 }
 
 // NewProvider will return a new provider where a TLS config is ready to be fetched.
 func NewProvider(ctx context.Context, log logr.Logger, tlsOptions *options.TLSOptions,
 	kubeOptions *options.KubeOptions, cmOptions *options.CertManagerOptions,
-	readyz *healthz.Check) (*Provider, error) {
+	cleanup *cleanup.Cleaner, readyz *healthz.Check) (*Provider, error) {
 
 	p := &Provider{
 		log: log.WithName("serving_certificate"),
 
 		servingCertificateTTL: tlsOptions.ServingCertificateDuration,
-		preserveCRs:           cmOptions.PreserveCRs,
-		customRootCA:          len(tlsOptions.RootCACertFile) > 0,
+		renewalFraction:       tlsOptions.ServingCertificateRenewalFraction,
+		expiryDangerWindow:    tlsOptions.ServingCertificateExpiryDangerWindow,
+		servingDNSNames:       tlsOptions.ServingCertificateDNSNames,
+		servingIPAddresses:    tlsOptions.ServingCertificateIPAddresses,
+		servingKeyAlgorithm:   tlsOptions.ServingCertificateKeyAlgorithm,
+		servingIdentity:       tlsOptions.ServingCertificateIdentity,
+		minVersion:            tlsOptions.TLSMinVersion,
+		maxVersion:            tlsOptions.TLSMaxVersion,
+		cipherSuites:          tlsOptions.TLSCipherSuites,
+		curvePreferences:      tlsOptions.TLSCurvePreferences,
+		fips:                  tlsOptions.FIPS,
+		approveCRs:            cmOptions.ApproveCRs,
+		customRootCA:          len(tlsOptions.RootCACertFile) > 0 || len(tlsOptions.RootCASourceKind) > 0,
+		rootCARetention:       tlsOptions.RootCARetention,
+		now:                   time.Now,
 		client:                kubeOptions.CMClient,
 		issuerRef:             cmOptions.IssuerRef,
+		cleanup:               cleanup,
 		readyz:                readyz,
+
+		servingCertificateEvents: make(chan struct{}, 1),
+	}
+
+	// Seed the root CAs retired by previous instances, before the root CA is
+	// loaded
+	if len(tlsOptions.RootCARetentionConfigMapName) > 0 {
+		p.retention = &rootCARetentionStore{
+			log:        p.log.WithName("retention"),
+			kubeClient: kubeOptions.KubeClient,
+			namespace:  cmOptions.Namespace,
+			name:       tlsOptions.RootCARetentionConfigMapName,
+		}
+		if err := p.loadRetainedRootCAs(ctx); err != nil {
+			p.log.Error(err, "failed to load retired root CAs, previous root CAs will not be retained")
+		}
 	}
 
 	if len(tlsOptions.RootCACertFile) > 0 {
-		rootCA, err := ioutil.ReadFile(tlsOptions.RootCACertFile)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read root CA certificate file %s: %s",
-				tlsOptions.RootCACertFile, err)
+		if err := p.loadRootCAFile(tlsOptions.RootCACertFile); err != nil {
+			return nil, err
 		}
 
-		p.rootCA = rootCA
+		// Reload the root CA whenever the file changes
+		if err := p.watchRootCAFile(ctx, tlsOptions.RootCACertFile); err != nil {
+			return nil, err
+		}
 	}
 
-	p.log.Info("fetching initial serving certificate")
-
-	// Before returning with the provider, we unser a valid, up-to-date TLS
-	// config is ready for serving.
-	p.mustFetchCertificate(ctx)
-
-	go func() {
-		for {
-			// Create a new timer every loop. Renew 2/3 into certificate duration
-			renewalTime := (2 * p.servingCertificateTTL) / 3
-			timer := time.NewTimer(renewalTime)
-
-			p.log.Info("renewing serving certificate", "renewal-time", renewalTime)
-
-			select {
-			case <-ctx.Done():
-				p.readyz.Set(false)
-				p.log.Info("closing renewal", "ctx", ctx.Err())
-				timer.Stop()
-				return
-			case <-timer.C:
-				// Ensure we stop the timer after every tick to release resources
-				timer.Stop()
-			}
-
-			// Renew certificate at every tick
-			p.log.Info("renewing serving certificate")
-			p.mustFetchCertificate(ctx)
+	if len(tlsOptions.RootCASourceKind) > 0 {
+		if err := p.watchRootCAObject(ctx, kubeOptions.KubeClient, tlsOptions.RootCASourceKind,
+			tlsOptions.RootCASourceNamespace, tlsOptions.RootCASourceName, tlsOptions.RootCASourceKey); err != nil {
+			return nil, err
 		}
-	}()
+	}
 
-	p.readyz.Set(true)
+	// Prune retired root CAs from the trust bundle after rotations
+	go p.runRootCAPruner(ctx)
 
-	return p, nil
-}
+	switch {
+	case len(tlsOptions.ServingCertificateDir) > 0:
+		// Serve the certificate of the mounted Secret, reloading it on change
+		if err := p.loadServingCertificateDir(tlsOptions.ServingCertificateDir); err != nil {
+			return nil, err
+		}
+		if err := p.watchServingCertificateDir(ctx, tlsOptions.ServingCertificateDir); err != nil {
+			return nil, err
+		}
 
-// mustFetchCertificate is a blocking func that will fetch a signed certificate
-// for serving. Will not return until a signed certificate has been
-// successfully fetched, for the context had been canceled.
-func (p *Provider) mustFetchCertificate(ctx context.Context) {
-	// Time to attempt to fetch a new certificate if the last failed.
-	ticker := time.NewTicker(time.Second * 20)
-	defer ticker.Stop()
-
-	for {
-		// Fetch a new serving certificate, signed by cert-manager.
-		if err := p.fetchCertificate(ctx); err != nil {
-			p.log.Error(err, "failed to fetch new serving certificate, retrying")
-
-			// Cancel if the context has been canceled. Retry after tick.
-			select {
-			case <-ctx.Done():
-				return
-			case <-ticker.C:
-				continue
-			}
+	case len(tlsOptions.ServingCertificateSecretName) > 0:
+		// Serve the certificate of the Secret, reloading it on change
+		if err := p.watchServingCertificateSecret(ctx, kubeOptions.KubeClient,
+			tlsOptions.ServingCertificateSecretNamespace, tlsOptions.ServingCertificateSecretName); err != nil {
+			return nil, err
+		}
+
+	default:
+		if len(tlsOptions.ServingCertificateStoreSecretName) > 0 {
+			p.store = newServingCertificateStore(p, kubeOptions.KubeClient,
+				tlsOptions.ServingCertificateStoreNamespace, tlsOptions.ServingCertificateStoreSecretName)
+			p.store.start(ctx)
 		}
 
-		p.log.Info("fetched new serving certificate")
+		p.log.Info("fetching initial serving certificate")
 
-		return
+		// Before returning with the provider, we unser a valid, up-to-date TLS
+		// config is ready for serving.
+		cert := mustFetch(ctx, p.log, p.fetchCertificate)
+
+		go renewLoop(ctx, p.log, p.renewalFraction, p.now, cert, p.fetchCertificate)
+	}
+
+	// Optionally issue and renew istiod's serving certificate, once leader
+	if tlsOptions.IstiodCertificate {
+		p.runnables = append(p.runnables, p.newIstiodCertificate(kubeOptions.KubeClient, tlsOptions))
+	}
+
+	// Optionally issue and renew an istio plug-in CA, once leader
+	if tlsOptions.CACerts {
+		p.runnables = append(p.runnables, p.newCACerts(kubeOptions.KubeClient, tlsOptions))
+	}
+
+	// Persist the root CA and retired root CAs whenever they change
+	if p.retention != nil {
+		go p.runRootCARetention(ctx, p.SubscribeRootCAEvents())
 	}
+
+	// Ready while the serving certificate is not close to expiry
+	p.checkReadiness()
+	go p.runReadiness(ctx)
+
+	return p, nil
+}
+
+// Runnables returns the certificate issuers which write to Secrets. These must
+// only be run by the leader, so that replicas don't issue certificates in
+// parallel or overwrite each other's Secrets.
+func (p *Provider) Runnables() []manager.Runnable {
+	return p.runnables
 }
 
 // TLSConfig should be used by consumers of the provider to get a TLS config
@@ -163,6 +264,10 @@ func (p *Provider) TLSConfig() (*tls.Config, error) {
 	return &tls.Config{
 		GetConfigForClient: p.getConfigForClient,
 		ClientAuth:         tls.RequireAndVerifyClientCert,
+		MinVersion:         p.minVersion,
+		MaxVersion:         p.maxVersion,
+		CipherSuites:       p.cipherSuites,
+		CurvePreferences:   p.curvePreferences,
 	}, nil
 }
 
@@ -174,48 +279,142 @@ func (p *Provider) getConfigForClient(_ *tls.ClientHelloInfo) (*tls.Config, erro
 	return p.tlsConfig, nil
 }
 
-// RootCA returns the configured CA certificate
+// RootCA returns the trust bundle, made up of the current root CA and any
+// previous root CAs which have not yet been retired.
 func (p *Provider) RootCA() []byte {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return p.rootCA
+	return p.trustBundle()
+}
+
+// SubscribeRootCAEvents returns a channel which will receive an event every
+// time the root CA changes. Events are not queued, so a subscriber which has
+// not yet handled the last event will only receive one.
+func (p *Provider) SubscribeRootCAEvents() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch := make(chan struct{}, 1)
+	p.rootCASubscribers = append(p.rootCASubscribers, ch)
+
+	return ch
+}
+
+// notifyRootCASubscribers sends an event to all root CA subscribers, without
+// blocking. Must be called with the lock held.
+func (p *Provider) notifyRootCASubscribers() {
+	for _, ch := range p.rootCASubscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
 }
 
 // fetchCertificate will attempt to fetch a new signed certificate with a new
 // private key for serving. This will then be stored as the latest TLS config
-// for this provider to be fetched by new client connections. If this process
-// fails, returns error.
-func (p *Provider) fetchCertificate(ctx context.Context) error {
-	opts := pkiutil.CertOptions{
-		// TODO: allow configurable namespace and service
-		Host:       "cert-manager-istio-csr.cert-manager.svc",
-		IsServer:   true,
-		TTL:        p.servingCertificateTTL,
-		RSAKeySize: 2048,
+// for this provider to be fetched by new client connections, and returned. If
+// this process fails, returns error. If a store is configured, the serving
+// certificate is shared through it with other replicas.
+func (p *Provider) fetchCertificate(ctx context.Context) (*x509.Certificate, error) {
+	if p.store != nil {
+		return p.store.fetchCertificate(ctx)
 	}
 
-	// Generate new CSR and private key for serving
-	csr, pk, err := pkiutil.GenCSR(opts)
+	cr, pk, err := p.requestServingCertificate(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to generate serving private key and CSR: %s", err)
+		return nil, err
 	}
 
-	// Build the CertificateRequest for a serving certificate for this agent
-	// using the configured issuer.
+	return p.setServingCertificate(cr.Status.Certificate, pk, cr.Status.CA,
+		fmt.Sprintf("CertificateRequest %s/%s", cr.Namespace, cr.Name))
+}
+
+// requestServingCertificate requests a new serving certificate from the
+// configured issuer, returning the ready CertificateRequest and private key.
+func (p *Provider) requestServingCertificate(ctx context.Context) (*cmapi.CertificateRequest, []byte, error) {
+	opts := certificateOptions{
+		dnsNames:     p.servingDNSNames,
+		ipAddresses:  p.servingIPAddresses,
+		duration:     p.servingCertificateTTL,
+		keyAlgorithm: p.servingKeyAlgorithm,
+	}
+
+	return p.requestCertificate(ctx, p.log, opts, p.servingIdentity, "istio-csr serving certificate")
+}
+
+// certificateOptions are the options of a certificate requested from the
+// configured issuer.
+type certificateOptions struct {
+	dnsNames     []string
+	ipAddresses  []net.IP
+	uris         []*url.URL
+	organization string
+	isCA         bool
+	duration     time.Duration
+	keyAlgorithm util.KeyAlgorithm
+}
+
+// generateCSR generates a new private key of the options' key algorithm, and a
+// CSR for it with the options' subject and SANs. Returns the PEM encoded CSR
+// and private key.
+func generateCSR(opts certificateOptions) ([]byte, []byte, error) {
+	pk, pkPEM, err := util.GeneratePrivateKey(opts.keyAlgorithm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl := &x509.CertificateRequest{
+		DNSNames:    opts.dnsNames,
+		IPAddresses: opts.ipAddresses,
+		URIs:        opts.uris,
+	}
+	if len(opts.organization) > 0 {
+		tmpl.Subject.Organization = []string{opts.organization}
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, tmpl, pk)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CSR: %s", err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), pkPEM, nil
+}
+
+// requestCertificate generates a new private key, and requests a serving
+// certificate, or a CA certificate if opts.isCA is set, for it with the given
+// options from the configured issuer. The identity is recorded on the
+// CertificateRequest, and the reason in its approval, logs and errors. Returns
+// the ready CertificateRequest and the private key.
+func (p *Provider) requestCertificate(ctx context.Context, log logr.Logger, opts certificateOptions,
+	identity, reason string) (*cmapi.CertificateRequest, []byte, error) {
+	// Generate new CSR and private key
+	csr, pk, err := generateCSR(opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate private key and CSR for %s: %s", reason, err)
+	}
+
+	usages := []cmapi.KeyUsage{cmapi.UsageServerAuth}
+	if opts.isCA {
+		usages = []cmapi.KeyUsage{cmapi.UsageCertSign, cmapi.UsageCRLSign, cmapi.UsageDigitalSignature}
+	}
+
+	// Build the CertificateRequest using the configured issuer.
 	cr := &cmapi.CertificateRequest{
 		ObjectMeta: metav1.ObjectMeta{
 			GenerateName: "cert-manager-istio-csr-",
+			Labels:       util.CertificateRequestLabels(),
 			Annotations: map[string]string{
-				"istio.cert-manager.io/identities": "cert-manager-istio-csr",
+				"istio.cert-manager.io/identities": identity,
 			},
 		},
 		Spec: cmapi.CertificateRequestSpec{
 			Duration: &metav1.Duration{
-				Duration: p.servingCertificateTTL,
+				Duration: opts.duration,
 			},
-			IsCA:      false,
+			IsCA:      opts.isCA,
 			Request:   csr,
-			Usages:    []cmapi.KeyUsage{cmapi.UsageServerAuth},
+			Usages:    usages,
 			IssuerRef: p.issuerRef,
 		},
 	}
@@ -223,82 +422,66 @@ func (p *Provider) fetchCertificate(ctx context.Context) error {
 	// Create CertificateRequest and wait for it to be successfully signed.
 	cr, err = p.client.Create(ctx, cr, metav1.CreateOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to create serving CertificateRequest: %s", err)
+		return nil, nil, fmt.Errorf("failed to create CertificateRequest for %s: %s", reason, err)
 	}
 
-	log := p.log.WithValues("namespace", cr.Namespace, "name", cr.Name)
-	log.Info("created serving CertificateRequest")
+	log = log.WithValues("namespace", cr.Namespace, "name", cr.Name, "reason", reason)
+	log.Info("created CertificateRequest")
 
-	cr, err = util.WaitForCertificateRequestReady(ctx, log, p.client, cr.Name, time.Minute)
-	if err != nil {
-		return fmt.Errorf("failed to wait for CertificateRequest %s/%s to become ready: %s",
-			cr.Namespace, cr.Name, err)
-	}
+	// If we are not preserving CertificateRequests, delete from Kubernetes once
+	// finished with, whether it succeeded or failed
+	defer p.cleanup.Delete(cr.Name)
 
-	log.Info("serving CertificateRequest ready")
-
-	// If we are no preserving CertificateRequests, delete from Kubernetes
-	if !p.preserveCRs {
-		go func() {
-			if err := p.client.Delete(ctx, cr.Name, metav1.DeleteOptions{}); err != nil {
-				log.Error(err, "failed to delete serving CertificateRequest")
-				return
-			}
+	if p.approveCRs {
+		cr, err = util.ApproveCertificateRequest(ctx, p.client, cr, reason)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
-			log.Info("deleted serving CertificateRequest")
-		}()
+	cr, err = util.WaitForCertificateRequestReady(ctx, log, p.client, cr.Name, time.Minute)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wait for CertificateRequest %s/%s for %s to become ready: %s",
+			cr.Namespace, cr.Name, reason, err)
 	}
 
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	log.Info("CertificateRequest ready")
 
-	// If we are not using a custom root CA, then overwrite the existing with
-	// what was responded.
-	if !p.customRootCA {
-		p.rootCA = cr.Status.CA
-	}
+	return cr, pk, nil
+}
 
-	// Parse the root CA if it exists
-	var rootCert *x509.Certificate
-	if len(p.rootCA) > 0 {
-		block, _ := pem.Decode(p.rootCA)
-		if block == nil {
-			return fmt.Errorf("failed to decode root cert PEM")
-		}
-		rootCert, err = x509.ParseCertificate(block.Bytes)
+// buildTLSConfig builds the TLS config which will be used for serving and
+// exposed by this provider. This config will serve using the given signed
+// certificate and private key. Incoming client requests are mutually
+// authenticated against the trust bundle if a certificate is present.
+func (p *Provider) buildTLSConfig(tlsCert *tls.Certificate, trustBundle []byte) (*tls.Config, error) {
+	var rootCerts []*x509.Certificate
+	if len(trustBundle) > 0 {
+		var err error
+		rootCerts, err = parseRootCAs(trustBundle)
 		if err != nil {
-			return fmt.Errorf("failed to parse certificate: %v", err)
+			return nil, err
 		}
 	}
 
-	// Build the client certificate verifier based upon the root certificate
+	// Build the client certificate verifier based upon the root certificates
 	peerCertVerifier := spiffe.NewPeerCertVerifier()
-	peerCertVerifier.AddMapping(spiffe.GetTrustDomain(), []*x509.Certificate{rootCert})
+	peerCertVerifier.AddMapping(spiffe.GetTrustDomain(), rootCerts)
 
-	tlsCert, err := tls.X509KeyPair(cr.Status.Certificate, pk)
-	if err != nil {
-		return err
-	}
-
-	rootCA := x509.NewCertPool()
-	rootCA.AppendCertsFromPEM(p.rootCA)
-
-	// Build the actual TLS config which will be used for serving and exposed by
-	// this provider. This config will serve using the just signed certificate
-	// and private key. Mutually authenticate incoming client requests based if a
-	// certificate is present.
-	p.tlsConfig = &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		ClientAuth:   tls.VerifyClientCertIfGiven,
-		ClientCAs:    peerCertVerifier.GetGeneralCertPool(),
+	return &tls.Config{
+		Certificates:     []tls.Certificate{*tlsCert},
+		ClientAuth:       tls.VerifyClientCertIfGiven,
+		ClientCAs:        peerCertVerifier.GetGeneralCertPool(),
+		MinVersion:       p.minVersion,
+		MaxVersion:       p.maxVersion,
+		CipherSuites:     p.cipherSuites,
+		CurvePreferences: p.curvePreferences,
 		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
 			err := peerCertVerifier.VerifyPeerCert(rawCerts, verifiedChains)
 			if err != nil {
-				log.Error(err, "could not verify certificate")
+				p.log.Error(err, "could not verify certificate")
 			}
 			return err
 		},
-	}
-
-	return nil
+	}, nil
 }
@@ -0,0 +1,107 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/cert-manager/istio-csr/pkg/util"
+)
+
+func TestGenerateCSR(t *testing.T) {
+	tests := map[string]struct {
+		keyAlgorithm util.KeyAlgorithm
+		expKey       func(pub interface{}) bool
+	}{
+		"if RSA-2048, should generate a 2048 bit RSA key": {
+			keyAlgorithm: util.KeyAlgorithmRSA2048,
+			expKey: func(pub interface{}) bool {
+				k, ok := pub.(*rsa.PublicKey)
+				return ok && k.N.BitLen() == 2048
+			},
+		},
+		"if RSA-4096, should generate a 4096 bit RSA key": {
+			keyAlgorithm: util.KeyAlgorithmRSA4096,
+			expKey: func(pub interface{}) bool {
+				k, ok := pub.(*rsa.PublicKey)
+				return ok && k.N.BitLen() == 4096
+			},
+		},
+		"if ECDSA-P256, should generate a P-256 ECDSA key": {
+			keyAlgorithm: util.KeyAlgorithmECDSAP256,
+			expKey: func(pub interface{}) bool {
+				k, ok := pub.(*ecdsa.PublicKey)
+				return ok && k.Curve.Params().Name == "P-256"
+			},
+		},
+		"if ECDSA-P384, should generate a P-384 ECDSA key": {
+			keyAlgorithm: util.KeyAlgorithmECDSAP384,
+			expKey: func(pub interface{}) bool {
+				k, ok := pub.(*ecdsa.PublicKey)
+				return ok && k.Curve.Params().Name == "P-384"
+			},
+		},
+	}
+
+	dnsNames := []string{"istio-csr.istio-system.svc", "istio-csr.eastwest.example.com"}
+	ipAddresses := []net.IP{net.ParseIP("10.0.0.1").To4()}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			csrPEM, pkPEM, err := generateCSR(certificateOptions{
+				dnsNames:     dnsNames,
+				ipAddresses:  ipAddresses,
+				keyAlgorithm: test.keyAlgorithm,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			block, _ := pem.Decode(csrPEM)
+			if block == nil || block.Type != "CERTIFICATE REQUEST" {
+				t.Fatalf("failed to decode CSR PEM: %s", csrPEM)
+			}
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := csr.CheckSignature(); err != nil {
+				t.Errorf("unexpected CSR signature error: %s", err)
+			}
+
+			if !reflect.DeepEqual(csr.DNSNames, dnsNames) {
+				t.Errorf("unexpected DNS names, exp=%v got=%v", dnsNames, csr.DNSNames)
+			}
+			if len(csr.IPAddresses) != 1 || !csr.IPAddresses[0].Equal(ipAddresses[0]) {
+				t.Errorf("unexpected IP addresses, exp=%v got=%v", ipAddresses, csr.IPAddresses)
+			}
+			if !test.expKey(csr.PublicKey) {
+				t.Errorf("unexpected public key of type %T", csr.PublicKey)
+			}
+
+			if block, _ := pem.Decode(pkPEM); block == nil {
+				t.Errorf("failed to decode private key PEM")
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// KeyAlgorithm is the algorithm and size of a generated private key.
+type KeyAlgorithm string
+
+const (
+	KeyAlgorithmRSA2048   KeyAlgorithm = "RSA-2048"
+	KeyAlgorithmRSA4096   KeyAlgorithm = "RSA-4096"
+	KeyAlgorithmECDSAP256 KeyAlgorithm = "ECDSA-P256"
+	KeyAlgorithmECDSAP384 KeyAlgorithm = "ECDSA-P384"
+)
+
+// KeyAlgorithms are the supported key algorithms.
+var KeyAlgorithms = []KeyAlgorithm{
+	KeyAlgorithmRSA2048,
+	KeyAlgorithmRSA4096,
+	KeyAlgorithmECDSAP256,
+	KeyAlgorithmECDSAP384,
+}
+
+// ParseKeyAlgorithm returns the supported key algorithm of the given name,
+// matched case insensitively.
+func ParseKeyAlgorithm(name string) (KeyAlgorithm, error) {
+	var names []string
+	for _, alg := range KeyAlgorithms {
+		if strings.EqualFold(name, string(alg)) {
+			return alg, nil
+		}
+		names = append(names, string(alg))
+	}
+	return "", fmt.Errorf("unsupported key algorithm %q, must be one of %s", name, strings.Join(names, ", "))
+}
+
+// PublicKeyMatchesAlgorithm returns true if the public key is of the given
+// key algorithm and size.
+func PublicKeyMatchesAlgorithm(pub crypto.PublicKey, alg KeyAlgorithm) bool {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return (alg == KeyAlgorithmRSA2048 && key.N.BitLen() == 2048) ||
+			(alg == KeyAlgorithmRSA4096 && key.N.BitLen() == 4096)
+	case *ecdsa.PublicKey:
+		return (alg == KeyAlgorithmECDSAP256 && key.Curve == elliptic.P256()) ||
+			(alg == KeyAlgorithmECDSAP384 && key.Curve == elliptic.P384())
+	default:
+		return false
+	}
+}
+
+// GeneratePrivateKey generates a new private key of the given algorithm,
+// returning it along with its PEM encoding.
+func GeneratePrivateKey(alg KeyAlgorithm) (crypto.Signer, []byte, error) {
+	switch alg {
+	case KeyAlgorithmRSA2048, KeyAlgorithmRSA4096:
+		size := 2048
+		if alg == KeyAlgorithmRSA4096 {
+			size = 4096
+		}
+
+		pk, err := rsa.GenerateKey(rand.Reader, size)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate %s private key: %s", alg, err)
+		}
+
+		return pk, pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(pk),
+		}), nil
+
+	case KeyAlgorithmECDSAP256, KeyAlgorithmECDSAP384:
+		curve := elliptic.P256()
+		if alg == KeyAlgorithmECDSAP384 {
+			curve = elliptic.P384()
+		}
+
+		pk, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to generate %s private key: %s", alg, err)
+		}
+
+		der, err := x509.MarshalECPrivateKey(pk)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode %s private key: %s", alg, err)
+		}
+
+		return pk, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+
+	default:
+		return nil, nil, fmt.Errorf("unsupported key algorithm %q", alg)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"testing"
+)
+
+func TestParseKeyAlgorithm(t *testing.T) {
+	tests := map[string]struct {
+		name   string
+		exp    KeyAlgorithm
+		expErr bool
+	}{
+		"if RSA-2048, should return RSA-2048": {
+			name: "RSA-2048",
+			exp:  KeyAlgorithmRSA2048,
+		},
+		"if lower case ecdsa-p384, should return ECDSA-P384": {
+			name: "ecdsa-p384",
+			exp:  KeyAlgorithmECDSAP384,
+		},
+		"if unsupported algorithm, should error": {
+			name:   "RSA-1024",
+			expErr: true,
+		},
+		"if empty, should error": {
+			name:   "",
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			alg, err := ParseKeyAlgorithm(test.name)
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+			if alg != test.exp {
+				t.Errorf("unexpected key algorithm, exp=%q got=%q", test.exp, alg)
+			}
+		})
+	}
+}
+
+func TestPublicKeyMatchesAlgorithm(t *testing.T) {
+	tests := map[string]struct {
+		keyAlgorithm KeyAlgorithm
+		alg          KeyAlgorithm
+		exp          bool
+	}{
+		"if RSA-2048 key and RSA-2048, should match": {
+			keyAlgorithm: KeyAlgorithmRSA2048,
+			alg:          KeyAlgorithmRSA2048,
+			exp:          true,
+		},
+		"if RSA-2048 key and RSA-4096, should not match": {
+			keyAlgorithm: KeyAlgorithmRSA2048,
+			alg:          KeyAlgorithmRSA4096,
+			exp:          false,
+		},
+		"if ECDSA-P256 key and ECDSA-P256, should match": {
+			keyAlgorithm: KeyAlgorithmECDSAP256,
+			alg:          KeyAlgorithmECDSAP256,
+			exp:          true,
+		},
+		"if ECDSA-P256 key and ECDSA-P384, should not match": {
+			keyAlgorithm: KeyAlgorithmECDSAP256,
+			alg:          KeyAlgorithmECDSAP384,
+			exp:          false,
+		},
+		"if ECDSA-P384 key and RSA-2048, should not match": {
+			keyAlgorithm: KeyAlgorithmECDSAP384,
+			alg:          KeyAlgorithmRSA2048,
+			exp:          false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			sk, _, err := GeneratePrivateKey(test.keyAlgorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if match := PublicKeyMatchesAlgorithm(sk.Public(), test.alg); match != test.exp {
+				t.Errorf("unexpected match, exp=%t got=%t", test.exp, match)
+			}
+		})
+	}
+}
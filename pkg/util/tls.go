@@ -0,0 +1,89 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var (
+	// curves are the supported key exchange curves, by name.
+	curves = map[string]tls.CurveID{
+		"P256":   tls.CurveP256,
+		"P384":   tls.CurveP384,
+		"P521":   tls.CurveP521,
+		"X25519": tls.X25519,
+	}
+
+	// FIPSCipherSuites are the FIPS-approved TLS 1.2 cipher suites.
+	FIPSCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+
+	// FIPSCurves are the FIPS-approved key exchange curves.
+	FIPSCurves = []tls.CurveID{
+		tls.CurveP256,
+		tls.CurveP384,
+		tls.CurveP521,
+	}
+)
+
+// ParseCurves returns the key exchange curves of the given names, one of P256,
+// P384, P521 or X25519, matched case insensitively.
+func ParseCurves(names []string) ([]tls.CurveID, error) {
+	var ids []tls.CurveID
+	for _, name := range names {
+		id, ok := curves[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q, must be one of P256, P384, P521, X25519", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ValidateFIPSPublicKey returns error if the public key is not of a
+// FIPS-approved type and size: RSA of at least 2048 bits, or ECDSA on the
+// P-256, P-384 or P-521 curves.
+func ValidateFIPSPublicKey(pub crypto.PublicKey) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if size := key.N.BitLen(); size < 2048 {
+			return fmt.Errorf("RSA key size %d is not FIPS-approved, must be at least 2048", size)
+		}
+		return nil
+
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+			return nil
+		}
+		return fmt.Errorf("ECDSA curve %s is not FIPS-approved", key.Curve.Params().Name)
+
+	default:
+		return fmt.Errorf("public key type %T is not FIPS-approved", pub)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestParseCurves(t *testing.T) {
+	tests := map[string]struct {
+		names  []string
+		exp    []tls.CurveID
+		expErr bool
+	}{
+		"if no names, should return no curves": {
+			names: nil,
+			exp:   nil,
+		},
+		"if supported names, should return curves in order": {
+			names: []string{"X25519", "p384", "P256"},
+			exp:   []tls.CurveID{tls.X25519, tls.CurveP384, tls.CurveP256},
+		},
+		"if unsupported name, should error": {
+			names:  []string{"P256", "P224"},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			ids, err := ParseCurves(test.names)
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+			if !reflect.DeepEqual(ids, test.exp) {
+				t.Errorf("unexpected curves, exp=%v got=%v", test.exp, ids)
+			}
+		})
+	}
+}
+
+func TestValidateFIPSPublicKey(t *testing.T) {
+	mustKey := func(key crypto.Signer, err error) crypto.PublicKey {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key.Public()
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		pub    crypto.PublicKey
+		expErr bool
+	}{
+		"if RSA-2048, should accept": {
+			pub:    mustKey(rsa.GenerateKey(rand.Reader, 2048)),
+			expErr: false,
+		},
+		"if RSA-1024, should reject": {
+			pub:    mustKey(rsa.GenerateKey(rand.Reader, 1024)),
+			expErr: true,
+		},
+		"if ECDSA P-384, should accept": {
+			pub:    mustKey(ecdsa.GenerateKey(elliptic.P384(), rand.Reader)),
+			expErr: false,
+		},
+		"if ECDSA P-224, should reject": {
+			pub:    mustKey(ecdsa.GenerateKey(elliptic.P224(), rand.Reader)),
+			expErr: true,
+		},
+		"if Ed25519, should reject": {
+			pub:    edPub,
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := ValidateFIPSPublicKey(test.pub)
+			if (err != nil) != test.expErr {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
@@ -18,7 +18,10 @@ package util
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/pem"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -30,8 +33,97 @@ import (
 	"k8s.io/apimachinery/pkg/util/wait"
 )
 
+const (
+	// CertificateRequestConditionApproved indicates that a CertificateRequest
+	// has been approved to be signed, from cert-manager v1.3.
+	CertificateRequestConditionApproved cmapi.CertificateRequestConditionType = "Approved"
+
+	// CertificateRequestConditionDenied indicates that a CertificateRequest has
+	// been denied, and must not be signed, from cert-manager v1.3.
+	CertificateRequestConditionDenied cmapi.CertificateRequestConditionType = "Denied"
+
+	// ApprovalReason is the reason set on Approved and Denied conditions of
+	// CertificateRequests managed by istio-csr.
+	ApprovalReason = "cert-manager-istio-csr.cert-manager.io"
+
+	// ManagedByLabelKey is the label key set on resources created and managed
+	// by istio-csr.
+	ManagedByLabelKey = "app.kubernetes.io/managed-by"
+
+	// ManagedByLabelValue is the label value set on resources created and
+	// managed by istio-csr.
+	ManagedByLabelValue = "cert-manager-istio-csr"
+)
+
+// CertificateFingerprints returns the hex encoded SHA-256 fingerprints of all
+// certificates in the given PEM bundle, comma separated.
+func CertificateFingerprints(pemBundle []byte) string {
+	var fingerprints []string
+	for {
+		var block *pem.Block
+		block, pemBundle = pem.Decode(pemBundle)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		fingerprints = append(fingerprints, fmt.Sprintf("%x", sha256.Sum256(block.Bytes)))
+	}
+
+	return strings.Join(fingerprints, ",")
+}
+
+// CertificateRequestLabels returns the labels set on all CertificateRequests
+// created by istio-csr, used to identify them for garbage collection.
+func CertificateRequestLabels() map[string]string {
+	return map[string]string{
+		ManagedByLabelKey: ManagedByLabelValue,
+	}
+}
+
+// IssuerRefEqual returns true if both issuer references refer to the same
+// issuer. An empty kind defaults to Issuer, and an empty group defaults to
+// cert-manager.io.
+func IssuerRefEqual(a, b cmmeta.ObjectReference) bool {
+	return a.Name == b.Name &&
+		defaultString(a.Kind, "Issuer") == defaultString(b.Kind, "Issuer") &&
+		defaultString(a.Group, "cert-manager.io") == defaultString(b.Group, "cert-manager.io")
+}
+
+// defaultString returns def if s is empty, otherwise s.
+func defaultString(s, def string) string {
+	if len(s) == 0 {
+		return def
+	}
+	return s
+}
+
+// ApproveCertificateRequest will add an Approved condition to the given
+// CertificateRequest, with the given message recording why it was approved.
+func ApproveCertificateRequest(ctx context.Context, cmclient cmclient.CertificateRequestInterface,
+	cr *cmapi.CertificateRequest, message string) (*cmapi.CertificateRequest, error) {
+	cr = cr.DeepCopy()
+	now := metav1.Now()
+	cr.Status.Conditions = append(cr.Status.Conditions, cmapi.CertificateRequestCondition{
+		Type:               CertificateRequestConditionApproved,
+		Status:             cmmeta.ConditionTrue,
+		Reason:             ApprovalReason,
+		Message:            message,
+		LastTransitionTime: &now,
+	})
+
+	cr, err := cmclient.UpdateStatus(ctx, cr, metav1.UpdateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to approve CertificateRequest: %s", err)
+	}
+
+	return cr, nil
+}
+
 // WaitForCertificateRequestReady waits for the CertificateRequest resource to
-// enter a Ready state.
+// enter a Ready state. Returns early with an error if the CertificateRequest
+// has been denied.
 func WaitForCertificateRequestReady(ctx context.Context, log logr.Logger, cmclient cmclient.CertificateRequestInterface,
 	name string, timeout time.Duration) (*cmapi.CertificateRequest, error) {
 	var (
@@ -51,6 +143,13 @@ func WaitForCertificateRequestReady(ctx context.Context, log logr.Logger, cmclie
 				return false, fmt.Errorf("error getting CertificateRequest %s: %v", name, err)
 			}
 
+			if certificateRequestHasCondition(cr, cmapi.CertificateRequestCondition{
+				Type:   CertificateRequestConditionDenied,
+				Status: cmmeta.ConditionTrue,
+			}) {
+				return false, fmt.Errorf("CertificateRequest %s has been denied", name)
+			}
+
 			isReady := certificateRequestHasCondition(cr, cmapi.CertificateRequestCondition{
 				Type:   cmapi.CertificateRequestConditionReady,
 				Status: cmmeta.ConditionTrue,
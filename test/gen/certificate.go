@@ -0,0 +1,154 @@
+/*
+Copyright 2021 The cert-manager Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gen
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type CertificateBuilder struct {
+	cn                  string
+	isCA                bool
+	notBefore, notAfter time.Time
+	dnsNames, uris      []string
+
+	// parent, if set, is the PEM encoded CA certificate which signs the
+	// certificate, rather than it being self-signed.
+	parent []byte
+}
+
+type CertificateModifier func(*CertificateBuilder)
+
+func MustCertificate(t *testing.T, mods ...CertificateModifier) []byte {
+	cert, err := Certificate(mods...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// Certificate returns a PEM encoded certificate, self-signed unless a parent
+// is set.
+func Certificate(mods ...CertificateModifier) ([]byte, error) {
+	certBuilder := &CertificateBuilder{
+		notBefore: time.Now().Add(-time.Minute),
+		notAfter:  time.Now().Add(time.Hour),
+	}
+
+	for _, mod := range mods {
+		mod(certBuilder)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: certBuilder.cn},
+		NotBefore:             certBuilder.notBefore,
+		NotAfter:              certBuilder.notAfter,
+		IsCA:                  certBuilder.isCA,
+		BasicConstraintsValid: true,
+		DNSNames:              certBuilder.dnsNames,
+	}
+
+	for _, uri := range certBuilder.uris {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return nil, err
+		}
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+
+	if certBuilder.isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	}
+
+	parent := tmpl
+	if len(certBuilder.parent) > 0 {
+		block, _ := pem.Decode(certBuilder.parent)
+		if block == nil {
+			return nil, errors.New("failed to decode parent certificate PEM")
+		}
+		parent, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, tmpl, parent, sk.Public(), sk)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes}), nil
+}
+
+func SetCertificateCommonName(cn string) CertificateModifier {
+	return func(cert *CertificateBuilder) {
+		cert.cn = cn
+	}
+}
+
+func SetCertificateIsCA(isCA bool) CertificateModifier {
+	return func(cert *CertificateBuilder) {
+		cert.isCA = isCA
+	}
+}
+
+func SetCertificateDNSNames(dnsNames []string) CertificateModifier {
+	return func(cert *CertificateBuilder) {
+		cert.dnsNames = dnsNames
+	}
+}
+
+func SetCertificateURIs(uris []string) CertificateModifier {
+	return func(cert *CertificateBuilder) {
+		cert.uris = uris
+	}
+}
+
+func SetCertificateNotBefore(notBefore time.Time) CertificateModifier {
+	return func(cert *CertificateBuilder) {
+		cert.notBefore = notBefore
+	}
+}
+
+func SetCertificateNotAfter(notAfter time.Time) CertificateModifier {
+	return func(cert *CertificateBuilder) {
+		cert.notAfter = notAfter
+	}
+}
+
+// SetCertificateParent signs the certificate with the PEM encoded CA
+// certificate, which shares the same private key.
+func SetCertificateParent(parent []byte) CertificateModifier {
+	return func(cert *CertificateBuilder) {
+		cert.parent = parent
+	}
+}
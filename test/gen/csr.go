@@ -42,10 +42,20 @@ func init() {
 	}
 }
 
+// PrivateKey returns the PEM encoded shared private key, which signs generated
+// certificates and CSRs.
+func PrivateKey() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(sk.(*rsa.PrivateKey)),
+	})
+}
+
 type CSRBuilder struct {
 	ids, dns, ips, emails []string
 	cn                    string
 	usages                []x509.KeyUsage
+	signer                crypto.Signer
 }
 
 type CSRModifier func(*CSRBuilder)
@@ -93,7 +103,12 @@ func CSR(mods ...CSRModifier) ([]byte, error) {
 	csr.EmailAddresses = csrBuilder.emails
 	csr.Subject.CommonName = csrBuilder.cn
 
-	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, csr, sk)
+	signer := sk
+	if csrBuilder.signer != nil {
+		signer = csrBuilder.signer
+	}
+
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, csr, signer)
 	if err != nil {
 		return nil, err
 	}
@@ -130,3 +145,9 @@ func SetCSRCommonName(cn string) CSRModifier {
 		csr.cn = cn
 	}
 }
+
+func SetCSRSigner(signer crypto.Signer) CSRModifier {
+	return func(csr *CSRBuilder) {
+		csr.signer = signer
+	}
+}